@@ -0,0 +1,167 @@
+/*
+Package clients registers the Gaia services that may get a token from
+the auth server with the OAuth 2.0 client credentials grant, and gives
+services a TokenSource to get and cache those tokens.
+*/
+package clients
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClientsInvalid = errors.New("error: invalid service clients")
+	ErrClientInvalid  = errors.New("error: unknown client or wrong secret")
+	ErrClientScope    = errors.New("error: client may not request the scope")
+	ErrClientToken    = errors.New("error: unable to get a service token")
+)
+
+// Client is a service allowed to get tokens for audience with some of scopes.
+type Client struct {
+	ID       string   `json:"id"`
+	Secret   string   `json:"secret"`
+	Scopes   []string `json:"scopes"`
+	Audience []string `json:"audience"`
+}
+
+type Registry struct {
+	clients map[string]Client
+}
+
+// Parse reads a JSON list of clients, e.g. [{"id": "crm", "secret": "..", "scopes": ["sessions:revoke"], "audience": ["auth"]}]
+func Parse(data []byte) (*Registry, error) {
+	var list []Client
+	err := json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, errors.Join(ErrClientsInvalid, err)
+	}
+
+	r := &Registry{clients: map[string]Client{}}
+	for i, c := range list {
+		if c.ID == "" || c.Secret == "" || len(c.Audience) == 0 {
+			return nil, errors.Join(ErrClientsInvalid, fmt.Errorf("client %d: id, secret and audience are required", i))
+		}
+		if _, ok := r.clients[c.ID]; ok {
+			return nil, errors.Join(ErrClientsInvalid, fmt.Errorf("client %q is registered twice", c.ID))
+		}
+		r.clients[c.ID] = c
+	}
+	return r, nil
+}
+
+// Authenticate returns the client with id if secret is right. Unknown clients and wrong secrets are the same error.
+func (r *Registry) Authenticate(id string, secret string) (Client, error) {
+	c, ok := r.clients[id]
+	if !ok {
+		// Compare anyway, so the answer takes as long for unknown clients
+		c = Client{Secret: "\x00"}
+	}
+
+	given := sha256.Sum256([]byte(secret))
+	want := sha256.Sum256([]byte(c.Secret))
+	if subtle.ConstantTimeCompare(given[:], want[:]) != 1 || !ok {
+		return Client{}, ErrClientInvalid
+	}
+	return c, nil
+}
+
+// Grant returns the scope the client gets for the space separated requested scope. Requesting nothing grants all of its scopes.
+func (c Client) Grant(requested string) (string, error) {
+	scopes := strings.Fields(requested)
+	if len(scopes) == 0 {
+		return strings.Join(c.Scopes, " "), nil
+	}
+	for _, s := range scopes {
+		if !slices.Contains(c.Scopes, s) {
+			return "", fmt.Errorf("%w: %s", ErrClientScope, s)
+		}
+	}
+	return strings.Join(scopes, " "), nil
+}
+
+/*
+TokenSource gets service tokens from the auth server's /oauth/token and
+keeps them until shortly before they expire. It is safe for concurrent use.
+*/
+type TokenSource struct {
+	url    string
+	id     string
+	secret string
+	scope  string
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Tokens are renewed this long before they expire, so they do not expire on the way
+var RenewBefore = time.Minute
+
+func NewTokenSource(authServer string, id string, secret string, scope string) *TokenSource {
+	return &TokenSource{
+		url:    authServer + "/oauth/token",
+		id:     id,
+		secret: secret,
+		scope:  scope,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Token returns a valid service token, from the cache if it does not expire soon.
+func (s *TokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Until(s.expires) > RenewBefore {
+		return s.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if s.scope != "" {
+		form.Set("scope", s.scope)
+	}
+	req, err := http.NewRequest("POST", s.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.Join(ErrClientToken, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(s.id), url.QueryEscape(s.secret))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", errors.Join(ErrClientToken, err)
+	}
+	defer resp.Body.Close()
+
+	var body tokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", errors.Join(ErrClientToken, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Join(ErrClientToken, fmt.Errorf("%d %s", resp.StatusCode, body.Error))
+	}
+
+	s.token = body.AccessToken
+	s.expires = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	return s.token, nil
+}
@@ -0,0 +1,79 @@
+package clients
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestParse(t *testing.T) {
+	is := is.New(t)
+
+	r, err := Parse([]byte(`[{"id": "crm", "secret": "s3cret", "scopes": ["sessions:revoke"], "audience": ["auth"]}]`))
+	is.NoErr(err)
+
+	c, err := r.Authenticate("crm", "s3cret")
+	is.NoErr(err)
+	is.Equal(c.Audience, []string{"auth"})
+
+	_, err = r.Authenticate("crm", "wrong")
+	is.True(errors.Is(err, ErrClientInvalid))
+	_, err = r.Authenticate("dmi", "s3cret")
+	is.True(errors.Is(err, ErrClientInvalid))
+
+	_, err = Parse([]byte(`[{"id": "crm", "secret": "s3cret"}]`))
+	is.True(errors.Is(err, ErrClientsInvalid))
+	_, err = Parse([]byte(`[{"id": "crm", "secret": "a", "audience": ["auth"]}, {"id": "crm", "secret": "b", "audience": ["auth"]}]`))
+	is.True(errors.Is(err, ErrClientsInvalid))
+}
+
+func TestGrant(t *testing.T) {
+	is := is.New(t)
+
+	c := Client{ID: "dmi", Scopes: []string{"crm:read", "crm:match"}}
+
+	scope, err := c.Grant("")
+	is.NoErr(err)
+	is.Equal(scope, "crm:read crm:match")
+
+	scope, err = c.Grant("crm:match")
+	is.NoErr(err)
+	is.Equal(scope, "crm:match")
+
+	_, err = c.Grant("crm:match crm:delete")
+	is.True(errors.Is(err, ErrClientScope))
+}
+
+func TestTokenSource(t *testing.T) {
+	is := is.New(t)
+
+	issued := 0
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "crm" || secret != "s3cret" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		issued++
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "token", "token_type": "Bearer", "expires_in": 900, "scope": r.FormValue("scope")})
+	}))
+	defer auth.Close()
+
+	source := NewTokenSource(auth.URL, "crm", "s3cret", "sessions:revoke")
+	token, err := source.Token()
+	is.NoErr(err)
+	is.Equal(token, "token")
+
+	// The token is kept until it is about to expire
+	_, err = source.Token()
+	is.NoErr(err)
+	is.Equal(issued, 1)
+
+	_, err = NewTokenSource(auth.URL, "crm", "wrong", "").Token()
+	is.True(errors.Is(err, ErrClientToken))
+}
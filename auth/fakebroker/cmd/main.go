@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/henrikkorsgaard/gaia/auth/fakebroker"
+
+	_ "github.com/joho/godotenv/autoload"
+)
+
+/*
+Runs the fake MitID broker for local development. Point the auth
+server at it with MITID_BROKER_HOST=http://localhost:3030 and the same
+client id and secret.
+*/
+func main() {
+	port := os.Getenv("FAKEBROKER_PORT")
+	if port == "" {
+		port = "3030"
+	}
+
+	broker := fakebroker.New(os.Getenv("MITID_CLIENT_ID"), os.Getenv("MITID_CLIENT_SECRET"))
+	// The identity used by the login page in app/static
+	broker.AddIdentity(fakebroker.Identity{
+		MitIdUUID: "0e4a1734-a8f3-4c49-b09c-35405104725e",
+		Name:      "Bruno Latour",
+	})
+	broker.AddIdentity(fakebroker.Identity{
+		MitIdUUID: "7c1d3c6e-52a4-4a4e-9a0e-3f6f0b3d2c11",
+		Name:      "Isabelle Stengers",
+	})
+
+	fmt.Printf("Fake MitID broker is running on port %s\n", port)
+	log.Fatal(http.ListenAndServe(":"+port, broker))
+}
@@ -0,0 +1,368 @@
+package fakebroker
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/henrikkorsgaard/gaia/auth/jwks"
+)
+
+// Failure makes the broker misbehave in a specific way, to test how the auth server copes.
+type Failure string
+
+const (
+	FailNone        Failure = ""
+	FailExpiredCode Failure = "expired_code" // the token endpoint rejects the code as expired
+	FailBadState    Failure = "bad_state"    // the authorize endpoint returns another state than it was given
+	FailWrongNonce  Failure = "wrong_nonce"  // the id_token carries another nonce than it was given
+	FailServerError Failure = "server_error" // the token and userinfo endpoints answer 503
+)
+
+// How long a code can be exchanged. The real broker is not documented, but it is short.
+var codeTTL = time.Minute
+
+// Identity is a test user at the broker, with the claims MitID returns.
+type Identity struct {
+	Subject   string `json:"sub"`
+	MitIdUUID string `json:"mitid.uuid"`
+	Name      string `json:"mitid.identity_name"`
+}
+
+type grant struct {
+	identity      Identity
+	clientId      string
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	expires       time.Time
+}
+
+/*
+Broker is a stand-in for the MitID broker. It implements enough of
+OpenID Connect for the auth server: discovery, authorize, token,
+userinfo and jwks. There is no login UI. The identity is picked with
+the same simulation parameter the pre-production broker accepts
+(simulation=no-ui uuid:<mitid uuid>), or from a list of links when it
+is missing.
+
+The issuer is derived from the Host of the request, so the same Broker
+works behind httptest and as a command.
+*/
+type Broker struct {
+	clientId     string
+	clientSecret string
+	key          *rsa.PrivateKey
+	kid          string
+	mux          *http.ServeMux
+
+	mu           sync.Mutex
+	identities   map[string]Identity // keyed by mitid uuid
+	order        []string
+	codes        map[string]grant
+	accessTokens map[string]Identity
+	failure      Failure
+}
+
+func New(clientId, clientSecret string) *Broker {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	b := &Broker{
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		key:          key,
+		kid:          randomString(8),
+		identities:   map[string]Identity{},
+		codes:        map[string]grant{},
+		accessTokens: map[string]Identity{},
+	}
+
+	b.mux = http.NewServeMux()
+	b.mux.HandleFunc("/.well-known/openid-configuration", b.discovery)
+	b.mux.HandleFunc("/.well-known/jwks", b.jwks)
+	b.mux.HandleFunc("/connect/authorize", b.authorize)
+	b.mux.HandleFunc("/connect/token", b.token)
+	b.mux.HandleFunc("/connect/userinfo", b.userinfo)
+	return b
+}
+
+// NewServer starts the broker as an httptest fixture. Close it when done.
+func NewServer(clientId, clientSecret string, identities ...Identity) (*Broker, *httptest.Server) {
+	b := New(clientId, clientSecret)
+	for _, i := range identities {
+		b.AddIdentity(i)
+	}
+	return b, httptest.NewServer(b)
+}
+
+func (b *Broker) AddIdentity(identity Identity) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if identity.Subject == "" {
+		identity.Subject = identity.MitIdUUID
+	}
+	if _, ok := b.identities[identity.MitIdUUID]; !ok {
+		b.order = append(b.order, identity.MitIdUUID)
+	}
+	b.identities[identity.MitIdUUID] = identity
+}
+
+// Fail makes every following request fail in the given way, until Fail(FailNone).
+func (b *Broker) Fail(failure Failure) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failure = failure
+}
+
+func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mux.ServeHTTP(w, r)
+}
+
+func (b *Broker) currentFailure() Failure {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failure
+}
+
+func issuer(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func (b *Broker) discovery(w http.ResponseWriter, r *http.Request) {
+	iss := issuer(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                iss,
+		"authorization_endpoint":                iss + "/connect/authorize",
+		"token_endpoint":                        iss + "/connect/token",
+		"userinfo_endpoint":                     iss + "/connect/userinfo",
+		"jwks_uri":                              iss + "/.well-known/jwks",
+		"response_types_supported":              []string{"code"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (b *Broker) jwks(w http.ResponseWriter, r *http.Request) {
+	key, err := jwks.NewKey(b.kid, &b.key.PublicKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	key.Alg = "RS256"
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jwks.Set{Keys: []jwks.Key{key}})
+}
+
+var chooser = template.Must(template.New("chooser").Parse(`<!DOCTYPE html>
+<html>
+<body>
+	<h1>Fake MitID</h1>
+	<ul>
+	{{range .}}<li><a href="{{.Link}}">{{.Name}} ({{.MitIdUUID}})</a></li>
+	{{end}}</ul>
+</body>
+</html>`))
+
+func (b *Broker) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	if q.Get("client_id") != b.clientId || q.Get("response_type") != "code" || q.Get("redirect_uri") == "" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid_request: pkce required", http.StatusBadRequest)
+		return
+	}
+
+	mitid := strings.TrimPrefix(q.Get("simulation"), "no-ui uuid:")
+
+	b.mu.Lock()
+	identity, ok := b.identities[mitid]
+	b.mu.Unlock()
+
+	// Without a known identity we let the developer pick one
+	if !ok {
+		type choice struct {
+			Identity
+			Link string
+		}
+		var choices []choice
+		b.mu.Lock()
+		for _, id := range b.order {
+			c := url.Values{}
+			for k, v := range q {
+				c[k] = v
+			}
+			c.Set("simulation", "no-ui uuid:"+id)
+			choices = append(choices, choice{b.identities[id], "/connect/authorize?" + c.Encode()})
+		}
+		b.mu.Unlock()
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		chooser.Execute(w, choices)
+		return
+	}
+
+	code := randomString(32)
+	b.mu.Lock()
+	b.codes[code] = grant{
+		identity:      identity,
+		clientId:      q.Get("client_id"),
+		redirectURI:   q.Get("redirect_uri"),
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+		expires:       time.Now().Add(codeTTL),
+	}
+	b.mu.Unlock()
+
+	state := q.Get("state")
+	if b.currentFailure() == FailBadState {
+		state = randomString(16)
+	}
+
+	params := url.Values{}
+	params.Add("code", code)
+	params.Add("state", state)
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+params.Encode(), http.StatusFound)
+}
+
+func tokenError(w http.ResponseWriter, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+func (b *Broker) token(w http.ResponseWriter, r *http.Request) {
+	failure := b.currentFailure()
+	if failure == FailServerError {
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.FormValue("client_id") != b.clientId || r.FormValue("client_secret") != b.clientSecret {
+		tokenError(w, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+
+	if r.FormValue("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type", r.FormValue("grant_type"))
+		return
+	}
+
+	// Codes are one-time, also when the exchange fails
+	code := r.FormValue("code")
+	b.mu.Lock()
+	g, ok := b.codes[code]
+	delete(b.codes, code)
+	b.mu.Unlock()
+
+	if !ok {
+		tokenError(w, "invalid_grant", "unknown code")
+		return
+	}
+
+	if failure == FailExpiredCode || time.Now().After(g.expires) {
+		tokenError(w, "invalid_grant", "code has expired")
+		return
+	}
+
+	if g.clientId != r.FormValue("client_id") || g.redirectURI != r.FormValue("redirect_uri") {
+		tokenError(w, "invalid_grant", "code was issued to another client or redirect_uri")
+		return
+	}
+
+	sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != g.codeChallenge {
+		tokenError(w, "invalid_grant", "code_verifier does not match code_challenge")
+		return
+	}
+
+	nonce := g.nonce
+	if failure == FailWrongNonce {
+		nonce = randomString(16)
+	}
+
+	claims := jwt.MapClaims{
+		"iss":   issuer(r),
+		"sub":   g.identity.Subject,
+		"aud":   b.clientId,
+		"nonce": nonce,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(5 * time.Minute).Unix(),
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = b.kid
+	signed, err := idToken.SignedString(b.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	accessToken := randomString(32)
+	b.mu.Lock()
+	b.accessTokens[accessToken] = g.identity
+	b.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"id_token":     signed,
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+	})
+}
+
+func (b *Broker) userinfo(w http.ResponseWriter, r *http.Request) {
+	if b.currentFailure() == FailServerError {
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	accessToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	b.mu.Lock()
+	identity, ok := b.accessTokens[accessToken]
+	b.mu.Unlock()
+
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "invalid_token", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(identity)
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(fmt.Sprintf("unable to read random bytes: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,96 @@
+/*
+Package forwarded carries the identity of the user from the gateway to
+the upstream services.
+
+The gateway removes every identity header the client sent, and for
+logged in users adds a short-lived internal token as the bearer token,
+together with plain X-Gaia-* headers for logging and personalisation.
+Upstreams should trust the headers only after Verifier has checked the
+token.
+*/
+package forwarded
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/henrikkorsgaard/gaia/auth/tokens"
+)
+
+const (
+	HeaderUser  = "X-Gaia-User"
+	HeaderScope = "X-Gaia-Scope"
+	HeaderRoles = "X-Gaia-Roles"
+)
+
+var (
+	ErrForwardedMissing  = errors.New("error: request was not forwarded by the gateway with a user")
+	ErrForwardedMismatch = errors.New("error: forwarded user does not match the internal token")
+)
+
+// Strip removes identity headers set by the client. Only the gateway may set them.
+func Strip(h http.Header) {
+	h.Del("Authorization")
+	for name := range h {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), "X-Gaia-") {
+			h.Del(name)
+		}
+	}
+}
+
+// Set adds the internal token and the identity headers for claims.
+func Set(h http.Header, internalToken string, claims *tokens.UserToken) {
+	h.Set("Authorization", "Bearer "+internalToken)
+	h.Set(HeaderUser, claims.Subject)
+	h.Set(HeaderScope, claims.Scope)
+	if len(claims.Roles) > 0 {
+		h.Set(HeaderRoles, strings.Join(claims.Roles, " "))
+	}
+}
+
+/*
+Verifier checks forwarded requests in an upstream. Keys are usually a
+jwks.RemoteKeySet on the gateway's /.well-known/jwks.json, and audience
+the name of the upstream in the route table.
+*/
+type Verifier struct {
+	validator *tokens.Validator
+	audience  string
+}
+
+func NewVerifier(keys tokens.KeySet, audience string) *Verifier {
+	return &Verifier{validator: tokens.NewValidator(keys), audience: audience}
+}
+
+// User verifies the internal token of the request and that the X-Gaia-* headers agree with it.
+func (v *Verifier) User(r *http.Request) (*tokens.UserToken, error) {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || bearer == "" {
+		return nil, ErrForwardedMissing
+	}
+
+	claims, err := v.validator.Check(bearer, v.audience)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Header.Get(HeaderUser) != claims.Subject || r.Header.Get(HeaderScope) != claims.Scope || r.Header.Get(HeaderRoles) != strings.Join(claims.Roles, " ") {
+		return nil, ErrForwardedMismatch
+	}
+
+	return claims, nil
+}
+
+// Middleware only lets verified requests through. The claims are available with tokens.ClaimsFromContext.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := v.User(r)
+		if err != nil {
+			http.Error(w, err.Error(), tokens.StatusCode(err))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(tokens.NewContext(r.Context(), claims)))
+	})
+}
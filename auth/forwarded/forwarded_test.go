@@ -0,0 +1,83 @@
+package forwarded
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/henrikkorsgaard/gaia/auth/tokens"
+	"github.com/matryer/is"
+)
+
+func TestStrip(t *testing.T) {
+	is := is.New(t)
+
+	h := http.Header{}
+	h.Set("Authorization", "Bearer forged")
+	h.Set(HeaderUser, "someone-else")
+	h.Set("x-gaia-roles", "admin")
+	h.Set("Accept", "text/html")
+
+	Strip(h)
+	is.Equal(len(h), 1)
+	is.Equal(h.Get("Accept"), "text/html")
+}
+
+func TestVerifier(t *testing.T) {
+	is := is.New(t)
+
+	keys, err := tokens.NewKeyRing("ES256")
+	is.NoErr(err)
+	claims := &tokens.UserToken{Scope: "crm:write", Roles: []string{"customer"}}
+	claims.Subject = uuid.NewString()
+
+	internalToken, err := tokens.NewInternalToken(claims, "crm", keys)
+	is.NoErr(err)
+
+	var seen *tokens.UserToken
+	handler := NewVerifier(keys, "crm").Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = tokens.ClaimsFromContext(r.Context())
+	}))
+
+	call := func(h http.Header) int {
+		req := httptest.NewRequest("GET", "/users/"+claims.Subject, nil)
+		req.Header = h
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	h := http.Header{}
+	Set(h, internalToken, claims)
+	is.Equal(call(h), http.StatusOK)
+	is.Equal(seen.Subject, claims.Subject)
+	is.True(seen.HasRole("customer"))
+
+	// The headers are only trusted together with the token
+	h.Set(HeaderUser, uuid.NewString())
+	is.Equal(call(h), http.StatusUnauthorized)
+
+	h = http.Header{}
+	Set(h, internalToken, claims)
+	h.Set(HeaderRoles, "admin")
+	is.Equal(call(h), http.StatusUnauthorized)
+	h.Del(HeaderRoles)
+	is.Equal(call(h), http.StatusUnauthorized)
+
+	h = http.Header{}
+	h.Set(HeaderUser, claims.Subject)
+	is.Equal(call(h), http.StatusUnauthorized)
+
+	// A token minted for another upstream
+	dmiToken, err := tokens.NewInternalToken(claims, "dmi", keys)
+	is.NoErr(err)
+	h = http.Header{}
+	Set(h, dmiToken, claims)
+	is.Equal(call(h), http.StatusForbidden)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	_, err = NewVerifier(keys, "crm").User(req)
+	is.True(errors.Is(err, ErrForwardedMissing))
+}
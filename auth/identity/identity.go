@@ -0,0 +1,72 @@
+package identity
+
+import (
+	"encoding/gob"
+	"errors"
+	"net/url"
+)
+
+var (
+	ErrIdentityUnknownProvider = errors.New("error: unknown identity provider")
+	ErrIdentitySubjectMismatch = errors.New("error: userinfo subject does not match id_token")
+	ErrIdentityIncomplete      = errors.New("error: provider did not return a complete identity")
+)
+
+// Identity is what we know about a user after an identity provider has authenticated them.
+type Identity struct {
+	Provider  string `json:"provider"` // name of the IdentityProvider
+	Subject   string `json:"subject"`  // stable id of the user at the provider
+	Name      string `json:"name"`
+	MitIdUUID string `json:"mitid_uuid,omitempty"` // only set by MitID
+}
+
+func init() {
+	// Identity is kept in the gaia session during onboarding
+	gob.Register(Identity{})
+}
+
+/*
+AuthorizeRequest carries the per-login values from the auth server to
+the provider. The same values are passed to the authorize redirect and
+to the code exchange.
+*/
+type AuthorizeRequest struct {
+	RedirectURI   string
+	State         string
+	Nonce         string
+	CodeChallenge string
+	CodeVerifier  string
+	// Query of the login request. Providers may read dev-only hints from it, e.g. the MitID simulation uuid.
+	Query url.Values
+}
+
+/*
+IdentityProvider is an external (or simulated) login. The auth server
+redirects the user to AuthorizeURL, and the provider sends the user back
+with a code that Exchange turns into a verified Identity.
+*/
+type IdentityProvider interface {
+	Name() string
+	AuthorizeURL(req AuthorizeRequest) (string, error)
+	Exchange(code string, req AuthorizeRequest) (Identity, error)
+}
+
+// SessionEnder is implemented by providers that keep their own login session, which we can end at logout.
+type SessionEnder interface {
+	EndSessionURL(postLogoutRedirectURI string) (string, error)
+}
+
+// Providers maps the {provider} path value to an IdentityProvider
+type Providers map[string]IdentityProvider
+
+func (p Providers) Add(provider IdentityProvider) {
+	p[provider.Name()] = provider
+}
+
+func (p Providers) Get(name string) (IdentityProvider, error) {
+	provider, ok := p[name]
+	if !ok {
+		return nil, ErrIdentityUnknownProvider
+	}
+	return provider, nil
+}
@@ -0,0 +1,61 @@
+package identity
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestSimulatorExchange(t *testing.T) {
+	is := is.New(t)
+
+	sim := NewSimulator()
+	req := AuthorizeRequest{
+		RedirectURI: "http://localhost:3020/account/authenticate",
+		State:       "state",
+		Nonce:       "nonce",
+		Query:       url.Values{"sub": {"abc"}, "name": {"Bruno Latour"}},
+	}
+
+	u, err := sim.AuthorizeURL(req)
+	is.NoErr(err)
+	callback, err := url.Parse(u)
+	is.NoErr(err)
+	is.Equal(callback.Query().Get("state"), "state")
+
+	code := callback.Query().Get("code")
+	ident, err := sim.Exchange(code, req)
+	is.NoErr(err)
+	is.Equal(ident, Identity{Provider: "simulator", Subject: "abc", Name: "Bruno Latour"})
+
+	// codes are one-time
+	_, err = sim.Exchange(code, req)
+	is.True(errors.Is(err, ErrSimulatorUnknownCode))
+}
+
+func TestSimulatorNonce(t *testing.T) {
+	is := is.New(t)
+
+	sim := NewSimulator()
+	u, err := sim.AuthorizeURL(AuthorizeRequest{Nonce: "nonce", Query: url.Values{}})
+	is.NoErr(err)
+	callback, err := url.Parse(u)
+	is.NoErr(err)
+
+	_, err = sim.Exchange(callback.Query().Get("code"), AuthorizeRequest{Nonce: "another nonce"})
+	is.True(errors.Is(err, ErrSimulatorUnknownCode))
+}
+
+func TestUnknownProvider(t *testing.T) {
+	is := is.New(t)
+
+	providers := Providers{}
+	providers.Add(NewSimulator())
+
+	_, err := providers.Get("simulator")
+	is.NoErr(err)
+	_, err = providers.Get("mitid")
+	is.True(errors.Is(err, ErrIdentityUnknownProvider))
+}
@@ -0,0 +1,36 @@
+package identity
+
+import (
+	"net/url"
+)
+
+/*
+NewMitID returns the MitID broker (Signaturgruppen) as an OIDC provider.
+With simulation enabled, a ?mitid=<uuid> query on the login request
+logs in as that test identity without the MitID UI. This only works
+against the pre-production broker.
+*/
+func NewMitID(host, clientId, clientSecret string, simulation bool) *OIDCProvider {
+	p := NewOIDC("mitid", host, clientId, clientSecret)
+	p.scope = "openid mitid"
+	p.mapper = mitidClaims
+
+	if simulation {
+		p.extraParams = func(req AuthorizeRequest, params url.Values) {
+			if req.Query.Get("mitid") != "" {
+				params.Add("simulation", "no-ui uuid:"+req.Query.Get("mitid")) //0e4a1734-a8f3-4c49-b09c-35405104725e
+			}
+		}
+	}
+
+	return p
+}
+
+func mitidClaims(claims map[string]any) Identity {
+	uuid, _ := claims["mitid.uuid"].(string)
+	name, _ := claims["mitid.identity_name"].(string)
+	return Identity{
+		MitIdUUID: uuid,
+		Name:      name,
+	}
+}
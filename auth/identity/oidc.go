@@ -0,0 +1,96 @@
+package identity
+
+import (
+	"net/url"
+
+	"github.com/henrikkorsgaard/gaia/auth/oidc"
+)
+
+// ClaimMapper turns the userinfo claims of a provider into an Identity.
+type ClaimMapper func(claims map[string]any) Identity
+
+/*
+OIDCProvider is a generic OpenID Connect identity provider. The
+provider specific parts are the scope, extra authorize parameters and
+how the userinfo claims map to an Identity.
+*/
+type OIDCProvider struct {
+	name   string
+	scope  string
+	mapper ClaimMapper
+	// extraParams adds provider specific authorize parameters
+	extraParams func(req AuthorizeRequest, params url.Values)
+	oidc        *oidc.Provider
+}
+
+// NewOIDC returns a provider using the standard sub and name claims.
+func NewOIDC(name, host, clientId, clientSecret string) *OIDCProvider {
+	return &OIDCProvider{
+		name:   name,
+		scope:  "openid profile",
+		mapper: standardClaims,
+		oidc:   oidc.New(host, clientId, clientSecret),
+	}
+}
+
+func (p *OIDCProvider) Name() string {
+	return p.name
+}
+
+func (p *OIDCProvider) AuthorizeURL(req AuthorizeRequest) (string, error) {
+	params := url.Values{}
+	params.Add("redirect_uri", req.RedirectURI)
+	params.Add("scope", p.scope)
+	params.Add("state", req.State)
+	params.Add("nonce", req.Nonce)
+	params.Add("code_challenge", req.CodeChallenge)
+	params.Add("code_challenge_method", "S256")
+
+	if p.extraParams != nil {
+		p.extraParams(req, params)
+	}
+
+	return p.oidc.AuthorizeURL(params)
+}
+
+func (p *OIDCProvider) EndSessionURL(postLogoutRedirectURI string) (string, error) {
+	return p.oidc.EndSessionURL(postLogoutRedirectURI)
+}
+
+// Exchange verifies the id_token before the userinfo is trusted, and checks that both are about the same subject.
+func (p *OIDCProvider) Exchange(code string, req AuthorizeRequest) (identity Identity, err error) {
+	tokens, err := p.oidc.Exchange(code, req.RedirectURI, url.Values{"code_verifier": {req.CodeVerifier}})
+	if err != nil {
+		return identity, err
+	}
+
+	idToken, err := p.oidc.VerifyIDToken(tokens.IdToken, req.Nonce)
+	if err != nil {
+		return identity, err
+	}
+
+	claims := map[string]any{}
+	err = p.oidc.UserInfo(tokens.AccessToken, &claims)
+	if err != nil {
+		return identity, err
+	}
+
+	if sub, _ := claims["sub"].(string); sub != idToken.Subject {
+		return identity, ErrIdentitySubjectMismatch
+	}
+
+	identity = p.mapper(claims)
+	identity.Provider = p.name
+	identity.Subject = idToken.Subject
+
+	if identity.Name == "" {
+		return identity, ErrIdentityIncomplete
+	}
+
+	return identity, nil
+}
+
+func standardClaims(claims map[string]any) Identity {
+	name, _ := claims["name"].(string)
+	return Identity{Name: name}
+}
@@ -0,0 +1,85 @@
+package identity
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+var ErrSimulatorUnknownCode = errors.New("error: simulator does not know the code")
+
+/*
+Simulator is a dev-only identity provider that never leaves the auth
+server. AuthorizeURL sends the user straight back to the callback with
+a one-time code for an identity taken from the login query:
+
+	/account/login/simulator?sub=<subject>&name=<name>&mitid=<uuid>
+
+Missing values are made up. It must never be registered outside dev.
+*/
+type Simulator struct {
+	mu    sync.Mutex
+	codes map[string]simulatedLogin
+}
+
+type simulatedLogin struct {
+	identity Identity
+	nonce    string
+}
+
+func NewSimulator() *Simulator {
+	return &Simulator{codes: map[string]simulatedLogin{}}
+}
+
+func (s *Simulator) Name() string {
+	return "simulator"
+}
+
+func (s *Simulator) AuthorizeURL(req AuthorizeRequest) (string, error) {
+	identity := Identity{
+		Subject:   req.Query.Get("sub"),
+		Name:      req.Query.Get("name"),
+		MitIdUUID: req.Query.Get("mitid"),
+	}
+	if identity.Subject == "" {
+		identity.Subject = uuid.NewString()
+	}
+	if identity.Name == "" {
+		identity.Name = "Simulated User"
+	}
+
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	code := base64.RawURLEncoding.EncodeToString(b)
+
+	s.mu.Lock()
+	s.codes[code] = simulatedLogin{identity: identity, nonce: req.Nonce}
+	s.mu.Unlock()
+
+	params := url.Values{}
+	params.Add("state", req.State)
+	params.Add("code", code)
+	return req.RedirectURI + "?" + params.Encode(), nil
+}
+
+// Exchange hands out the identity once, for the login that asked for it.
+func (s *Simulator) Exchange(code string, req AuthorizeRequest) (Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	login, ok := s.codes[code]
+	delete(s.codes, code)
+	if !ok || login.nonce != req.Nonce {
+		return Identity{}, ErrSimulatorUnknownCode
+	}
+
+	login.identity.Provider = s.Name()
+	return login.identity, nil
+}
@@ -0,0 +1,234 @@
+package jwks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrJWKSFetch          = errors.New("error: unable to fetch jwks")
+	ErrJWKSUnknownKey     = errors.New("error: no key in jwks matches kid")
+	ErrJWKSUnsupportedKey = errors.New("error: unsupported key in jwks")
+)
+
+// Keys are refetched when they are older than this, even if every kid is known.
+var cacheTTL = 24 * time.Hour
+
+// An unknown kid triggers a refetch, but never more often than this.
+// This stops a stream of forged kids from hammering the provider.
+// One unknown kid in the interval still forces a refetch, so a key
+// rotated just after the last fetch is found.
+var MinRefreshInterval = 30 * time.Second
+
+// Key is a single JSON Web Key as defined in RFC 7517.
+// Only the fields needed for RSA, EC and OKP (Ed25519) public keys are mapped.
+type Key struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type Set struct {
+	Keys []Key `json:"keys"`
+}
+
+// PublicKey decodes the JWK into a key usable with jwt.Parse.
+func (k Key) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.Join(ErrJWKSUnsupportedKey, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, errors.Join(ErrJWKSUnsupportedKey, err)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("%w: curve %s", ErrJWKSUnsupportedKey, k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, errors.Join(ErrJWKSUnsupportedKey, err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, errors.Join(ErrJWKSUnsupportedKey, err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("%w: curve %s", ErrJWKSUnsupportedKey, k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.Join(ErrJWKSUnsupportedKey, err)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("%w: kty %s", ErrJWKSUnsupportedKey, k.Kty)
+}
+
+// NewKey encodes a public key as a JWK with the given kid.
+func NewKey(kid string, pub crypto.PublicKey) (Key, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return Key{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}, nil
+
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return Key{
+			Kty: "EC",
+			Kid: kid,
+			Use: "sig",
+			Crv: pub.Curve.Params().Name,
+			X:   base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size))),
+			Y:   base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size))),
+		}, nil
+
+	case ed25519.PublicKey:
+		return Key{
+			Kty: "OKP",
+			Kid: kid,
+			Use: "sig",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(pub),
+		}, nil
+	}
+
+	return Key{}, ErrJWKSUnsupportedKey
+}
+
+/*
+RemoteKeySet caches the keys published on a jwks_uri.
+
+Keys are looked up by kid. When the provider rotates its keys the new
+kid will be unknown to us, and that triggers a refetch. Keys that are
+removed by the provider disappear from the cache on the next fetch.
+*/
+type RemoteKeySet struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	forced  bool // an unknown kid has refetched inside MinRefreshInterval of the fetch before
+}
+
+func NewRemoteKeySet(url string, client *http.Client) *RemoteKeySet {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &RemoteKeySet{
+		url:    url,
+		client: client,
+		keys:   map[string]crypto.PublicKey{},
+	}
+}
+
+// Key returns the public key for kid, fetching the jwks if the cache is stale or the kid is unknown.
+func (s *RemoteKeySet) Key(kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.fetched) > cacheTTL {
+		if err := s.fetch(); err != nil {
+			return nil, err
+		}
+	}
+
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+
+	forced := time.Since(s.fetched) < MinRefreshInterval
+	if forced && s.forced {
+		return nil, ErrJWKSUnknownKey
+	}
+
+	if err := s.fetch(); err != nil {
+		return nil, err
+	}
+	s.forced = forced
+
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+
+	return nil, ErrJWKSUnknownKey
+}
+
+// fetch replaces the cached keys. The caller must hold s.mu.
+func (s *RemoteKeySet) fetch() error {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return errors.Join(ErrJWKSFetch, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s returned %d", ErrJWKSFetch, s.url, resp.StatusCode)
+	}
+
+	var set Set
+	err = json.NewDecoder(resp.Body).Decode(&set)
+	if err != nil {
+		return errors.Join(ErrJWKSFetch, err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.PublicKey()
+		if err != nil {
+			// skip keys we cannot use rather than failing the whole set
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	s.keys = keys
+	s.fetched = time.Now()
+	return nil
+}
@@ -0,0 +1,249 @@
+package oidc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/henrikkorsgaard/gaia/auth/jwks"
+)
+
+var (
+	ErrDiscovery      = errors.New("error: unable to fetch openid configuration")
+	ErrTokenExchange  = errors.New("error: provider rejected code exchange")
+	ErrUserInfo       = errors.New("error: provider rejected userinfo request")
+	ErrIDTokenMissing = errors.New("error: provider did not return an id_token")
+	ErrIDTokenInvalid = errors.New("error: id_token is invalid")
+	ErrIDTokenNonce   = errors.New("error: id_token nonce does not match")
+)
+
+// Algorithms we accept on id_tokens. HS256 is deliberately missing, the client secret is not a signing key.
+var validMethods = []string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "ES512", "EdDSA"}
+
+// Configuration is the subset of /.well-known/openid-configuration we use.
+type Configuration struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+type Tokens struct {
+	IdToken     string `json:"id_token"`
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+type IDToken struct {
+	Nonce string `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+/*
+Provider talks to a single OpenID Connect provider.
+
+The openid configuration is discovered lazily on first use, so a
+provider that is down when we start does not stop the service from
+starting. The discovered configuration is cached for the lifetime of
+the Provider while the signing keys are cached and rotated by the
+jwks.RemoteKeySet.
+*/
+type Provider struct {
+	host         string
+	clientId     string
+	clientSecret string
+	client       *http.Client
+
+	mu     sync.Mutex
+	config *Configuration
+	keys   *jwks.RemoteKeySet
+}
+
+func New(host, clientId, clientSecret string) *Provider {
+	return &Provider{
+		host:         strings.TrimSuffix(host, "/"),
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Configuration returns the discovered configuration, fetching it if needed.
+func (p *Provider) Configuration() (Configuration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.config != nil {
+		return *p.config, nil
+	}
+
+	resp, err := p.client.Get(p.host + "/.well-known/openid-configuration")
+	if err != nil {
+		return Configuration{}, errors.Join(ErrDiscovery, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Configuration{}, fmt.Errorf("%w: provider returned %d", ErrDiscovery, resp.StatusCode)
+	}
+
+	var config Configuration
+	err = json.NewDecoder(resp.Body).Decode(&config)
+	if err != nil {
+		return Configuration{}, errors.Join(ErrDiscovery, err)
+	}
+
+	if config.Issuer == "" || config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.JwksURI == "" {
+		return Configuration{}, fmt.Errorf("%w: configuration is incomplete", ErrDiscovery)
+	}
+
+	p.config = &config
+	p.keys = jwks.NewRemoteKeySet(config.JwksURI, p.client)
+	return config, nil
+}
+
+// AuthorizeURL returns the url we redirect the user to, with client_id and response_type added to params.
+func (p *Provider) AuthorizeURL(params url.Values) (string, error) {
+	config, err := p.Configuration()
+	if err != nil {
+		return "", err
+	}
+
+	params.Set("response_type", "code")
+	params.Set("client_id", p.clientId)
+
+	return config.AuthorizationEndpoint + "?" + params.Encode(), nil
+}
+
+// EndSessionURL returns the url that ends the users session at the provider, or "" if the provider has none.
+func (p *Provider) EndSessionURL(postLogoutRedirectURI string) (string, error) {
+	config, err := p.Configuration()
+	if err != nil {
+		return "", err
+	}
+
+	if config.EndSessionEndpoint == "" {
+		return "", nil
+	}
+
+	params := url.Values{}
+	params.Set("client_id", p.clientId)
+	params.Set("post_logout_redirect_uri", postLogoutRedirectURI)
+	return config.EndSessionEndpoint + "?" + params.Encode(), nil
+}
+
+// Exchange trades the authorization code for tokens. Extra form values, e.g. a PKCE code_verifier, are passed in params.
+func (p *Provider) Exchange(code, redirectURI string, params url.Values) (tokens Tokens, err error) {
+	config, err := p.Configuration()
+	if err != nil {
+		return tokens, err
+	}
+
+	data := url.Values{}
+	for k, v := range params {
+		data[k] = v
+	}
+	data.Set("client_id", p.clientId)
+	data.Set("client_secret", p.clientSecret)
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", code)
+	data.Set("redirect_uri", redirectURI)
+
+	resp, err := p.client.Post(config.TokenEndpoint, "application/x-www-form-urlencoded", strings.NewReader(data.Encode()))
+	if err != nil {
+		return tokens, errors.Join(ErrTokenExchange, err)
+	}
+	// we need to close this, see: https://stackoverflow.com/questions/23928983/defer-body-close-after-receiving-response
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return tokens, errors.Join(ErrTokenExchange, errors.New(string(body)))
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&tokens)
+	if err != nil {
+		return tokens, errors.Join(ErrTokenExchange, err)
+	}
+
+	if tokens.IdToken == "" {
+		return tokens, ErrIDTokenMissing
+	}
+
+	return tokens, nil
+}
+
+// UserInfo decodes the userinfo response into v.
+func (p *Provider) UserInfo(accessToken string, v any) error {
+	config, err := p.Configuration()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", config.UserinfoEndpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return errors.Join(ErrUserInfo, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: provider returned %d", ErrUserInfo, resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return errors.Join(ErrUserInfo, err)
+	}
+
+	return nil
+}
+
+/*
+VerifyIDToken checks the signature against the provider jwks and
+validates iss, aud, exp and nonce. The nonce is the one we sent with
+the authorize request for this login.
+*/
+func (p *Provider) VerifyIDToken(raw, nonce string) (*IDToken, error) {
+	config, err := p.Configuration()
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &IDToken{}
+	_, err = jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.keys.Key(kid)
+	},
+		jwt.WithValidMethods(validMethods),
+		jwt.WithIssuer(config.Issuer),
+		jwt.WithAudience(p.clientId),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, errors.Join(ErrIDTokenInvalid, err)
+	}
+
+	if nonce == "" || claims.Nonce != nonce {
+		return nil, ErrIDTokenNonce
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,223 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/henrikkorsgaard/gaia/auth/jwks"
+	"github.com/matryer/is"
+)
+
+const testClientId = "gaia-test-client"
+
+// fakeProvider serves discovery and jwks, and signs id_tokens with whatever keys it currently publishes
+type fakeProvider struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	kid     string       // current signing key
+	fetches atomic.Int32 // of the jwks
+}
+
+func newFakeProvider() *fakeProvider {
+	f := &fakeProvider{keys: map[string]*rsa.PrivateKey{}}
+	f.rotate()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Configuration{
+			Issuer:                f.URL,
+			AuthorizationEndpoint: f.URL + "/connect/authorize",
+			TokenEndpoint:         f.URL + "/connect/token",
+			UserinfoEndpoint:      f.URL + "/connect/userinfo",
+			JwksURI:               f.URL + "/.well-known/jwks",
+		})
+	})
+	mux.HandleFunc("/.well-known/jwks", func(w http.ResponseWriter, r *http.Request) {
+		f.fetches.Add(1)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		set := jwks.Set{}
+		for kid, key := range f.keys {
+			set.Keys = append(set.Keys, jwks.Key{
+				Kty: "RSA",
+				Kid: kid,
+				Use: "sig",
+				Alg: "RS256",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(set)
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// rotate adds a new signing key and keeps the old ones published
+func (f *fakeProvider) rotate() string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.kid = uuid.NewString()
+	f.keys[f.kid] = key
+	return f.kid
+}
+
+// retire stops publishing kid
+func (f *fakeProvider) retire(kid string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.keys, kid)
+}
+
+func (f *fakeProvider) sign(claims IDToken, kid string) string {
+	f.mu.Lock()
+	key := f.keys[kid]
+	f.mu.Unlock()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func (f *fakeProvider) claims(nonce string) IDToken {
+	return IDToken{
+		Nonce: nonce,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    f.URL,
+			Subject:   uuid.NewString(),
+			Audience:  jwt.ClaimStrings{testClientId},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	is := is.New(t)
+	fake := newFakeProvider()
+	defer fake.Close()
+
+	p := New(fake.URL, testClientId, "secret")
+	config, err := p.Configuration()
+	is.NoErr(err)
+	is.Equal(config.Issuer, fake.URL)
+	is.Equal(config.TokenEndpoint, fake.URL+"/connect/token")
+}
+
+func TestDiscoveryFail(t *testing.T) {
+	is := is.New(t)
+	fake := newFakeProvider()
+	fake.Close()
+
+	p := New(fake.URL, testClientId, "secret")
+	_, err := p.Configuration()
+	is.True(errors.Is(err, ErrDiscovery))
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	is := is.New(t)
+	fake := newFakeProvider()
+	defer fake.Close()
+
+	p := New(fake.URL, testClientId, "secret")
+	nonce := uuid.NewString()
+	claims := fake.claims(nonce)
+
+	idToken, err := p.VerifyIDToken(fake.sign(claims, fake.kid), nonce)
+	is.NoErr(err)
+	is.Equal(idToken.Subject, claims.Subject)
+}
+
+func TestVerifyIDTokenRejected(t *testing.T) {
+	is := is.New(t)
+	fake := newFakeProvider()
+	defer fake.Close()
+
+	p := New(fake.URL, testClientId, "secret")
+	nonce := uuid.NewString()
+
+	wrongIssuer := fake.claims(nonce)
+	wrongIssuer.Issuer = "https://evil.example.com"
+	_, err := p.VerifyIDToken(fake.sign(wrongIssuer, fake.kid), nonce)
+	is.True(errors.Is(err, ErrIDTokenInvalid))
+
+	wrongAudience := fake.claims(nonce)
+	wrongAudience.Audience = jwt.ClaimStrings{"another-client"}
+	_, err = p.VerifyIDToken(fake.sign(wrongAudience, fake.kid), nonce)
+	is.True(errors.Is(err, ErrIDTokenInvalid))
+
+	expired := fake.claims(nonce)
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-10 * time.Minute))
+	_, err = p.VerifyIDToken(fake.sign(expired, fake.kid), nonce)
+	is.True(errors.Is(err, ErrIDTokenInvalid))
+
+	_, err = p.VerifyIDToken(fake.sign(fake.claims(nonce), fake.kid), "another nonce")
+	is.True(errors.Is(err, ErrIDTokenNonce))
+
+	// a token signed with the client secret must never be accepted
+	hmac, err := jwt.NewWithClaims(jwt.SigningMethodHS256, fake.claims(nonce)).SignedString([]byte("secret"))
+	is.NoErr(err)
+	_, err = p.VerifyIDToken(hmac, nonce)
+	is.True(errors.Is(err, ErrIDTokenInvalid))
+}
+
+func TestKeyRotation(t *testing.T) {
+	is := is.New(t)
+	fake := newFakeProvider()
+	defer fake.Close()
+
+	p := New(fake.URL, testClientId, "secret")
+	nonce := uuid.NewString()
+	oldKid := fake.kid
+
+	_, err := p.VerifyIDToken(fake.sign(fake.claims(nonce), oldKid), nonce)
+	is.NoErr(err)
+
+	// The provider rotates, and the unknown kid makes us refetch the keys, also right after the last fetch
+	newKid := fake.rotate()
+	_, err = p.VerifyIDToken(fake.sign(fake.claims(nonce), newKid), nonce)
+	is.NoErr(err)
+
+	// That was the one forced refetch in the refresh interval, another unknown kid is not fetched
+	fetches := fake.fetches.Load()
+	newKid = fake.rotate()
+	_, err = p.VerifyIDToken(fake.sign(fake.claims(nonce), newKid), nonce)
+	is.True(errors.Is(err, ErrIDTokenInvalid))
+	is.Equal(fake.fetches.Load(), fetches)
+
+	interval := jwks.MinRefreshInterval
+	jwks.MinRefreshInterval = 0
+	defer func() { jwks.MinRefreshInterval = interval }()
+
+	_, err = p.VerifyIDToken(fake.sign(fake.claims(nonce), newKid), nonce)
+	is.NoErr(err)
+
+	// Tokens signed with a retired key are rejected once we have refetched
+	oldToken := fake.sign(fake.claims(nonce), oldKid)
+	fake.retire(oldKid)
+	fake.rotate()
+	_, err = p.VerifyIDToken(fake.sign(fake.claims(nonce), fake.kid), nonce)
+	is.NoErr(err)
+	_, err = p.VerifyIDToken(oldToken, nonce)
+	is.True(errors.Is(err, ErrIDTokenInvalid))
+}
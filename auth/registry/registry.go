@@ -0,0 +1,195 @@
+package registry
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSessionUnknown = errors.New("error: unknown session")
+	ErrSessionRevoked = errors.New("error: session has been revoked")
+	ErrRegistryStore  = errors.New("error: session registry could not be stored")
+)
+
+// Sessions not seen for this long are forgotten. It matches the refresh token lifetime, after which they cannot be used anyway.
+var idleTimeout = 14 * 24 * time.Hour
+
+// Checking a session stores when it was seen at most this often, so every proxied request is not a write
+var touchInterval = time.Minute
+
+type Session struct {
+	Id       string `gorm:"primaryKey"`
+	GaiaId   string `gorm:"index"`
+	Created  time.Time
+	LastSeen time.Time `gorm:"index"`
+	Revoked  bool
+}
+
+func (Session) TableName() string {
+	return "session_registry"
+}
+
+/*
+SessionRegistry knows every logged in session by id. The browser
+session only carries the id, so a session can be revoked here and the
+proxy will refuse it on the next request, also before the access token
+in it expires.
+
+A registry from NewSQLiteRegistry also writes the sessions to the
+database, so logins and revocations survive a restart of the gateway.
+*/
+type SessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	db       *gorm.DB // nil if the registry is only kept in memory
+}
+
+// NewSessionRegistry keeps the sessions in memory, they are forgotten when the gateway stops
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{sessions: map[string]*Session{}}
+}
+
+// NewSQLiteRegistry keeps the sessions in db too, e.g. the database of the session store, and loads the ones it has
+func NewSQLiteRegistry(db *gorm.DB) (*SessionRegistry, error) {
+	err := db.AutoMigrate(&Session{})
+	if err != nil {
+		return nil, errors.Join(ErrRegistryStore, err)
+	}
+
+	var sessions []Session
+	err = db.Find(&sessions, "last_seen > ?", time.Now().Add(-idleTimeout)).Error
+	if err != nil {
+		return nil, errors.Join(ErrRegistryStore, err)
+	}
+
+	r := NewSessionRegistry()
+	r.db = db
+	for i := range sessions {
+		r.sessions[sessions[i].Id] = &sessions[i]
+	}
+	return r, nil
+}
+
+// Add registers a new session for the user and returns its id.
+func (r *SessionRegistry) Add(gaiaId string) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sweep()
+	s := &Session{
+		Id:       id,
+		GaiaId:   gaiaId,
+		Created:  time.Now(),
+		LastSeen: time.Now(),
+	}
+	if r.db != nil {
+		err = r.db.Create(s).Error
+		if err != nil {
+			return "", errors.Join(ErrRegistryStore, err)
+		}
+	}
+	r.sessions[id] = s
+	return id, nil
+}
+
+// Check returns the session if it is active and marks it as seen.
+func (r *SessionRegistry) Check(id string) (Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sessions[id]
+	if !ok {
+		return Session{}, ErrSessionUnknown
+	}
+	if s.Revoked {
+		return *s, ErrSessionRevoked
+	}
+	if time.Since(s.LastSeen) > touchInterval {
+		r.store(func(db *gorm.DB) *gorm.DB { return db.Model(s).Update("last_seen", time.Now()) })
+	}
+	s.LastSeen = time.Now()
+	return *s, nil
+}
+
+// Revoke revokes a single session, e.g. at logout.
+func (r *SessionRegistry) Revoke(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s, ok := r.sessions[id]; ok {
+		s.Revoked = true
+		r.store(func(db *gorm.DB) *gorm.DB { return db.Model(s).Update("revoked", true) })
+	}
+}
+
+// RevokeUser revokes every session of the user and returns how many were active.
+func (r *SessionRegistry) RevokeUser(gaiaId string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, s := range r.sessions {
+		if s.GaiaId == gaiaId && !s.Revoked {
+			s.Revoked = true
+			n++
+		}
+	}
+	r.store(func(db *gorm.DB) *gorm.DB {
+		return db.Model(&Session{}).Where("gaia_id = ?", gaiaId).Update("revoked", true)
+	})
+	return n
+}
+
+// Sessions lists the active sessions of the user.
+func (r *SessionRegistry) Sessions(gaiaId string) []Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var sessions []Session
+	for _, s := range r.sessions {
+		if s.GaiaId == gaiaId && !s.Revoked {
+			sessions = append(sessions, *s)
+		}
+	}
+	return sessions
+}
+
+// sweep must be called with r.mu held
+func (r *SessionRegistry) sweep() {
+	for id, s := range r.sessions {
+		if time.Since(s.LastSeen) > idleTimeout {
+			delete(r.sessions, id)
+		}
+	}
+	r.store(func(db *gorm.DB) *gorm.DB {
+		return db.Delete(&Session{}, "last_seen < ?", time.Now().Add(-idleTimeout))
+	})
+}
+
+/*
+store writes a change to the database, if the registry has one. If it
+fails the change is logged, the session in memory has changed anyway and
+a revocation holds until the gateway restarts. It must be called with
+r.mu held.
+*/
+func (r *SessionRegistry) store(change func(db *gorm.DB) *gorm.DB) {
+	if r.db == nil {
+		return
+	}
+	err := change(r.db).Error
+	if err != nil {
+		log.Printf("%v: %v", ErrRegistryStore, err)
+	}
+}
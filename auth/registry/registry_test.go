@@ -0,0 +1,94 @@
+package registry
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/matryer/is"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestRevoke(t *testing.T) {
+	is := is.New(t)
+
+	r := NewSessionRegistry()
+	gaiaId := uuid.NewString()
+
+	sid, err := r.Add(gaiaId)
+	is.NoErr(err)
+
+	s, err := r.Check(sid)
+	is.NoErr(err)
+	is.Equal(s.GaiaId, gaiaId)
+
+	r.Revoke(sid)
+	_, err = r.Check(sid)
+	is.True(errors.Is(err, ErrSessionRevoked))
+
+	_, err = r.Check("unknown")
+	is.True(errors.Is(err, ErrSessionUnknown))
+}
+
+func TestRevokeUser(t *testing.T) {
+	is := is.New(t)
+
+	r := NewSessionRegistry()
+	gaiaId := uuid.NewString()
+
+	laptop, err := r.Add(gaiaId)
+	is.NoErr(err)
+	phone, err := r.Add(gaiaId)
+	is.NoErr(err)
+	other, err := r.Add(uuid.NewString())
+	is.NoErr(err)
+
+	is.Equal(len(r.Sessions(gaiaId)), 2)
+	is.Equal(r.RevokeUser(gaiaId), 2)
+	is.Equal(len(r.Sessions(gaiaId)), 0)
+
+	_, err = r.Check(laptop)
+	is.True(errors.Is(err, ErrSessionRevoked))
+	_, err = r.Check(phone)
+	is.True(errors.Is(err, ErrSessionRevoked))
+	_, err = r.Check(other)
+	is.NoErr(err)
+}
+
+// Sessions and revocations in the database survive a restart of the gateway
+func TestSQLiteRegistry(t *testing.T) {
+	is := is.New(t)
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "sessions.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	is.NoErr(err)
+
+	r, err := NewSQLiteRegistry(db)
+	is.NoErr(err)
+	gaiaId := uuid.NewString()
+	laptop, err := r.Add(gaiaId)
+	is.NoErr(err)
+	phone, err := r.Add(gaiaId)
+	is.NoErr(err)
+	other, err := r.Add(uuid.NewString())
+	is.NoErr(err)
+	r.Revoke(phone)
+
+	restarted, err := NewSQLiteRegistry(db)
+	is.NoErr(err)
+	s, err := restarted.Check(laptop)
+	is.NoErr(err)
+	is.Equal(s.GaiaId, gaiaId)
+	_, err = restarted.Check(phone)
+	is.True(errors.Is(err, ErrSessionRevoked))
+
+	is.Equal(restarted.RevokeUser(gaiaId), 1)
+	restarted, err = NewSQLiteRegistry(db)
+	is.NoErr(err)
+	_, err = restarted.Check(laptop)
+	is.True(errors.Is(err, ErrSessionRevoked))
+	_, err = restarted.Check(other)
+	is.NoErr(err)
+}
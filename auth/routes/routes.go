@@ -0,0 +1,273 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRoutesInvalid         = errors.New("error: invalid route table")
+	ErrRoutesUnknownUpstream = errors.New("error: route refers to an unknown upstream")
+)
+
+/*
+Route protects a path pattern on the gateway and names the upstream that
+serves it.
+
+A pattern ending in / matches the whole subtree, other patterns match
+the path exactly. A {name} segment matches any single segment, e.g.
+/crm/users/{id}.
+*/
+type Route struct {
+	Path     string   `json:"path"`
+	Methods  []string `json:"methods,omitempty"` // empty matches every method
+	Upstream string   `json:"upstream"`
+	// StripPrefix is removed from the path before it is sent upstream, e.g. /crm
+	StripPrefix string `json:"strip_prefix,omitempty"`
+	// Public routes are proxied without a session. Everything else requires a logged in user.
+	Public   bool     `json:"public,omitempty"`
+	Audience string   `json:"audience,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+	Roles    []string `json:"roles,omitempty"` // any one of them
+}
+
+/*
+Table is the route table of the gateway. Routes are matched in order,
+the first match wins, so specific routes go before the catch-all.
+*/
+type Table struct {
+	Upstreams map[string]string `json:"upstreams"`
+	Routes    []Route           `json:"routes"`
+
+	upstreams map[string]*url.URL
+}
+
+// Default protects /secret/ and passes everything else to the app, which is how the gateway worked before the table.
+func Default(origin string) (*Table, error) {
+	t := &Table{
+		Upstreams: map[string]string{"app": origin},
+		Routes: []Route{
+			{Path: "/secret/", Upstream: "app"},
+			{Path: "/", Upstream: "app", Public: true},
+		},
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return nil, errors.Join(ErrRoutesInvalid, fmt.Errorf("invalid origin server url %q", origin))
+	}
+	t.upstreams = map[string]*url.URL{"app": u}
+	return t, nil
+}
+
+/*
+Parse reads a JSON route table. Upstreams missing from the table are
+taken from defaults, so the table does not have to repeat e.g. the CRM
+host from the environment.
+*/
+func Parse(data []byte, defaults map[string]string) (*Table, error) {
+	t := &Table{}
+	err := json.Unmarshal(data, t)
+	if err != nil {
+		return nil, errors.Join(ErrRoutesInvalid, err)
+	}
+
+	err = t.compile(defaults)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Table) compile(defaults map[string]string) error {
+	if t.Upstreams == nil {
+		t.Upstreams = map[string]string{}
+	}
+	for name, host := range defaults {
+		if _, ok := t.Upstreams[name]; !ok && host != "" {
+			t.Upstreams[name] = host
+		}
+	}
+
+	t.upstreams = map[string]*url.URL{}
+	for name, host := range t.Upstreams {
+		u, err := url.Parse(host)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.Join(ErrRoutesInvalid, fmt.Errorf("upstream %s has an invalid url %q", name, host))
+		}
+		t.upstreams[name] = u
+	}
+
+	for i, route := range t.Routes {
+		if !strings.HasPrefix(route.Path, "/") {
+			return errors.Join(ErrRoutesInvalid, fmt.Errorf("route %d: path must start with /", i))
+		}
+		if _, ok := t.upstreams[route.Upstream]; !ok {
+			return errors.Join(ErrRoutesUnknownUpstream, fmt.Errorf("route %d: %q", i, route.Upstream))
+		}
+		for j, m := range route.Methods {
+			t.Routes[i].Methods[j] = strings.ToUpper(m)
+		}
+	}
+	return nil
+}
+
+// Match returns the first route for the method and path, and the upstream serving it.
+func (t *Table) Match(method string, urlPath string) (Route, *url.URL, bool) {
+	for _, route := range t.Routes {
+		if len(route.Methods) > 0 && !slices.Contains(route.Methods, method) {
+			continue
+		}
+		if matchPath(route.Path, urlPath) {
+			return route, t.upstreams[route.Upstream], true
+		}
+	}
+	return Route{}, nil, false
+}
+
+// UpstreamPath is the path the upstream should see for urlPath.
+func (r Route) UpstreamPath(urlPath string) string {
+	if r.StripPrefix == "" {
+		return urlPath
+	}
+	p := strings.TrimPrefix(urlPath, r.StripPrefix)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
+
+func matchPath(pattern string, urlPath string) bool {
+	subtree := strings.HasSuffix(pattern, "/")
+	patternSegments := segments(pattern)
+	pathSegments := segments(urlPath)
+
+	if len(pathSegments) < len(patternSegments) || (!subtree && len(pathSegments) != len(patternSegments)) {
+		return false
+	}
+
+	for i, s := range patternSegments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if pathSegments[i] == "" {
+				return false
+			}
+			continue
+		}
+		if s != pathSegments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func segments(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// Clean is the path we match and forward. It stops /public/../secret/ from being matched as a public route.
+func Clean(urlPath string) string {
+	cleaned := path.Clean("/" + urlPath)
+	if strings.HasSuffix(urlPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+/*
+Reloader holds the current route table. A table from a file is read
+again when the file changes, so routes can be changed without a
+restart. A broken file is logged and the previous table is kept.
+*/
+type Reloader struct {
+	path     string
+	defaults map[string]string
+
+	mu      sync.RWMutex
+	table   *Table
+	modTime time.Time
+}
+
+// Static returns a Reloader that always has table.
+func Static(table *Table) *Reloader {
+	return &Reloader{table: table}
+}
+
+func NewReloader(path string, defaults map[string]string) (*Reloader, error) {
+	r := &Reloader{path: path, defaults: defaults}
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) Table() *Table {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.table
+}
+
+// Reload reads the file if it has changed since the last load.
+func (r *Reloader) Reload() error {
+	if r.path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return errors.Join(ErrRoutesInvalid, err)
+	}
+
+	r.mu.RLock()
+	unchanged := info.ModTime().Equal(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return errors.Join(ErrRoutesInvalid, err)
+	}
+
+	table, err := Parse(data, r.defaults)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.table = table
+	r.modTime = info.ModTime()
+	return nil
+}
+
+// Watch checks the file for changes every interval until stop is closed.
+func (r *Reloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := r.Reload()
+			if err != nil {
+				log.Printf("keeping the previous route table: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package routes
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+var table = `{
+	"upstreams": {"crm": "http://crm.local:3010"},
+	"routes": [
+		{"path": "/crm/users/{id}", "methods": ["put"], "upstream": "crm", "strip_prefix": "/crm", "audience": "crm", "scopes": ["crm:write"]},
+		{"path": "/crm/users/{id}", "upstream": "crm", "strip_prefix": "/crm"},
+		{"path": "/static/", "upstream": "app", "public": true},
+		{"path": "/", "upstream": "app"}
+	]
+}`
+
+func TestMatch(t *testing.T) {
+	is := is.New(t)
+
+	routes, err := Parse([]byte(table), map[string]string{"app": "http://app.local:8000", "crm": "http://ignored"})
+	is.NoErr(err)
+
+	route, upstream, ok := routes.Match("PUT", "/crm/users/42")
+	is.True(ok)
+	is.Equal(upstream.Host, "crm.local:3010") // the table wins over the defaults
+	is.Equal(route.Scopes, []string{"crm:write"})
+	is.Equal(route.UpstreamPath("/crm/users/42"), "/users/42")
+
+	route, _, ok = routes.Match("GET", "/crm/users/42")
+	is.True(ok)
+	is.Equal(len(route.Scopes), 0)
+
+	route, upstream, ok = routes.Match("GET", "/static/css/gaia.css")
+	is.True(ok)
+	is.True(route.Public)
+	is.Equal(upstream.Host, "app.local:8000")
+
+	// {id} matches a single segment, so this falls through to the catch-all
+	route, _, ok = routes.Match("GET", "/crm/users/42/invoices")
+	is.True(ok)
+	is.Equal(route.Path, "/")
+	is.True(!route.Public)
+}
+
+func TestMatchNothing(t *testing.T) {
+	is := is.New(t)
+
+	routes, err := Parse([]byte(`{"upstreams": {"app": "http://app.local"}, "routes": [{"path": "/gaia/", "upstream": "app"}]}`), nil)
+	is.NoErr(err)
+
+	_, _, ok := routes.Match("GET", "/other/page.html")
+	is.True(!ok)
+}
+
+func TestParseErrors(t *testing.T) {
+	is := is.New(t)
+
+	_, err := Parse([]byte(`{"routes": [{"path": "/", "upstream": "billing"}]}`), nil)
+	is.True(errors.Is(err, ErrRoutesUnknownUpstream))
+
+	_, err = Parse([]byte(`{"upstreams": {"app": "localhost:8000"}}`), nil)
+	is.True(errors.Is(err, ErrRoutesInvalid))
+
+	_, err = Parse([]byte(`{"upstreams": {"app": "http://app.local"}, "routes": [{"path": "secret", "upstream": "app"}]}`), nil)
+	is.True(errors.Is(err, ErrRoutesInvalid))
+
+	_, err = Parse([]byte(`not json`), nil)
+	is.True(errors.Is(err, ErrRoutesInvalid))
+}
+
+func TestDefault(t *testing.T) {
+	is := is.New(t)
+
+	routes, err := Default("http://app.local:8000")
+	is.NoErr(err)
+	route, upstream, ok := routes.Match("GET", "/secret/page.html")
+	is.True(ok)
+	is.True(!route.Public)
+	is.Equal(upstream.Host, "app.local:8000")
+
+	_, err = Default("://app.local")
+	is.True(errors.Is(err, ErrRoutesInvalid))
+}
+
+func TestClean(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(Clean("/static/../secret/"), "/secret/")
+	is.Equal(Clean("//secret//page.html"), "/secret/page.html")
+	is.Equal(Clean("/"), "/")
+	is.Equal(Clean(""), "/")
+}
+
+func TestReload(t *testing.T) {
+	is := is.New(t)
+
+	path := filepath.Join(t.TempDir(), "routes.json")
+	write := func(data string, modTime time.Time) {
+		is.NoErr(os.WriteFile(path, []byte(data), 0600))
+		is.NoErr(os.Chtimes(path, modTime, modTime))
+	}
+
+	now := time.Now()
+	write(`{"upstreams": {"app": "http://app.local"}, "routes": [{"path": "/", "upstream": "app"}]}`, now)
+
+	r, err := NewReloader(path, nil)
+	is.NoErr(err)
+	route, _, _ := r.Table().Match("GET", "/")
+	is.True(!route.Public)
+
+	write(`{"upstreams": {"app": "http://app.local"}, "routes": [{"path": "/", "upstream": "app", "public": true}]}`, now.Add(time.Second))
+	is.NoErr(r.Reload())
+	route, _, _ = r.Table().Match("GET", "/")
+	is.True(route.Public)
+
+	// A broken file does not take the gateway down
+	write(`{"routes": [`, now.Add(2*time.Second))
+	is.True(r.Reload() != nil)
+	route, _, _ = r.Table().Match("GET", "/")
+	is.True(route.Public)
+}
@@ -1,55 +1,58 @@
 package server
 
 import (
-	"encoding/gob"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
-	"strings"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/sessions"
+	"github.com/henrikkorsgaard/gaia/auth/identity"
+	"github.com/henrikkorsgaard/gaia/auth/registry"
 	"github.com/henrikkorsgaard/gaia/auth/tokens"
 	"github.com/henrikkorsgaard/gaia/crm/database"
 )
 
-type mitidTokens struct {
-	IdToken     string `json:"id_token"`
-	AccessToken string `json:"access_token"`
-}
-
-type mitidUser struct {
-	MitIdUUID string `json:"mitid.uuid"`
-	Name      string `json:"mitid.identity_name"`
-}
-
-var state = uuid.NewString()[:6] //TODO: Cycle this over time?
+// TODO: Handle in config
+const redirectURI = "http://localhost:3020/account/authenticate"
 
 var (
 	ErrAuthenticationMissingCode         = errors.New("error: mitid did not return code")
 	ErrAuthenticationStateError          = errors.New("error: provider returned unexpected state")
 	ErrAuthenticationIdentityNotFound    = errors.New("error: crm could not match identity")
 	ErrAuthenticationIdentityServiceFail = errors.New("error: crm returned error")
-	ErrAuthenticationOnboardingSession   = errors.New("error: onbaording sessions data incomplete")
+	ErrAuthenticationAddress             = errors.New("error: crm could not verify the address")
 )
 
 /*
-login() will redirect the user to MitID authentication flow
+login() will redirect the user to the identity provider authentication flow
 this will redirect here with the codes needed.
 */
-func authenticate(store *sessions.CookieStore, config Config) http.Handler {
+func authenticate(store sessions.Store, refreshTokens *tokens.RefreshStore, sessionRegistry *registry.SessionRegistry, keys *tokens.KeyRing, providers identity.Providers, config Config) http.Handler {
 	//this is the endpoint that sets what?
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		gob.Register(mitidUser{})
 		q := r.URL.Query()
-		queryState := q.Get("state")
-		if queryState != state {
-			http.Error(w, ErrAuthenticationStateError.Error(), http.StatusInternalServerError)
+
+		session, err := store.Get(r, "gaia")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		attempt, err := consumeLoginAttempt(session, q.Get("state"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		// Save the consumed attempt before doing anything else, so a replay is rejected even if this login fails
+		err = session.Save(r, w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
@@ -59,22 +62,20 @@ func authenticate(store *sessions.CookieStore, config Config) http.Handler {
 			return
 		}
 
-		// This can potentially fail if the code is old?
-		mtokens, err := getTokens(code, config)
-
+		provider, err := providers.Get(attempt.Provider)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		//This can fail if the login was initiated more than 15 minutes earlier
-		mitUser, err := getUserInfo(mtokens.AccessToken)
+		// This can potentially fail if the code is old?
+		ident, err := provider.Exchange(code, attempt.authorizeRequest(nil))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
 
-		user, err := matchUser(config.CRM_SERVER, mitUser.MitIdUUID, mitUser.Name, "", "")
+		user, err := matchUser(config.CRM_SERVER, keys, identityUser(ident))
 		//We handle errors here that are not associated with 404 identity match
 		//This returns any other error
 		if err != nil && !errors.Is(err, ErrAuthenticationIdentityNotFound) {
@@ -83,35 +84,22 @@ func authenticate(store *sessions.CookieStore, config Config) http.Handler {
 		}
 
 		if user.GaiaId != "" {
-			token, err := tokens.NewUserToken(user.GaiaId, config.TOKEN_SIGN_KEY)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			session, err := store.Get(r, "gaia")
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			session.Values["token"] = token
-			err = session.Save(r, w)
+			err = startUserSession(w, r, session, refreshTokens, sessionRegistry, keys, user.GaiaId, user.Role, ident.Provider, config)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 			//TODO: Handle redirect targets in config
-			http.Redirect(w, r, "/gaia/dashboard.html", http.StatusOK)
+			http.Redirect(w, r, "/gaia/dashboard.html", http.StatusFound)
 
 		} else {
-
-			session, err := store.Get(r, "gaia")
+			// The identity is verified from here, so the session gets a new id like a login does
+			err = renewSessionId(w, r, session)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			session.Values["mitid"] = mitUser
+			startOnboarding(session, ident, config)
 
 			err = session.Save(r, w)
 			if err != nil {
@@ -119,143 +107,85 @@ func authenticate(store *sessions.CookieStore, config Config) http.Handler {
 				return
 			}
 
-			cookie := http.Cookie{
-				Name:     "gaia_n",
-				Value:    mitUser.Name,
-				MaxAge:   3600,
-				Path:     "/",
-				HttpOnly: false,
-				Secure:   false,
-			}
-
-			http.SetCookie(w, &cookie)
-
 			//TODO: Handle this from a config perspective.
 			http.Redirect(w, r, "/onboarding.html", http.StatusFound)
 		}
 	})
 }
 
-func onboarding(store *sessions.CookieStore, config Config) http.Handler {
-
-	//this is the endpoint that sets what?
+func login(store sessions.Store, providers identity.Providers, config Config) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		if r.Method == http.MethodPost {
-			session, err := store.Get(r, "gaia")
-			if err != nil {
-				clearOnboardingSessionData(w, r, session)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			user, err := getOnboardingSessionUser(r, session)
-			if err != nil {
-				clearOnboardingSessionData(w, r, session)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			user, err = matchUser(config.CRM_SERVER, user.MitIdUUID, user.Name, user.Address, user.DarId)
-			if err != nil {
-				clearOnboardingSessionData(w, r, session)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			if user.GaiaId == "" {
-				clearOnboardingSessionData(w, r, session)
-				http.Error(w, ErrAuthenticationIdentityNotFound.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			token, err := tokens.NewUserToken(user.GaiaId, config.TOKEN_SIGN_KEY)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			session.Values["token"] = token
-			err = session.Save(r, w)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			http.Redirect(w, r, "/gaia/dashboard.html", http.StatusOK)
+		// /account/login without a provider is MitID
+		name := r.PathValue("provider")
+		if name == "" {
+			name = "mitid"
 		}
 
-	})
-}
-
-func login(config Config) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		params := url.Values{}
-		params.Add("response_type", "code")
-		params.Add("client_id", config.MITID_CLIENT_ID)
-		params.Add("redirect_uri", "http://localhost:3020/account/authenticate")
-		params.Add("scope", "openid mitid")
-		params.Add("state", state)
+		provider, err := providers.Get(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
 
-		if config.ENVIRONMENT == "dev" {
-			q := r.URL.Query()
-			if q.Get("mitid") != "" {
-				params.Add("simulation", "no-ui uuid:"+q.Get("mitid")) //0e4a1734-a8f3-4c49-b09c-35405104725e
+		session, err := store.Get(r, "gaia")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-			}
+		// A new login replaces any attempt that was never completed
+		attempt := newLoginAttempt(provider.Name())
+		session.Values["login"] = attempt
+		err = session.Save(r, w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
-		url := "https://pp.netseidbroker.dk/op/connect/authorize?" + params.Encode()
+		url, err := provider.AuthorizeURL(attempt.authorizeRequest(r.URL.Query()))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		http.Redirect(w, r, url, http.StatusFound)
 	})
 }
 
-func getTokens(code string, config Config) (mtokens mitidTokens, err error) {
-	fmt.Println("æl.djas")
-	// Now we go on to exchaning the code for access and id tokens
-	data := url.Values{}
-	data.Add("client_id", config.MITID_CLIENT_ID)
-	data.Add("client_secret", config.MITID_CLIENT_SECRET)
-	data.Add("grant_type", "authorization_code")
-	data.Add("code", code)
-	data.Add("redirect_uri", "http://localhost:3020/account/authenticate")
-
-	resp, err := http.Post("https://pp.netseidbroker.dk/op/connect/token", "application/x-www-form-urlencoded", strings.NewReader(data.Encode()))
-	if err != nil {
-		return mtokens, err
+// identityUser is the CRM match request for an identity
+func identityUser(ident identity.Identity) database.User {
+	return database.User{
+		MitIdUUID: ident.MitIdUUID,
+		Provider:  ident.Provider,
+		Subject:   ident.Subject,
+		Name:      ident.Name,
 	}
-	// we need to close this, see: https://stackoverflow.com/questions/23928983/defer-body-close-after-receiving-response
-	defer resp.Body.Close()
-
-	json.NewDecoder(resp.Body).Decode(&mtokens)
-
-	return mtokens, err
 }
 
-func getUserInfo(accessToken string) (user mitidUser, err error) {
-
-	req, err := http.NewRequest("GET", "https://pp.netseidbroker.dk/op/connect/userinfo", nil)
+/*
+matchUser asks CRM for the Gaia user of an identity. The auth server is
+the token issuer, so it signs its own service token instead of using
+/oauth/token.
+*/
+func matchUser(host string, keys *tokens.KeyRing, request database.User) (user database.User, err error) {
+	data, err := json.Marshal(request)
 	if err != nil {
 		return user, err
 	}
 
-	req.Header.Add("Authorization", "Bearer "+accessToken)
-	resp, err := http.DefaultClient.Do(req)
+	token, err := tokens.NewServiceToken("auth", []string{"crm"}, "crm:match", keys)
 	if err != nil {
 		return user, err
 	}
-	defer resp.Body.Close()
 
-	json.NewDecoder(resp.Body).Decode(&user)
-
-	return user, err
-}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%v/match", host), bytes.NewReader(data))
+	if err != nil {
+		return user, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
 
-func matchUser(host string, mitidUUID, name, address, darId string) (user database.User, err error) {
-	var data = fmt.Sprintf(`{ "mitid_uuid":"%s", "name":"%s", "address": "%s", "dar_id": "%s" }`, mitidUUID, name, address, darId)
-	//TODO: Manage CRM host in config
-	resp, err := http.Post(fmt.Sprintf("%v/match", host), "application/json", strings.NewReader(data))
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return user, err
 	}
@@ -264,6 +194,9 @@ func matchUser(host string, mitidUUID, name, address, darId string) (user databa
 	if resp.StatusCode == http.StatusNotFound {
 
 		return user, ErrAuthenticationIdentityNotFound
+	} else if resp.StatusCode == http.StatusUnprocessableEntity {
+		// CRM could not verify the address with DAR
+		return user, ErrAuthenticationAddress
 	} else if resp.StatusCode == http.StatusOK {
 		json.NewDecoder(resp.Body).Decode(&user)
 		return user, err
@@ -276,55 +209,3 @@ func matchUser(host string, mitidUUID, name, address, darId string) (user databa
 		return user, errors.Join(ErrAuthenticationIdentityServiceFail, errors.New(string(body)))
 	}
 }
-
-func getOnboardingSessionUser(r *http.Request, session *sessions.Session) (user database.User, err error) {
-	address := r.FormValue("address")
-	darId := r.FormValue("darid")
-
-	if address == "" || darId == "" {
-		return user, ErrAuthenticationOnboardingSession
-	}
-
-	mitid := session.Values["mitid"].(mitidUser)
-
-	if session.IsNew || mitid.MitIdUUID == "" || mitid.Name == "" {
-		return user, ErrAuthenticationOnboardingSession
-	}
-
-	cookie, err := r.Cookie("gaia_n")
-	if err != nil {
-		return user, err
-	}
-
-	//If we cannot match the values between name and id,
-	// then something is tampered with
-	if cookie.Value == "" || cookie.Value != mitid.Name {
-		return user, ErrAuthenticationOnboardingSession
-	}
-
-	user = database.User{
-		MitIdUUID: mitid.MitIdUUID,
-		Name:      mitid.Name,
-		Address:   address,
-		DarId:     darId,
-	}
-
-	return user, err
-}
-
-func clearOnboardingSessionData(w http.ResponseWriter, r *http.Request, session *sessions.Session) error {
-	//remove data from session
-	delete(session.Values, "mitid")
-
-	cookie := http.Cookie{
-		Name:     "gaia_n",
-		Value:    "",
-		MaxAge:   0,
-		Path:     "/",
-		HttpOnly: false,
-		Secure:   false,
-	}
-
-	http.SetCookie(w, &cookie)
-	return session.Save(r, w)
-}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/henrikkorsgaard/gaia/auth/identity"
+)
+
+var (
+	ErrAuthenticationStateExpired  = errors.New("error: login attempt has expired")
+	ErrAuthenticationStateReplayed = errors.New("error: login attempt has already been used")
+)
+
+// How long a user has to complete the login at the provider
+var loginAttemptTTL = 10 * time.Minute
+
+/*
+loginAttempt is created by login() and stored in the gaia session.
+The state, nonce and PKCE verifier are unique to the attempt, and
+authenticate() will only accept a callback once for each attempt.
+*/
+type loginAttempt struct {
+	Provider     string
+	State        string
+	Nonce        string
+	CodeVerifier string
+	Expires      time.Time
+	Consumed     bool
+}
+
+func init() {
+	gob.Register(loginAttempt{})
+}
+
+func newLoginAttempt(provider string) loginAttempt {
+	return loginAttempt{
+		Provider:     provider,
+		State:        randomString(32),
+		Nonce:        randomString(32),
+		CodeVerifier: randomString(64),
+		Expires:      time.Now().Add(loginAttemptTTL),
+	}
+}
+
+// codeChallenge is the S256 PKCE challenge for the attempt verifier
+func (a loginAttempt) codeChallenge() string {
+	sum := sha256.Sum256([]byte(a.CodeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// authorizeRequest hands the attempt to the identity provider. query is only set on login.
+func (a loginAttempt) authorizeRequest(query url.Values) identity.AuthorizeRequest {
+	return identity.AuthorizeRequest{
+		RedirectURI:   redirectURI,
+		State:         a.State,
+		Nonce:         a.Nonce,
+		CodeChallenge: a.codeChallenge(),
+		CodeVerifier:  a.CodeVerifier,
+		Query:         query,
+	}
+}
+
+/*
+consumeLoginAttempt checks the state returned by the provider against
+the attempt in the session and marks the attempt as used. The session
+must be saved by the caller so a replayed callback sees the mark.
+*/
+func consumeLoginAttempt(session *sessions.Session, state string) (loginAttempt, error) {
+	attempt, ok := session.Values["login"].(loginAttempt)
+
+	// Either no login was started in this session, or the callback belongs to another session
+	if !ok || state == "" || subtle.ConstantTimeCompare([]byte(attempt.State), []byte(state)) != 1 {
+		return attempt, ErrAuthenticationStateError
+	}
+
+	if attempt.Consumed {
+		return attempt, ErrAuthenticationStateReplayed
+	}
+
+	if time.Now().After(attempt.Expires) {
+		return attempt, ErrAuthenticationStateExpired
+	}
+
+	attempt.Consumed = true
+	session.Values["login"] = attempt
+	return attempt, nil
+}
+
+// randomString returns n random bytes base64url encoded
+func randomString(n int) string {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/henrikkorsgaard/gaia/auth/identity"
+	"github.com/henrikkorsgaard/gaia/auth/registry"
+	"github.com/henrikkorsgaard/gaia/auth/tokens"
+)
+
+var (
+	ErrOnboardingMissing = errors.New("error: no onboarding in progress")
+	ErrOnboardingExpired = errors.New("error: onboarding has expired, please log in again")
+	ErrOnboardingStep    = errors.New("error: onboarding step is not allowed now")
+	ErrOnboardingUnknown = errors.New("error: unknown onboarding step")
+	ErrOnboardingAddress = errors.New("error: address and darid are required")
+	ErrOnboardingTerms   = errors.New("error: the terms must be accepted")
+)
+
+// Used when ONBOARDING_TTL is not set
+var defaultOnboardingTTL = 30 * time.Minute
+
+// The onboarding steps, in order
+const (
+	stepIdentityConfirmed = "identity_confirmed"
+	stepAddressChosen     = "address_chosen"
+	stepTermsAccepted     = "terms_accepted"
+	stepAccountCreated    = "account_created"
+)
+
+// The step each action leads to, and the steps it may be taken from. Going back to change the address is allowed.
+var onboardingActions = map[string]struct {
+	from []string
+	to   string
+}{
+	"address": {from: []string{stepIdentityConfirmed, stepAddressChosen, stepTermsAccepted}, to: stepAddressChosen},
+	"terms":   {from: []string{stepAddressChosen, stepTermsAccepted}, to: stepTermsAccepted},
+	"account": {from: []string{stepTermsAccepted}, to: stepAccountCreated},
+}
+
+/*
+onboardingState is kept in the gaia session for a user we could not
+match in CRM. Only the server moves it from step to step, so the browser
+cannot skip a step or change the identity. Each step gives the user
+another ONBOARDING_TTL to take the next one, and the state survives a
+new login with the same identity.
+*/
+type onboardingState struct {
+	Step          string
+	Identity      identity.Identity
+	Address       string
+	DarId         string
+	TermsAccepted time.Time
+	Expires       time.Time
+}
+
+func init() {
+	gob.Register(onboardingState{})
+}
+
+// onboardingView is what the frontend sees, without the identity details
+type onboardingView struct {
+	Step     string    `json:"step"`
+	Name     string    `json:"name"`
+	Address  string    `json:"address,omitempty"`
+	DarId    string    `json:"dar_id,omitempty"`
+	Expires  time.Time `json:"expires"`
+	Redirect string    `json:"redirect,omitempty"`
+}
+
+/*
+startOnboarding puts the identity in the session, or resumes the
+onboarding the same identity already started.
+*/
+func startOnboarding(session *sessions.Session, ident identity.Identity, config Config) {
+	state, ok := session.Values["onboarding"].(onboardingState)
+	if ok && state.Identity.Provider == ident.Provider && state.Identity.Subject == ident.Subject && time.Now().Before(state.Expires) {
+		state.Identity = ident
+	} else {
+		state = onboardingState{Step: stepIdentityConfirmed, Identity: ident}
+	}
+	state.Expires = time.Now().Add(onboardingTTL(config))
+	session.Values["onboarding"] = state
+}
+
+func onboardingTTL(config Config) time.Duration {
+	if config.ONBOARDING_TTL > 0 {
+		return config.ONBOARDING_TTL
+	}
+	return defaultOnboardingTTL
+}
+
+/*
+onboarding is the JSON API of the onboarding flow.
+
+	GET  /account/onboarding          the current step and the name of the user
+	POST /account/onboarding/address  address and darid
+	POST /account/onboarding/terms    accept=true
+	POST /account/onboarding/account  creates the user in CRM and logs in
+*/
+func onboarding(store sessions.Store, refreshTokens *tokens.RefreshStore, sessionRegistry *registry.SessionRegistry, keys *tokens.KeyRing, config Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := r.PathValue("step")
+		if (action == "" && r.Method != http.MethodGet) || (action != "" && r.Method != http.MethodPost) {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+
+		session, err := store.Get(r, "gaia")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		state, ok := session.Values["onboarding"].(onboardingState)
+		if !ok {
+			http.Error(w, ErrOnboardingMissing.Error(), http.StatusNotFound)
+			return
+		}
+
+		if time.Now().After(state.Expires) {
+			delete(session.Values, "onboarding")
+			err = session.Save(r, w)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Error(w, ErrOnboardingExpired.Error(), http.StatusGone)
+			return
+		}
+
+		if action == "" {
+			writeOnboarding(w, state, "")
+			return
+		}
+
+		transition, ok := onboardingActions[action]
+		if !ok {
+			http.Error(w, ErrOnboardingUnknown.Error(), http.StatusNotFound)
+			return
+		}
+		if !slices.Contains(transition.from, state.Step) {
+			http.Error(w, ErrOnboardingStep.Error(), http.StatusConflict)
+			return
+		}
+
+		switch action {
+		case "address":
+			address, darId := r.FormValue("address"), r.FormValue("darid")
+			if address == "" || darId == "" {
+				http.Error(w, ErrOnboardingAddress.Error(), http.StatusBadRequest)
+				return
+			}
+			state.Address = address
+			state.DarId = darId
+			// The terms are accepted for an address, so they are accepted again after a change
+			state.TermsAccepted = time.Time{}
+
+		case "terms":
+			if r.FormValue("accept") != "true" {
+				http.Error(w, ErrOnboardingTerms.Error(), http.StatusBadRequest)
+				return
+			}
+			state.TermsAccepted = time.Now()
+
+		case "account":
+			request := identityUser(state.Identity)
+			request.DarId = state.DarId
+
+			user, err := matchUser(config.CRM_SERVER, keys, request)
+			if errors.Is(err, ErrAuthenticationAddress) {
+				// Back to choosing an address
+				state.Step = stepIdentityConfirmed
+				state.TermsAccepted = time.Time{}
+				session.Values["onboarding"] = state
+				err = session.Save(r, w)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				http.Error(w, ErrAuthenticationAddress.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			if err != nil {
+				// The state is kept, so the user can try again
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+
+			delete(session.Values, "onboarding")
+			err = startUserSession(w, r, session, refreshTokens, sessionRegistry, keys, user.GaiaId, user.Role, user.Provider, config)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			state.Step = transition.to
+			//TODO: Handle redirect targets in config
+			writeOnboarding(w, state, "/gaia/dashboard.html")
+			return
+		}
+
+		state.Step = transition.to
+		state.Expires = time.Now().Add(onboardingTTL(config))
+		session.Values["onboarding"] = state
+		err = session.Save(r, w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeOnboarding(w, state, "")
+	})
+}
+
+func writeOnboarding(w http.ResponseWriter, state onboardingState, redirect string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(onboardingView{
+		Step:     state.Step,
+		Name:     state.Identity.Name,
+		Address:  state.Address,
+		DarId:    state.DarId,
+		Expires:  state.Expires,
+		Redirect: redirect,
+	})
+}
@@ -1,29 +1,52 @@
 package server
 
 import (
+	"context"
 	"errors"
-	"fmt"
-	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
-	"strings"
+	"time"
 
 	"github.com/gorilla/sessions"
+	"github.com/henrikkorsgaard/gaia/auth/forwarded"
+	"github.com/henrikkorsgaard/gaia/auth/registry"
+	"github.com/henrikkorsgaard/gaia/auth/routes"
 	"github.com/henrikkorsgaard/gaia/auth/tokens"
 )
 
 var (
-	ErrInvalidSession = errors.New("invalid authentication session")
-	ErrInvalidToken   = errors.New("invalid authentication token")
+	ErrInvalidSession  = errors.New("invalid authentication session")
+	ErrNoRoute         = errors.New("no route for this path")
+	ErrUpstream        = errors.New("upstream service is unavailable")
+	ErrUpstreamTimeout = errors.New("upstream service did not answer in time")
 )
 
-func proxyHandler(store *sessions.CookieStore, originServer *url.URL, config Config) http.Handler {
+// Access tokens closer than this to expiry are renewed before the request is proxied
+var renewWindow = 2 * time.Minute
+
+/*
+proxyHandler forwards requests to the upstream of the first matching
+route in the route table. Routes that are not public require a valid
+session, and the audience, scopes and roles of the route.
+*/
+func proxyHandler(store sessions.Store, refreshTokens *tokens.RefreshStore, sessionRegistry *registry.SessionRegistry, keys *tokens.KeyRing, routeTable *routes.Reloader, config Config) http.Handler {
+	validator := tokens.NewValidator(keys)
+	proxy := newReverseProxy(config)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		//TODO: Maybe generalise some pattern matching here?
-		//TODO: Integrate with a configuration setting, e.g. map of paths
-		if strings.HasPrefix(r.URL.Path, "/secret/") {
+		urlPath := routes.Clean(r.URL.Path)
+		route, upstream, ok := routeTable.Table().Match(r.Method, urlPath)
+		if !ok {
+			http.Error(w, ErrNoRoute.Error(), http.StatusNotFound)
+			return
+		}
+
+		var claims *tokens.UserToken
+		if !route.Public {
 
 			session, err := store.Get(r, "gaia")
 			if err != nil {
@@ -37,34 +60,105 @@ func proxyHandler(store *sessions.CookieStore, originServer *url.URL, config Con
 				return
 			}
 
-			validToken, err := tokens.ValidateToken(session.Values["token"].(string), config.TOKEN_SIGN_KEY)
+			// Renew transparently, the user should not notice the short-lived access token
+			if tokens.ExpiresWithin(tokenString.(string), keys, renewWindow) {
+				err = renewUserSession(w, r, session, refreshTokens, sessionRegistry, keys, config)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusUnauthorized)
+					return
+				}
+			}
+
+			_, err = validator.Validate(session.Values["token"].(string))
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				http.Error(w, err.Error(), tokens.StatusCode(err))
 				return
 			}
 
-			if !validToken {
-				http.Error(w, ErrInvalidToken.Error(), http.StatusUnauthorized)
+			// A revoked session is refused even if its access token has not expired
+			sid, _ := session.Values["sid"].(string)
+			_, err = sessionRegistry.Check(sid)
+			if err != nil {
+				endBrowserSession(w, r, session)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			claims, err = validator.Check(session.Values["token"].(string), route.Audience, route.Scopes...)
+			if err == nil {
+				err = tokens.RequireRole(claims, route.Roles...)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), tokens.StatusCode(err))
 				return
 			}
 		}
 
-		r.Host = originServer.Host
-		r.URL.Host = originServer.Host
-		r.URL.Scheme = originServer.Scheme
-		r.RequestURI = ""
+		// The upstream and its path are decided here, the reverse proxy only forwards
+		out := r.Clone(context.WithValue(r.Context(), upstreamKey{}, upstream))
+		out.URL.Path = route.UpstreamPath(urlPath)
+		out.URL.RawPath = ""
 
-		// save the response from the origin server
-		oResp, err := http.DefaultClient.Do(r)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			_, _ = fmt.Fprint(w, err)
-			return
+		// Upstreams learn who the user is from us, never from the client
+		forwarded.Strip(out.Header)
+		stripSessionCookie(out)
+		if claims != nil {
+			audience := route.Audience
+			if audience == "" {
+				audience = route.Upstream
+			}
+			internalToken, err := tokens.NewInternalToken(claims, audience, keys)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			forwarded.Set(out.Header, internalToken, claims)
 		}
-		defer oResp.Body.Close()
 
-		// return response to the client
-		w.WriteHeader(http.StatusOK)
-		io.Copy(w, oResp.Body)
+		proxy.ServeHTTP(w, out)
 	})
 }
+
+type upstreamKey struct{}
+
+// stripSessionCookie keeps the gaia session, and the tokens in it, from reaching the upstream
+func stripSessionCookie(r *http.Request) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != "gaia" {
+			r.AddCookie(c)
+		}
+	}
+}
+
+/*
+newReverseProxy streams requests and responses between the client and
+the upstream in the request context. Status, headers, cookies and
+trailers are passed on, hop-by-hop headers are dropped, and upgraded
+connections (websockets) and event streams are passed through.
+*/
+func newReverseProxy(config Config) *httputil.ReverseProxy {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Only the wait for the response headers is limited, a stream or a websocket may stay open for long
+	transport.ResponseHeaderTimeout = config.PROXY_TIMEOUT
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(pr.In.Context().Value(upstreamKey{}).(*url.URL))
+			// X-Forwarded-* sent by the client were removed before Rewrite, these are ours
+			pr.SetXForwarded()
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("proxy error for %s: %v", r.URL.Redacted(), err)
+
+			var netErr net.Error
+			if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+				http.Error(w, ErrUpstreamTimeout.Error(), http.StatusGatewayTimeout)
+				return
+			}
+			http.Error(w, ErrUpstream.Error(), http.StatusBadGateway)
+		},
+	}
+}
@@ -1,12 +1,20 @@
 package server
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
-	"net/url"
 	"slices"
+	"time"
 
 	"github.com/gorilla/sessions"
+	"github.com/henrikkorsgaard/gaia/auth/clients"
+	"github.com/henrikkorsgaard/gaia/auth/identity"
+	"github.com/henrikkorsgaard/gaia/auth/registry"
+	"github.com/henrikkorsgaard/gaia/auth/routes"
+	"github.com/henrikkorsgaard/gaia/auth/sessionstore"
+	"github.com/henrikkorsgaard/gaia/auth/tokens"
 )
 
 // Should be put in .env
@@ -21,12 +29,41 @@ type Config struct {
 	MITID_CLIENT_ID     string `env:"MITID_CLIENT_ID,required"`
 	MITID_CLIENT_SECRET string `env:"MITID_CLIENT_SECRET,required"`
 	MITID_BROKER_HOST   string `env:"MITID_BROKER_HOST,required"`
+	//Generic OpenID Connect provider, e.g. MitID Erhverv or a partner IdP. Optional.
+	OIDC_PROVIDER_NAME string `env:"OIDC_PROVIDER_NAME" envDefault:"oidc"`
+	OIDC_PROVIDER_HOST string `env:"OIDC_PROVIDER_HOST"`
+	OIDC_CLIENT_ID     string `env:"OIDC_CLIENT_ID"`
+	OIDC_CLIENT_SECRET string `env:"OIDC_CLIENT_SECRET"`
 	//Keys
-	TOKEN_SIGN_KEY string `env:"TOKEN_SIGN_KEY,required"`
-	SESSION_KEY    string `env:"SESSION_KEY,required"`
+	// User tokens are signed with a generated key, or the last key in TOKEN_SIGN_KEY_FILE
+	TOKEN_SIGN_ALG      string        `env:"TOKEN_SIGN_ALG" envDefault:"ES256"`
+	TOKEN_SIGN_KEY_FILE string        `env:"TOKEN_SIGN_KEY_FILE"`
+	TOKEN_KEY_ROTATION  time.Duration `env:"TOKEN_KEY_ROTATION"`
+	SESSION_KEY         string        `env:"SESSION_KEY,required"`
+	//Sessions
+	// sqlite keeps sessions on the server and the cookie only has the id, cookie keeps them in the cookie.
+	// sqlite also keeps the session registry and refresh tokens, with cookie they are in memory and every user is logged out by a restart.
+	SESSION_STORE            string        `env:"SESSION_STORE" envDefault:"sqlite"`
+	SESSION_DATABASE         string        `env:"SESSION_DATABASE" envDefault:"sessions.db"`
+	SESSION_IDLE_TIMEOUT     time.Duration `env:"SESSION_IDLE_TIMEOUT" envDefault:"2h"`
+	SESSION_ABSOLUTE_TIMEOUT time.Duration `env:"SESSION_ABSOLUTE_TIMEOUT" envDefault:"24h"`
+	SESSION_SWEEP            time.Duration `env:"SESSION_SWEEP" envDefault:"5m"`
+	//Services that get tokens with the client credentials grant on /oauth/token, as JSON, see auth/clients
+	SERVICE_CLIENTS string `env:"SERVICE_CLIENTS"`
 	//Hosts
 	ORIGIN_SERVER string `env:"ORIGIN_SERVER,required"`
 	CRM_SERVER    string `env:"CRM_SERVER,required"`
+	DMI_SERVER    string `env:"DMI_SERVER"`
+	//Gateway route table as a JSON file or inline JSON, see auth/routes. Defaults to protecting /secret/ on the origin server.
+	ROUTES_FILE   string        `env:"ROUTES_FILE"`
+	ROUTES        string        `env:"ROUTES"`
+	ROUTES_RELOAD time.Duration `env:"ROUTES_RELOAD" envDefault:"10s"`
+	//How long the gateway waits for an upstream to answer
+	PROXY_TIMEOUT time.Duration `env:"PROXY_TIMEOUT" envDefault:"30s"`
+	//How long each onboarding step may take, before the user has to log in again
+	ONBOARDING_TTL time.Duration `env:"ONBOARDING_TTL" envDefault:"30m"`
+	//Logout
+	END_PROVIDER_SESSION bool `env:"END_PROVIDER_SESSION"`
 	//Redirects
 	POST_LOGIN_REDIRECT        string `env:"POST_LOGIN_REDIRECT"`
 	IDENTITY_ERROR_REDIRECT    string `env:"IDENTITY_ERROR_REDIRECT"`
@@ -34,8 +71,24 @@ type Config struct {
 }
 
 func NewServer(config Config) http.Handler {
-	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
-	var handler http.Handler = addRoutes(store, config)
+	store, err := newSessionStore(config)
+	if err != nil {
+		log.Fatalf("unable to open the session store: %v", err)
+	}
+	refreshTokens, sessionRegistry, err := newLoginStores(store)
+	if err != nil {
+		log.Fatalf("unable to open the session registry: %v", err)
+	}
+
+	keys, err := newKeyRing(config)
+	if err != nil {
+		log.Fatalf("unable to create token signing keys: %v", err)
+	}
+	if config.TOKEN_KEY_ROTATION > 0 {
+		go keys.RotateEvery(config.TOKEN_KEY_ROTATION, nil)
+	}
+
+	var handler http.Handler = addRoutes(store, refreshTokens, sessionRegistry, keys, config)
 	// we want cors check first, because that is the simplest access check
 	handler = checkCORS(handler)
 
@@ -43,25 +96,168 @@ func NewServer(config Config) http.Handler {
 }
 
 // refactored into independent route function to aid testing
-func addRoutes(store *sessions.CookieStore, config Config) *http.ServeMux {
+func addRoutes(store sessions.Store, refreshTokens *tokens.RefreshStore, sessionRegistry *registry.SessionRegistry, keys *tokens.KeyRing, config Config) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.Handle("/healthy", healthy())
+	mux.Handle("/.well-known/jwks.json", publishKeys(keys))
+
+	providers := identity.Providers{}
+	providers.Add(identity.NewMitID(config.MITID_BROKER_HOST, config.MITID_CLIENT_ID, config.MITID_CLIENT_SECRET, config.ENVIRONMENT == "dev"))
+	if config.OIDC_PROVIDER_HOST != "" {
+		providers.Add(identity.NewOIDC(config.OIDC_PROVIDER_NAME, config.OIDC_PROVIDER_HOST, config.OIDC_CLIENT_ID, config.OIDC_CLIENT_SECRET))
+	}
+	if config.ENVIRONMENT == "dev" {
+		providers.Add(identity.NewSimulator())
+	}
 
 	// Handles full authentication
-	mux.Handle("/account/authenticate", authenticate(store, config))
-	mux.Handle("/account/login", login(config))
-	mux.Handle("/account/onboarding", onboarding(store, config))
+	mux.Handle("/account/authenticate", authenticate(store, refreshTokens, sessionRegistry, keys, providers, config))
+	mux.Handle("/account/login", login(store, providers, config))
+	mux.Handle("/account/login/{provider}", login(store, providers, config))
+	mux.Handle("/account/onboarding", onboarding(store, refreshTokens, sessionRegistry, keys, config))
+	mux.Handle("/account/onboarding/{step}", onboarding(store, refreshTokens, sessionRegistry, keys, config))
+	mux.Handle("/account/refresh", refresh(store, refreshTokens, sessionRegistry, keys, config))
+	mux.Handle("/account/logout", logout(store, refreshTokens, sessionRegistry, providers, config))
+	mux.Handle("/account/sessions/{gaiaId}", revokeSessions(refreshTokens, sessionRegistry, keys))
 
-	originServer, err := url.Parse(config.ORIGIN_SERVER)
+	serviceClients, err := newServiceClients(config)
+	if err != nil {
+		log.Fatalf("invalid service clients: %v", err)
+	}
+	mux.Handle("/oauth/token", issueServiceToken(serviceClients, keys))
 
+	routeTable, err := newRouteTable(config)
 	if err != nil {
-		log.Fatal("invalid origin server URL")
+		log.Fatalf("invalid route table: %v", err)
 	}
-	mux.Handle("/", proxyHandler(store, originServer, config))
+	mux.Handle("/", proxyHandler(store, refreshTokens, sessionRegistry, keys, routeTable, config))
 
 	return mux
 }
 
+// newRouteTable loads the route table, and reloads it when the file changes
+func newRouteTable(config Config) (*routes.Reloader, error) {
+	upstreams := map[string]string{
+		"app": config.ORIGIN_SERVER,
+		"crm": config.CRM_SERVER,
+		"dmi": config.DMI_SERVER,
+	}
+
+	if config.ROUTES_FILE != "" {
+		routeTable, err := routes.NewReloader(config.ROUTES_FILE, upstreams)
+		if err != nil {
+			return nil, err
+		}
+		if config.ROUTES_RELOAD > 0 {
+			go routeTable.Watch(config.ROUTES_RELOAD, nil)
+		}
+		return routeTable, nil
+	}
+
+	if config.ROUTES != "" {
+		table, err := routes.Parse([]byte(config.ROUTES), upstreams)
+		if err != nil {
+			return nil, err
+		}
+		return routes.Static(table), nil
+	}
+
+	table, err := routes.Default(config.ORIGIN_SERVER)
+	if err != nil {
+		return nil, err
+	}
+	return routes.Static(table), nil
+}
+
+/*
+newSessionStore opens the session store. Outside dev the cookie is
+only sent over HTTPS, and never to scripts or cross-site subrequests.
+SameSite is Lax and not Strict, because the identity provider redirects
+back to /account/authenticate from another site.
+*/
+func newSessionStore(config Config) (sessions.Store, error) {
+	options := &sessions.Options{
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   config.ENVIRONMENT != "dev",
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	switch config.SESSION_STORE {
+	case "cookie":
+		store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+		options.MaxAge = store.Options.MaxAge
+		store.Options = options
+		return store, nil
+	case "sqlite", "":
+		store, err := sessionstore.NewSQLiteStore(config.SESSION_DATABASE, []byte(config.SESSION_KEY), config.SESSION_IDLE_TIMEOUT, config.SESSION_ABSOLUTE_TIMEOUT)
+		if err != nil {
+			return nil, err
+		}
+		options.MaxAge = store.Options.MaxAge
+		store.Options = options
+		if config.SESSION_SWEEP > 0 {
+			go store.SweepEvery(config.SESSION_SWEEP, nil)
+		}
+		return store, nil
+	}
+	return nil, fmt.Errorf("unknown SESSION_STORE %q", config.SESSION_STORE)
+}
+
+// newLoginStores keeps the refresh tokens and session registry with the sessions, so logins survive a restart like they do
+func newLoginStores(store sessions.Store) (*tokens.RefreshStore, *registry.SessionRegistry, error) {
+	sqliteStore, ok := store.(*sessionstore.SQLiteStore)
+	if !ok {
+		return tokens.NewRefreshStore(), registry.NewSessionRegistry(), nil
+	}
+	refreshTokens, err := tokens.NewSQLiteRefreshStore(sqliteStore.DB())
+	if err != nil {
+		return nil, nil, err
+	}
+	sessionRegistry, err := registry.NewSQLiteRegistry(sqliteStore.DB())
+	if err != nil {
+		return nil, nil, err
+	}
+	return refreshTokens, sessionRegistry, nil
+}
+
+// newServiceClients reads the registered services. Without any, no service can get a token.
+func newServiceClients(config Config) (*clients.Registry, error) {
+	if config.SERVICE_CLIENTS == "" {
+		return clients.Parse([]byte("[]"))
+	}
+	return clients.Parse([]byte(config.SERVICE_CLIENTS))
+}
+
+func newKeyRing(config Config) (*tokens.KeyRing, error) {
+	if config.TOKEN_SIGN_KEY_FILE != "" {
+		return tokens.LoadKeyRing(config.TOKEN_SIGN_KEY_FILE)
+	}
+	return tokens.NewKeyRing(config.TOKEN_SIGN_ALG)
+}
+
+// publishKeys serves the public keys backends use to verify Gaia tokens
+func publishKeys(keys *tokens.KeyRing) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+
+		set, err := keys.JWKS()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		// Short enough that a rotated key is picked up well within the overlap
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(set)
+	})
+}
+
 func healthy() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusTeapot)
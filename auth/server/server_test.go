@@ -1,26 +1,39 @@
 package server
 
 import (
-	"encoding/gob"
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
 	"net/url"
-	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/gorilla/sessions"
+	"github.com/henrikkorsgaard/gaia/auth/fakebroker"
+	"github.com/henrikkorsgaard/gaia/auth/forwarded"
+	"github.com/henrikkorsgaard/gaia/auth/identity"
+	"github.com/henrikkorsgaard/gaia/auth/jwks"
+	"github.com/henrikkorsgaard/gaia/auth/oidc"
+	"github.com/henrikkorsgaard/gaia/auth/registry"
 	"github.com/henrikkorsgaard/gaia/auth/tokens"
+	"github.com/henrikkorsgaard/gaia/crm/dar/fixture"
 	"github.com/henrikkorsgaard/gaia/crm/database"
 	"github.com/henrikkorsgaard/gaia/crm/server"
 	"github.com/matryer/is"
 )
 
-var testdb = "test.db"
-
 func TestCookieAuthCheck(t *testing.T) {
 	is := is.New(t)
 
@@ -35,13 +48,18 @@ func TestCookieAuthCheck(t *testing.T) {
 	}
 
 	config := getServerConfig()
+	keys := getKeyRing()
 	config.ORIGIN_SERVER = source.URL
 	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+	sessionRegistry := registry.NewSessionRegistry()
 
-	authServer := httptest.NewServer(addRoutes(store, config))
+	authServer := httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), sessionRegistry, keys, config))
 	defer authServer.Close()
 
-	token, err := tokens.NewUserToken(u.GaiaId, config.TOKEN_SIGN_KEY)
+	token, err := tokens.NewUserToken(u.GaiaId, tokens.RoleCustomer, keys)
+	is.NoErr(err)
+
+	sid, err := sessionRegistry.Add(u.GaiaId)
 	is.NoErr(err)
 
 	req, err := http.NewRequest("GET", fmt.Sprintf("%v/secret/page.html", authServer.URL), nil)
@@ -51,6 +69,7 @@ func TestCookieAuthCheck(t *testing.T) {
 	is.NoErr(err)
 
 	session.Values["token"] = token
+	session.Values["sid"] = sid
 
 	recorder := httptest.NewRecorder()
 	err = session.Save(req, recorder)
@@ -78,13 +97,14 @@ func TestIndexWithCookie(t *testing.T) {
 	}
 
 	config := getServerConfig()
+	keys := getKeyRing()
 	config.ORIGIN_SERVER = source.URL
 	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
 
-	authServer := httptest.NewServer(addRoutes(store, config))
+	authServer := httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), registry.NewSessionRegistry(), keys, config))
 	defer authServer.Close()
 
-	token, err := tokens.NewUserToken(u.GaiaId, config.TOKEN_SIGN_KEY)
+	token, err := tokens.NewUserToken(u.GaiaId, tokens.RoleCustomer, keys)
 	is.NoErr(err)
 
 	req, err := http.NewRequest("GET", fmt.Sprintf("%v/index.html", authServer.URL), nil)
@@ -111,9 +131,10 @@ func TesMissingCookieFail(t *testing.T) {
 	is := is.New(t)
 
 	config := getServerConfig()
+	keys := getKeyRing()
 	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
 
-	authServer := httptest.NewServer(addRoutes(store, config))
+	authServer := httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), registry.NewSessionRegistry(), keys, config))
 	defer authServer.Close()
 
 	req, err := http.NewRequest("GET", fmt.Sprintf("%v/secret/page.html", authServer.URL), nil)
@@ -129,9 +150,10 @@ func TestMissingTokenFail(t *testing.T) {
 	is := is.New(t)
 
 	config := getServerConfig()
+	keys := getKeyRing()
 	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
 
-	authServer := httptest.NewServer(addRoutes(store, config))
+	authServer := httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), registry.NewSessionRegistry(), keys, config))
 	defer authServer.Close()
 
 	req, err := http.NewRequest("GET", fmt.Sprintf("%v/secret/page.html", authServer.URL), nil)
@@ -158,9 +180,10 @@ func TestInvalidTokenFail(t *testing.T) {
 	is := is.New(t)
 
 	config := getServerConfig()
+	keys := getKeyRing()
 	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
 
-	authServer := httptest.NewServer(addRoutes(store, config))
+	authServer := httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), registry.NewSessionRegistry(), keys, config))
 	defer authServer.Close()
 
 	req, err := http.NewRequest("GET", fmt.Sprintf("%v/secret/page.html", authServer.URL), nil)
@@ -180,7 +203,7 @@ func TestInvalidTokenFail(t *testing.T) {
 	client := authServer.Client()
 	resp, err := client.Do(req)
 	is.NoErr(err)
-	is.Equal(resp.StatusCode, http.StatusInternalServerError)
+	is.Equal(resp.StatusCode, http.StatusUnauthorized)
 }
 
 func TestProxyIntegrationIndex(t *testing.T) {
@@ -206,84 +229,1379 @@ func TestProxyIntegrationIndex(t *testing.T) {
 
 // This is closer to an integration test, but it hits all aspects.
 func TestOnboardingIntegration(t *testing.T) {
-	defer cleanup()
 	is := is.New(t)
 
-	db := database.New(testdb)
-	gob.Register(mitidUser{})
+	db := database.NewMemoryStore()
 	u1 := database.User{
-		Name:    "Bruno Latour",
-		Address: "Landgreven 10, 1301 København K",
-		DarId:   "0a3f507a-b2e6-32b8-e044-0003ba298018",
+		Name:  "Bruno Latour",
+		DarId: "0a3f507a-b2e6-32b8-e044-0003ba298018",
 	}
-	_, err := db.CreateUser(u1)
+	address := "Landgreven 10, 1301 København K"
+
+	config := getServerConfig()
+	keys := getKeyRing()
+	crm, closeCRM := newCRMServer(db, keys)
+	defer closeCRM()
+	config.CRM_SERVER = crm.URL
+
+	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+	authServer := httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), registry.NewSessionRegistry(), keys, config))
+	defer authServer.Close()
+
+	cookie := onboardingCookie(t, store, identity.Identity{
+		Provider:  "mitid",
+		Subject:   uuid.New().String(),
+		MitIdUUID: uuid.New().String(),
+		Name:      u1.Name,
+	}, config)
+	step := onboardingClient(t, authServer, cookie)
+
+	// The frontend greets the user by name without a readable cookie
+	resp, view := step("", nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(view.Step, stepIdentityConfirmed)
+	is.Equal(view.Name, u1.Name)
+
+	// Steps cannot be skipped
+	resp, _ = step("account", nil)
+	is.Equal(resp.StatusCode, http.StatusConflict)
+	resp, _ = step("terms", url.Values{"accept": {"true"}})
+	is.Equal(resp.StatusCode, http.StatusConflict)
+
+	resp, _ = step("address", url.Values{"address": {address}})
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+	resp, view = step("address", url.Values{"address": {address}, "darid": {u1.DarId}})
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(view.Step, stepAddressChosen)
+	is.Equal(view.DarId, u1.DarId)
+
+	resp, _ = step("terms", nil)
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+	resp, view = step("terms", url.Values{"accept": {"true"}})
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(view.Step, stepTermsAccepted)
+
+	resp, view = step("account", nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(view.Step, stepAccountCreated)
+	is.Equal(view.Redirect, "/gaia/dashboard.html")
+
+	req, err := http.NewRequest("GET", authServer.URL, nil)
+	is.NoErr(err)
+	req.AddCookie(sessionCookie(resp))
+	sess, err := store.Get(req, "gaia")
 	is.NoErr(err)
 
-	crm := httptest.NewServer(server.NewServer(db))
-	defer crm.Close()
+	tokenString := sess.Values["token"].(string)
+	claims, err := tokens.ParseToken(tokenString, keys)
+
+	is.NoErr(err)
+
+	is.Equal(claims.Audience, jwt.ClaimStrings{"crm", "data", "invoice"})
+	is.Equal(claims.Scope, "crm:read crm:write data:read invoice:read")
+	is.Equal(claims.Roles, []string{tokens.RoleCustomer})
+
+	// The onboarding is over
+	_, ok := sess.Values["onboarding"]
+	is.True(!ok)
+	user, err := db.GetUserById(claims.Subject)
+	is.NoErr(err)
+	is.Equal(user.DarId, u1.DarId)
+}
+
+func TestOnboardingExpires(t *testing.T) {
+	is := is.New(t)
+
+	config := getServerConfig()
+	keys := getKeyRing()
+	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+	authServer := httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), registry.NewSessionRegistry(), keys, config))
+	defer authServer.Close()
+
+	resp, _ := onboardingClient(t, authServer, nil)("", nil)
+	is.Equal(resp.StatusCode, http.StatusNotFound)
+
+	req, err := http.NewRequest("GET", "/", nil)
+	is.NoErr(err)
+	session, err := store.Get(req, "gaia")
+	is.NoErr(err)
+	startOnboarding(session, identity.Identity{Provider: "mitid", Subject: "abc", Name: "Bruno Latour"}, config)
+	state := session.Values["onboarding"].(onboardingState)
+	state.Expires = time.Now().Add(-time.Second)
+	session.Values["onboarding"] = state
+	recorder := httptest.NewRecorder()
+	is.NoErr(session.Save(req, recorder))
+
+	step := onboardingClient(t, authServer, recorder.Result().Cookies()[0])
+	resp, _ = step("address", url.Values{"address": {"Landgreven 10"}, "darid": {"abc"}})
+	is.Equal(resp.StatusCode, http.StatusGone)
+	// The expired onboarding is gone, the user has to log in again
+	resp, _ = step("", nil)
+	is.Equal(resp.StatusCode, http.StatusNotFound)
+}
+
+// An address DAR does not know sends the user back to choosing an address
+func TestOnboardingUnknownAddress(t *testing.T) {
+	is := is.New(t)
 
+	db := database.NewMemoryStore()
 	config := getServerConfig()
+	keys := getKeyRing()
+	crm, closeCRM := newCRMServer(db, keys)
+	defer closeCRM()
 	config.CRM_SERVER = crm.URL
 
 	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
-	authServer := httptest.NewServer(addRoutes(store, config))
+	authServer := httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), registry.NewSessionRegistry(), keys, config))
 	defer authServer.Close()
 
-	form := url.Values{}
-	form.Add("address", u1.Address)
-	form.Add("darid", u1.DarId)
+	step := onboardingClient(t, authServer, onboardingCookie(t, store, identity.Identity{
+		Provider: "mitid",
+		Subject:  uuid.New().String(),
+		Name:     "Bruno Latour",
+	}, config))
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%v/account/onboarding", authServer.URL), strings.NewReader(form.Encode()))
+	resp, _ := step("address", url.Values{"address": {"Landgreven 10"}, "darid": {"c6a8d1b8-7b5e-4a3e-9e0b-1f0a2b3c4d5e"}})
+	is.Equal(resp.StatusCode, http.StatusOK)
+	resp, _ = step("terms", url.Values{"accept": {"true"}})
+	is.Equal(resp.StatusCode, http.StatusOK)
+	resp, _ = step("account", nil)
+	is.Equal(resp.StatusCode, http.StatusUnprocessableEntity)
+
+	resp, view := step("", nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(view.Step, stepIdentityConfirmed)
+}
+
+// A new login with the same identity resumes the onboarding, another identity starts over
+func TestOnboardingResumes(t *testing.T) {
+	is := is.New(t)
+
+	config := getServerConfig()
+	ident := identity.Identity{Provider: "mitid", Subject: "abc", Name: "Bruno Latour"}
+
+	session := sessions.NewSession(sessions.NewCookieStore([]byte(config.SESSION_KEY)), "gaia")
+	startOnboarding(session, ident, config)
+	state := session.Values["onboarding"].(onboardingState)
+	state.Step = stepAddressChosen
+	state.DarId = "0a3f507a-b2e6-32b8-e044-0003ba298018"
+	session.Values["onboarding"] = state
+
+	startOnboarding(session, ident, config)
+	state = session.Values["onboarding"].(onboardingState)
+	is.Equal(state.Step, stepAddressChosen)
+	is.Equal(state.DarId, "0a3f507a-b2e6-32b8-e044-0003ba298018")
+
+	startOnboarding(session, identity.Identity{Provider: "mitid", Subject: "def", Name: "Donna Haraway"}, config)
+	state = session.Values["onboarding"].(onboardingState)
+	is.Equal(state.Step, stepIdentityConfirmed)
+	is.Equal(state.DarId, "")
+}
+
+// onboardingCookie is the session cookie after authenticate found no user for the identity
+func onboardingCookie(t *testing.T, store sessions.Store, ident identity.Identity, config Config) *http.Cookie {
+	is := is.New(t)
+
+	req, err := http.NewRequest("GET", "/", nil)
+	is.NoErr(err)
+	session, err := store.Get(req, "gaia")
 	is.NoErr(err)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	startOnboarding(session, ident, config)
 
+	recorder := httptest.NewRecorder()
+	is.NoErr(session.Save(req, recorder))
+	return recorder.Result().Cookies()[0]
+}
+
+// onboardingClient returns a function taking an onboarding step with the session cookie, like a browser. The empty step reads the state.
+func onboardingClient(t *testing.T, authServer *httptest.Server, cookie *http.Cookie) func(step string, form url.Values) (*http.Response, onboardingView) {
+	is := is.New(t)
+
+	return func(step string, form url.Values) (*http.Response, onboardingView) {
+		method, path := "GET", "/account/onboarding"
+		if step != "" {
+			method, path = "POST", "/account/onboarding/"+step
+		}
+		req, err := http.NewRequest(method, authServer.URL+path, strings.NewReader(form.Encode()))
+		is.NoErr(err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := authServer.Client().Do(req)
+		is.NoErr(err)
+		if cookies := resp.Cookies(); len(cookies) > 0 {
+			cookie = cookies[0]
+		}
+
+		var view onboardingView
+		if resp.StatusCode == http.StatusOK {
+			is.NoErr(json.NewDecoder(resp.Body).Decode(&view))
+		}
+		return resp, view
+	}
+}
+
+func TestLoginStartsAttempt(t *testing.T) {
+	is := is.New(t)
+
+	broker := newDiscoveryStub()
+	defer broker.Close()
+
+	config := getServerConfig()
+	keys := getKeyRing()
+	config.MITID_BROKER_HOST = broker.URL
+	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+
+	authServer := httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), registry.NewSessionRegistry(), keys, config))
+	defer authServer.Close()
+
+	client := authServer.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	resp, err := client.Get(fmt.Sprintf("%v/account/login", authServer.URL))
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusFound)
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	is.NoErr(err)
+	is.Equal(location.Path, "/connect/authorize")
+
+	req, err := http.NewRequest("GET", authServer.URL, nil)
+	is.NoErr(err)
+	req.AddCookie(resp.Cookies()[0])
 	session, err := store.Get(req, "gaia")
 	is.NoErr(err)
+	attempt := session.Values["login"].(loginAttempt)
 
-	session.Values["mitid"] = mitidUser{
-		MitIdUUID: uuid.New().String(),
-		Name:      u1.Name,
+	q := location.Query()
+	is.Equal(q.Get("state"), attempt.State)
+	is.Equal(q.Get("nonce"), attempt.Nonce)
+	is.Equal(q.Get("code_challenge"), attempt.codeChallenge())
+	is.Equal(q.Get("code_challenge_method"), "S256")
+
+	// Every login gets its own state
+	resp, err = client.Get(fmt.Sprintf("%v/account/login", authServer.URL))
+	is.NoErr(err)
+	location2, err := url.Parse(resp.Header.Get("Location"))
+	is.NoErr(err)
+	is.True(location2.Query().Get("state") != q.Get("state"))
+}
+
+func TestAuthenticateRejectsState(t *testing.T) {
+	is := is.New(t)
+
+	config := getServerConfig()
+	keys := getKeyRing()
+	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+
+	authServer := httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), registry.NewSessionRegistry(), keys, config))
+	defer authServer.Close()
+	client := authServer.Client()
+
+	callback := func(attempt *loginAttempt, state string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%v/account/authenticate?state=%s", authServer.URL, state), nil)
+		is.NoErr(err)
+
+		if attempt != nil {
+			session, err := store.Get(req, "gaia")
+			is.NoErr(err)
+			session.Values["login"] = *attempt
+			recorder := httptest.NewRecorder()
+			is.NoErr(session.Save(req, recorder))
+			req.AddCookie(recorder.Result().Cookies()[0])
+		}
+
+		resp, err := client.Do(req)
+		is.NoErr(err)
+		body, err := io.ReadAll(resp.Body)
+		is.NoErr(err)
+		return resp, strings.TrimSpace(string(body))
+	}
+
+	// No login was started in this session
+	resp, body := callback(nil, "somestate")
+	is.Equal(resp.StatusCode, http.StatusUnauthorized)
+	is.Equal(body, ErrAuthenticationStateError.Error())
+
+	// The state belongs to another session
+	attempt := newLoginAttempt("mitid")
+	resp, body = callback(&attempt, newLoginAttempt("mitid").State)
+	is.Equal(resp.StatusCode, http.StatusUnauthorized)
+	is.Equal(body, ErrAuthenticationStateError.Error())
+
+	expired := newLoginAttempt("mitid")
+	expired.Expires = time.Now().Add(-time.Minute)
+	resp, body = callback(&expired, expired.State)
+	is.Equal(resp.StatusCode, http.StatusUnauthorized)
+	is.Equal(body, ErrAuthenticationStateExpired.Error())
+
+	// The first callback consumes the attempt, even though the missing code fails it
+	resp, body = callback(&attempt, attempt.State)
+	is.Equal(resp.StatusCode, http.StatusInternalServerError)
+	is.Equal(body, ErrAuthenticationMissingCode.Error())
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%v/account/authenticate?state=%s&code=abc", authServer.URL, attempt.State), nil)
+	is.NoErr(err)
+	req.AddCookie(resp.Cookies()[0])
+	resp, err = client.Do(req)
+	is.NoErr(err)
+	replayed, err := io.ReadAll(resp.Body)
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusUnauthorized)
+	is.Equal(strings.TrimSpace(string(replayed)), ErrAuthenticationStateReplayed.Error())
+}
+
+func TestSimulatorLogin(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+	config := getServerConfig()
+	keys := getKeyRing()
+	crm, closeCRM := newCRMServer(db, keys)
+	defer closeCRM()
+	config.CRM_SERVER = crm.URL
+	// The server-side store, so the identity never reaches the browser
+	store, err := newSessionStore(config)
+	is.NoErr(err)
+
+	authServer := httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), registry.NewSessionRegistry(), keys, config))
+	defer authServer.Close()
+
+	client := authServer.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
 	}
 
+	resp, err := client.Get(fmt.Sprintf("%v/account/login/simulator?sub=abc&name=Bruno+Latour", authServer.URL))
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusFound)
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	is.NoErr(err)
+	is.Equal(location.Path, "/account/authenticate")
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%v/account/authenticate?%s", authServer.URL, location.RawQuery), nil)
+	is.NoErr(err)
+	req.AddCookie(resp.Cookies()[0])
+	resp, err = client.Do(req)
+	is.NoErr(err)
+
+	// Unknown to CRM, so the user is sent to onboarding with the identity in the session
+	is.Equal(resp.StatusCode, http.StatusFound)
+	is.Equal(resp.Header.Get("Location"), "/onboarding.html")
+	is.True(!strings.Contains(sessionCookie(resp).Value, "Bruno"))
+
+	req, err = http.NewRequest("GET", authServer.URL, nil)
+	is.NoErr(err)
+	req.AddCookie(sessionCookie(resp))
+	session, err := store.Get(req, "gaia")
+	is.NoErr(err)
+	ident := session.Values["onboarding"].(onboardingState).Identity
+	is.Equal(ident.Provider, "simulator")
+	is.Equal(ident.Subject, "abc")
+	is.Equal(ident.Name, "Bruno Latour")
+}
+
+// A session id planted in the browser before login is not the one that is logged in
+func TestLoginRenewsSessionId(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+	_, err := db.CreateUser(database.User{Name: "Bruno Latour", Provider: "simulator", Subject: "abc"})
+	is.NoErr(err)
+	config := getServerConfig()
+	keys := getKeyRing()
+	crm, closeCRM := newCRMServer(db, keys)
+	defer closeCRM()
+	config.CRM_SERVER = crm.URL
+	store, err := newSessionStore(config)
+	is.NoErr(err)
+
+	authServer := httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), registry.NewSessionRegistry(), keys, config))
+	defer authServer.Close()
+	client := browserClient(authServer)
+
+	for _, subject := range []string{"abc", "new"} {
+		resp, err := client.Get(fmt.Sprintf("%v/account/login/simulator?sub=%s&name=Bruno+Latour", authServer.URL, subject))
+		is.NoErr(err)
+		planted := sessionCookie(resp)
+
+		location, err := url.Parse(resp.Header.Get("Location"))
+		is.NoErr(err)
+		resp, err = client.Get(fmt.Sprintf("%v/account/authenticate?%s", authServer.URL, location.RawQuery))
+		is.NoErr(err)
+		is.Equal(resp.StatusCode, http.StatusFound)
+
+		// Logged in, or onboarding with the verified identity
+		cookie := sessionCookie(resp)
+		is.True(cookie.Value != planted.Value)
+		is.True(cookie.MaxAge >= 0)
+
+		req, err := http.NewRequest("GET", authServer.URL, nil)
+		is.NoErr(err)
+		req.AddCookie(planted)
+		session, err := store.Get(req, "gaia")
+		is.NoErr(err)
+		is.True(session.IsNew)
+	}
+}
+
+// Outside dev the session cookie is only sent over HTTPS
+func TestSessionCookieOptions(t *testing.T) {
+	is := is.New(t)
+
+	for _, environment := range []string{"dev", "production"} {
+		config := getServerConfig()
+		config.ENVIRONMENT = environment
+		for _, kind := range []string{"sqlite", "cookie"} {
+			config.SESSION_STORE = kind
+			store, err := newSessionStore(config)
+			is.NoErr(err)
+
+			req := httptest.NewRequest("GET", "/", nil)
+			session, err := store.Get(req, "gaia")
+			is.NoErr(err)
+			session.Values["sid"] = "1"
+			recorder := httptest.NewRecorder()
+			is.NoErr(session.Save(req, recorder))
+
+			cookie := recorder.Result().Cookies()[0]
+			is.True(cookie.HttpOnly)
+			is.Equal(cookie.SameSite, http.SameSiteLaxMode)
+			is.Equal(cookie.Secure, environment != "dev")
+		}
+	}
+
+	config := getServerConfig()
+	config.SESSION_STORE = "redis"
+	_, err := newSessionStore(config)
+	is.True(err != nil)
+}
+
+func TestLoginUnknownProvider(t *testing.T) {
+	is := is.New(t)
+
+	config := getServerConfig()
+	keys := getKeyRing()
+	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+	authServer := httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), registry.NewSessionRegistry(), keys, config))
+	defer authServer.Close()
+
+	resp, err := authServer.Client().Get(fmt.Sprintf("%v/account/login/nowhere", authServer.URL))
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusNotFound)
+}
+
+// The complete MitID flow against the fake broker: login, no match, onboarding, dashboard and a second login.
+func TestMitIDLoginFlow(t *testing.T) {
+	is := is.New(t)
+
+	mitid := uuid.New().String()
+	config := getServerConfig()
+	keys := getKeyRing()
+	_, broker := fakebroker.NewServer(config.MITID_CLIENT_ID, config.MITID_CLIENT_SECRET, fakebroker.Identity{
+		MitIdUUID: mitid,
+		Name:      "Bruno Latour",
+	})
+	defer broker.Close()
+
+	db := database.NewMemoryStore()
+	crm, closeCRM := newCRMServer(db, keys)
+	defer closeCRM()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer origin.Close()
+
+	config.MITID_BROKER_HOST = broker.URL
+	config.CRM_SERVER = crm.URL
+	config.ORIGIN_SERVER = origin.URL
+	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+
+	authServer := httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), registry.NewSessionRegistry(), keys, config))
+	defer authServer.Close()
+	client := browserClient(authServer)
+
+	resp := mitidLogin(t, client, authServer, mitid)
+	is.Equal(resp.StatusCode, http.StatusFound)
+	is.Equal(resp.Header.Get("Location"), "/onboarding.html")
+
+	steps := []struct {
+		step string
+		form url.Values
+	}{
+		{"address", url.Values{"address": {"Landgreven 10, 1301 København K"}, "darid": {"0a3f507a-b2e6-32b8-e044-0003ba298018"}}},
+		{"terms", url.Values{"accept": {"true"}}},
+		{"account", nil},
+	}
+	for _, s := range steps {
+		resp, err := client.PostForm(fmt.Sprintf("%v/account/onboarding/%s", authServer.URL, s.step), s.form)
+		is.NoErr(err)
+		is.Equal(resp.StatusCode, http.StatusOK)
+	}
+
+	resp, err := client.Get(fmt.Sprintf("%v/secret/dashboard.html", authServer.URL))
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	user, err := db.GetUserMitIDUUID(mitid)
+	is.NoErr(err)
+	is.Equal(user.Name, "Bruno Latour")
+	is.Equal(user.Provider, "mitid")
+
+	// The second time the user is matched and goes straight to the dashboard
+	resp = mitidLogin(t, browserClient(authServer), authServer, mitid)
+	is.Equal(resp.StatusCode, http.StatusFound)
+	is.Equal(resp.Header.Get("Location"), "/gaia/dashboard.html")
+}
+
+func TestMitIDLoginBrokerFailures(t *testing.T) {
+	is := is.New(t)
+
+	mitid := uuid.New().String()
+	config := getServerConfig()
+	keys := getKeyRing()
+	fake, broker := fakebroker.NewServer(config.MITID_CLIENT_ID, config.MITID_CLIENT_SECRET, fakebroker.Identity{
+		MitIdUUID: mitid,
+		Name:      "Bruno Latour",
+	})
+	defer broker.Close()
+
+	config.MITID_BROKER_HOST = broker.URL
+	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+	authServer := httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), registry.NewSessionRegistry(), keys, config))
+	defer authServer.Close()
+
+	failures := map[fakebroker.Failure]error{
+		fakebroker.FailExpiredCode: oidc.ErrTokenExchange,
+		fakebroker.FailBadState:    ErrAuthenticationStateError,
+		fakebroker.FailWrongNonce:  oidc.ErrIDTokenNonce,
+		fakebroker.FailServerError: oidc.ErrTokenExchange,
+	}
+
+	for failure, expected := range failures {
+		fake.Fail(failure)
+		resp := mitidLogin(t, browserClient(authServer), authServer, mitid)
+		body, err := io.ReadAll(resp.Body)
+		is.NoErr(err)
+		is.Equal(resp.StatusCode, http.StatusUnauthorized)
+		is.True(strings.HasPrefix(string(body), expected.Error()))
+	}
+}
+
+func TestRefreshEndpoint(t *testing.T) {
+	is := is.New(t)
+
+	config := getServerConfig()
+	keys := getKeyRing()
+	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+	refreshTokens := tokens.NewRefreshStore()
+	sessionRegistry := registry.NewSessionRegistry()
+	authServer := httptest.NewServer(addRoutes(store, refreshTokens, sessionRegistry, keys, config))
+	defer authServer.Close()
+
+	gaiaId := uuid.New().String()
+	refreshToken, err := refreshTokens.Issue(gaiaId)
+	is.NoErr(err)
+	sid, err := sessionRegistry.Add(gaiaId)
+	is.NoErr(err)
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%v/account/refresh", authServer.URL), nil)
+	is.NoErr(err)
+	session, err := store.Get(req, "gaia")
+	is.NoErr(err)
+	session.Values["refresh"] = refreshToken
+	session.Values["sid"] = sid
 	recorder := httptest.NewRecorder()
-	err = session.Save(req, recorder)
+	is.NoErr(session.Save(req, recorder))
+	stolen := recorder.Result().Cookies()[0]
+	req.AddCookie(stolen)
+
+	client := authServer.Client()
+	resp, err := client.Do(req)
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusNoContent)
+
+	req, err = http.NewRequest("GET", authServer.URL, nil)
 	is.NoErr(err)
+	req.AddCookie(sessionCookie(resp))
+	session, err = store.Get(req, "gaia")
+	is.NoErr(err)
+	is.True(session.Values["refresh"].(string) != refreshToken)
+	claims, err := tokens.ParseToken(session.Values["token"].(string), keys)
+	is.NoErr(err)
+	is.Equal(claims.Subject, gaiaId)
+
+	// Replaying the old session cookie after the grace period is reuse and revokes the family
+	grace := tokens.RefreshReuseGrace
+	tokens.RefreshReuseGrace = 0
+	defer func() { tokens.RefreshReuseGrace = grace }()
+	req, err = http.NewRequest("POST", fmt.Sprintf("%v/account/refresh", authServer.URL), nil)
+	is.NoErr(err)
+	req.AddCookie(stolen)
+	resp, err = client.Do(req)
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusUnauthorized)
+
+	_, _, err = refreshTokens.Rotate(session.Values["refresh"].(string))
+	is.True(errors.Is(err, tokens.ErrRefreshTokenRevoked))
+}
 
+func TestProxyRenewsToken(t *testing.T) {
+	is := is.New(t)
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello world")
+	}))
+	defer source.Close()
+
+	config := getServerConfig()
+	keys := getKeyRing()
+	config.ORIGIN_SERVER = source.URL
+	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+	refreshTokens := tokens.NewRefreshStore()
+	sessionRegistry := registry.NewSessionRegistry()
+	authServer := httptest.NewServer(addRoutes(store, refreshTokens, sessionRegistry, keys, config))
+	defer authServer.Close()
+
+	gaiaId := uuid.New().String()
+	refreshToken, err := refreshTokens.Issue(gaiaId)
+	is.NoErr(err)
+	sid, err := sessionRegistry.Add(gaiaId)
+	is.NoErr(err)
+
+	// An access token that is about to expire
+	ttl := tokens.AccessTokenTTL
+	tokens.AccessTokenTTL = time.Minute
+	token, err := tokens.NewUserToken(gaiaId, tokens.RoleCustomer, keys)
+	tokens.AccessTokenTTL = ttl
+	is.NoErr(err)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%v/secret/page.html", authServer.URL), nil)
+	is.NoErr(err)
+	session, err := store.Get(req, "gaia")
+	is.NoErr(err)
+	session.Values["token"] = token
+	session.Values["refresh"] = refreshToken
+	session.Values["sid"] = sid
+	recorder := httptest.NewRecorder()
+	is.NoErr(session.Save(req, recorder))
 	req.AddCookie(recorder.Result().Cookies()[0])
 
-	cookie := http.Cookie{
-		Name:     "gaia_n",
-		Value:    u1.Name,
-		MaxAge:   3600,
-		Path:     "/",
-		HttpOnly: false,
-		Secure:   false,
+	resp, err := authServer.Client().Do(req)
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	req, err = http.NewRequest("GET", authServer.URL, nil)
+	is.NoErr(err)
+	req.AddCookie(sessionCookie(resp))
+	session, err = store.Get(req, "gaia")
+	is.NoErr(err)
+	is.True(session.Values["token"].(string) != token)
+	is.Equal(tokens.ExpiresWithin(session.Values["token"].(string), keys, time.Minute), false)
+}
+
+// The requests of a page load renew the same session at once, and the user stays logged in
+func TestProxyRenewsConcurrently(t *testing.T) {
+	is := is.New(t)
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello world")
+	}))
+	defer source.Close()
+
+	config := getServerConfig()
+	config.ORIGIN_SERVER = source.URL
+	config.SESSION_DATABASE = filepath.Join(t.TempDir(), "sessions.db")
+	keys := getKeyRing()
+	store, err := newSessionStore(config)
+	is.NoErr(err)
+	refreshTokens := tokens.NewRefreshStore()
+	sessionRegistry := registry.NewSessionRegistry()
+	const requests = 8
+	page := &pageLoadStore{Store: store, requests: requests}
+	page.loaded.Add(requests)
+	authServer := httptest.NewServer(addRoutes(page, refreshTokens, sessionRegistry, keys, config))
+	defer authServer.Close()
+
+	// A session with an access token that is about to expire
+	ttl := tokens.AccessTokenTTL
+	tokens.AccessTokenTTL = time.Minute
+	cookie := loggedInCookie(t, store, refreshTokens, sessionRegistry, keys, uuid.NewString(), tokens.RoleCustomer, config)
+	tokens.AccessTokenTTL = ttl
+
+	get := func() int {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%v/secret/page.html", authServer.URL), nil)
+		is.NoErr(err)
+		req.AddCookie(cookie)
+		resp, err := authServer.Client().Do(req)
+		is.NoErr(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	statuses := make(chan int, requests)
+	for range requests {
+		go func() { statuses <- get() }()
+	}
+	for range requests {
+		is.Equal(<-statuses, http.StatusOK)
+	}
+
+	// The session survived, and its refresh token was not revoked as reused
+	is.Equal(get(), http.StatusOK)
+	req, err := http.NewRequest("GET", authServer.URL, nil)
+	is.NoErr(err)
+	req.AddCookie(cookie)
+	session, err := store.Get(req, "gaia")
+	is.NoErr(err)
+	_, err = sessionRegistry.Check(session.Values["sid"].(string))
+	is.NoErr(err)
+	_, _, err = refreshTokens.Rotate(session.Values["refresh"].(string))
+	is.NoErr(err)
+}
+
+func TestLoginSurvivesRestart(t *testing.T) {
+	is := is.New(t)
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello world")
+	}))
+	defer source.Close()
+
+	config := getServerConfig()
+	config.ORIGIN_SERVER = source.URL
+	config.SESSION_DATABASE = filepath.Join(t.TempDir(), "sessions.db")
+	keys := getKeyRing()
+	store, err := newSessionStore(config)
+	is.NoErr(err)
+	refreshTokens, sessionRegistry, err := newLoginStores(store)
+	is.NoErr(err)
+
+	gaiaId := uuid.NewString()
+	cookie := loggedInCookie(t, store, refreshTokens, sessionRegistry, keys, gaiaId, tokens.RoleCustomer, config)
+
+	// Without TOKEN_SIGN_KEY_FILE the gateway comes back with a new key, the access token in the session is not signed with it
+	restart := func() *httptest.Server {
+		store, err := newSessionStore(config)
+		is.NoErr(err)
+		refreshTokens, sessionRegistry, err = newLoginStores(store)
+		is.NoErr(err)
+		return httptest.NewServer(addRoutes(store, refreshTokens, sessionRegistry, getKeyRing(), config))
+	}
+	get := func(authServer *httptest.Server) int {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%v/secret/page.html", authServer.URL), nil)
+		is.NoErr(err)
+		req.AddCookie(cookie)
+		resp, err := authServer.Client().Do(req)
+		is.NoErr(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	authServer := restart()
+	is.Equal(get(authServer), http.StatusOK)
+	authServer.Close()
+
+	// A revocation survives it too
+	sessionRegistry.RevokeUser(gaiaId)
+	refreshTokens.RevokeUser(gaiaId)
+	authServer = restart()
+	defer authServer.Close()
+	is.True(get(authServer) != http.StatusOK)
+}
+
+// pageLoadStore holds the first requests until they have all loaded the session, like the requests of a page load
+type pageLoadStore struct {
+	sessions.Store
+	requests int32
+	calls    atomic.Int32
+	loaded   sync.WaitGroup
+}
+
+func (s *pageLoadStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	session, err := s.Store.Get(r, name)
+	if s.calls.Add(1) <= s.requests {
+		s.loaded.Done()
+		s.loaded.Wait()
 	}
+	return session, err
+}
+
+func TestPublishedKeys(t *testing.T) {
+	is := is.New(t)
 
-	req.AddCookie(&cookie)
+	config := getServerConfig()
+	keys := getKeyRing()
+	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+	authServer := httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), registry.NewSessionRegistry(), keys, config))
+	defer authServer.Close()
+
+	resp, err := http.Get(fmt.Sprintf("%v/.well-known/jwks.json", authServer.URL))
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	var set jwks.Set
+	is.NoErr(json.NewDecoder(resp.Body).Decode(&set))
+	is.Equal(len(set.Keys), 1)
+	is.Equal(set.Keys[0].Alg, "ES256")
+
+	token, err := tokens.NewUserToken(uuid.New().String(), tokens.RoleCustomer, keys)
+	is.NoErr(err)
+	_, err = tokens.ParseToken(token, jwks.NewRemoteKeySet(authServer.URL+"/.well-known/jwks.json", nil))
+	is.NoErr(err)
+}
+
+func TestRouteTable(t *testing.T) {
+	is := is.New(t)
+
+	upstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s %s", name, r.Method, r.URL.Path)
+		}))
+	}
+	app := upstream("app")
+	defer app.Close()
+	crm := upstream("crm")
+	defer crm.Close()
+
+	config := getServerConfig()
+	keys := getKeyRing()
+	config.ORIGIN_SERVER = app.URL
+	config.CRM_SERVER = crm.URL
+	config.ROUTES = `{"routes": [
+		{"path": "/crm/users/{id}", "methods": ["PUT"], "upstream": "crm", "strip_prefix": "/crm", "audience": "crm", "scopes": ["crm:write"]},
+		{"path": "/crm/users/{id}", "methods": ["DELETE"], "upstream": "crm", "strip_prefix": "/crm", "roles": ["admin"]},
+		{"path": "/data/", "upstream": "app", "audience": "dmi"},
+		{"path": "/static/", "upstream": "app", "public": true},
+		{"path": "/gaia/", "upstream": "app"}
+	]}`
+	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+	refreshTokens := tokens.NewRefreshStore()
+	sessionRegistry := registry.NewSessionRegistry()
+	authServer := httptest.NewServer(addRoutes(store, refreshTokens, sessionRegistry, keys, config))
+	defer authServer.Close()
+
+	gaiaId := uuid.New().String()
+	cookie := loggedInCookie(t, store, refreshTokens, sessionRegistry, keys, gaiaId, tokens.RoleCustomer, config)
 
 	client := authServer.Client()
-	resp, err := client.Do(req)
+	call := func(method string, path string, cookie *http.Cookie) (int, string) {
+		req, err := http.NewRequest(method, authServer.URL+path, nil)
+		is.NoErr(err)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := client.Do(req)
+		is.NoErr(err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		is.NoErr(err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := call("GET", "/static/gaia.css", nil)
+	is.Equal(status, http.StatusOK)
+	is.Equal(body, "app GET /static/gaia.css")
+
+	status, _ = call("GET", "/gaia/dashboard.html", nil)
+	is.Equal(status, http.StatusUnauthorized)
+
+	status, _ = call("GET", "/unknown", cookie)
+	is.Equal(status, http.StatusNotFound)
+
+	status, body = call("PUT", "/crm/users/"+gaiaId, cookie)
+	is.Equal(status, http.StatusOK)
+	is.Equal(body, "crm PUT /users/"+gaiaId)
+
+	// Logged in, but not an admin and the token is not meant for dmi
+	status, _ = call("DELETE", "/crm/users/"+gaiaId, cookie)
+	is.Equal(status, http.StatusForbidden)
+	status, _ = call("GET", "/data/consumption", cookie)
+	is.Equal(status, http.StatusForbidden)
+}
+
+func TestProxyResponse(t *testing.T) {
+	is := is.New(t)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("X-Origin", "app")
+		http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark"})
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "no such page")
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer origin.Close()
+
+	authServer := newProxyServer(origin.URL, 0)
+	defer authServer.Close()
+
+	resp, err := http.Get(authServer.URL + "/missing.html")
 	is.NoErr(err)
-	c := resp.Cookies()
-	req, err = http.NewRequest("GET", fmt.Sprintf("%v/account/onboarding", authServer.URL), nil)
+	body, err := io.ReadAll(resp.Body)
 	is.NoErr(err)
-	req.AddCookie(c[0])
-	sess, err := store.Get(req, "gaia")
+
+	is.Equal(resp.StatusCode, http.StatusNotFound)
+	is.Equal(string(body), "no such page")
+	is.Equal(resp.Header.Get("X-Origin"), "app")
+	is.Equal(resp.Cookies()[0].Name, "theme")
+	is.Equal(resp.Trailer.Get("X-Checksum"), "abc")
+}
+
+func TestProxyRequestHeaders(t *testing.T) {
+	is := is.New(t)
+
+	var received http.Header
+	var host string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		host = r.Host
+	}))
+	defer origin.Close()
+
+	authServer := newProxyServer(origin.URL, 0)
+	defer authServer.Close()
+
+	req, err := http.NewRequest("GET", authServer.URL+"/index.html", nil)
+	is.NoErr(err)
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "only for the gateway")
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("Accept-Language", "da")
+	resp, err := http.DefaultClient.Do(req)
 	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
 
-	tokenString := sess.Values["token"].(string)
-	token, err := jwt.ParseWithClaims(tokenString, &tokens.UserToken{}, func(token *jwt.Token) (any, error) {
-		return []byte(config.TOKEN_SIGN_KEY), nil
+	originURL, err := url.Parse(origin.URL)
+	is.NoErr(err)
+	authURL, err := url.Parse(authServer.URL)
+	is.NoErr(err)
+
+	is.Equal(host, originURL.Host)
+	is.Equal(received.Get("Accept-Language"), "da")
+	is.Equal(received.Get("X-Hop"), "")
+	is.Equal(received.Get("Proxy-Authorization"), "")
+	// The client cannot claim another address
+	is.Equal(received.Get("X-Forwarded-For"), "127.0.0.1")
+	is.Equal(received.Get("X-Forwarded-Host"), authURL.Host)
+	is.Equal(received.Get("X-Forwarded-Proto"), "http")
+}
+
+func TestProxyEventStream(t *testing.T) {
+	is := is.New(t)
 
-	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	done := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		// The first event must reach the client while the stream is still open
+		<-done
+	}))
+	defer origin.Close()
+	defer close(done)
+
+	authServer := newProxyServer(origin.URL, time.Second)
+	defer authServer.Close()
 
+	resp, err := http.Get(authServer.URL + "/events")
 	is.NoErr(err)
+	defer resp.Body.Close()
 
-	claims, ok := token.Claims.(*tokens.UserToken)
-	is.Equal(ok, true)
-	is.Equal(claims.Audience, jwt.ClaimStrings{"crm", "data", "invoice"})
-	is.Equal(claims.Scope, "crm:write data:read invoice:read")
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	is.NoErr(err)
+	is.Equal(line, "data: first\n")
+}
+
+func TestProxyWebsocket(t *testing.T) {
+	is := is.New(t)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+
+		// echo a line
+		line, _ := rw.ReadString('\n')
+		fmt.Fprint(rw, line)
+		rw.Flush()
+	}))
+	defer origin.Close()
+
+	authServer := newProxyServer(origin.URL, time.Second)
+	defer authServer.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(authServer.URL, "http://"))
+	is.NoErr(err)
+	defer conn.Close()
+
+	fmt.Fprint(conn, "GET /live HTTP/1.1\r\nHost: gaia\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusSwitchingProtocols)
+
+	fmt.Fprint(conn, "ping\n")
+	line, err := reader.ReadString('\n')
+	is.NoErr(err)
+	is.Equal(line, "ping\n")
+}
+
+func TestProxyUpstreamErrors(t *testing.T) {
+	is := is.New(t)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	authServer := newProxyServer(slow.URL, 50*time.Millisecond)
+	defer authServer.Close()
+
+	resp, err := http.Get(authServer.URL + "/")
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusGatewayTimeout)
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	authServer = newProxyServer(down.URL, time.Second)
+	defer authServer.Close()
+
+	resp, err = http.Get(authServer.URL + "/")
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusBadGateway)
+}
+
+func TestProxyIdentity(t *testing.T) {
+	is := is.New(t)
+
+	config := getServerConfig()
+	keys := getKeyRing()
+	verifier := forwarded.NewVerifier(keys, "app")
+
+	var received *http.Request
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		claims, err := verifier.User(r)
+		if err != nil {
+			http.Error(w, err.Error(), tokens.StatusCode(err))
+			return
+		}
+		fmt.Fprint(w, claims.Subject)
+	}))
+	defer origin.Close()
+
+	config.ORIGIN_SERVER = origin.URL
+	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+	refreshTokens := tokens.NewRefreshStore()
+	sessionRegistry := registry.NewSessionRegistry()
+	authServer := httptest.NewServer(addRoutes(store, refreshTokens, sessionRegistry, keys, config))
+	defer authServer.Close()
+
+	gaiaId := uuid.New().String()
+	cookie := loggedInCookie(t, store, refreshTokens, sessionRegistry, keys, gaiaId, tokens.RoleCustomer, config)
+
+	call := func(path string, cookies ...*http.Cookie) (int, string) {
+		req, err := http.NewRequest("GET", authServer.URL+path, nil)
+		is.NoErr(err)
+		req.Header.Set(forwarded.HeaderUser, "forged")
+		req.Header.Set("Authorization", "Bearer forged")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		is.NoErr(err)
+		body, err := io.ReadAll(resp.Body)
+		is.NoErr(err)
+		return resp.StatusCode, string(body)
+	}
+
+	// Public routes get no identity, and the forged one is gone
+	status, _ := call("/index.html")
+	is.Equal(status, http.StatusUnauthorized)
+	is.Equal(received.Header.Get(forwarded.HeaderUser), "")
+	is.Equal(received.Header.Get("Authorization"), "")
+
+	status, body := call("/secret/page.html", cookie, &http.Cookie{Name: "theme", Value: "dark"})
+	is.Equal(status, http.StatusOK)
+	is.Equal(body, gaiaId)
+	is.Equal(received.Header.Get(forwarded.HeaderUser), gaiaId)
+
+	// The session cookie stays at the gateway
+	_, err := received.Cookie("gaia")
+	is.True(errors.Is(err, http.ErrNoCookie))
+	theme, err := received.Cookie("theme")
+	is.NoErr(err)
+	is.Equal(theme.Value, "dark")
+}
+
+// newProxyServer is an auth server with the default route table, where everything but /secret/ is public
+func newProxyServer(origin string, timeout time.Duration) *httptest.Server {
+	config := getServerConfig()
+	config.ORIGIN_SERVER = origin
+	config.PROXY_TIMEOUT = timeout
+	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+	return httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), registry.NewSessionRegistry(), getKeyRing(), config))
+}
+
+func TestLogout(t *testing.T) {
+	is := is.New(t)
+
+	config := getServerConfig()
+	keys := getKeyRing()
+	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+	refreshTokens := tokens.NewRefreshStore()
+	sessionRegistry := registry.NewSessionRegistry()
+	authServer := httptest.NewServer(addRoutes(store, refreshTokens, sessionRegistry, keys, config))
+	defer authServer.Close()
+
+	gaiaId := uuid.New().String()
+	laptop := loggedInCookie(t, store, refreshTokens, sessionRegistry, keys, gaiaId, tokens.RoleCustomer, config)
+	phone := loggedInCookie(t, store, refreshTokens, sessionRegistry, keys, gaiaId, tokens.RoleCustomer, config)
+	tablet := loggedInCookie(t, store, refreshTokens, sessionRegistry, keys, gaiaId, tokens.RoleCustomer, config)
+
+	client := browserClient(authServer)
+	logout := func(cookie *http.Cookie, query string) *http.Response {
+		req, err := http.NewRequest("POST", fmt.Sprintf("%v/account/logout%s", authServer.URL, query), nil)
+		is.NoErr(err)
+		req.AddCookie(cookie)
+		resp, err := client.Do(req)
+		is.NoErr(err)
+		return resp
+	}
+
+	resp := logout(laptop, "")
+	is.Equal(resp.StatusCode, http.StatusFound)
+	is.Equal(resp.Header.Get("Location"), "/")
+	is.True(sessionCookie(resp).MaxAge < 0)
+	is.Equal(len(sessionRegistry.Sessions(gaiaId)), 2)
+
+	// Logging out everywhere from the phone also logs out the tablet
+	resp = logout(phone, "?everywhere=true")
+	is.Equal(resp.StatusCode, http.StatusFound)
+	is.Equal(len(sessionRegistry.Sessions(gaiaId)), 0)
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%v/account/refresh", authServer.URL), nil)
+	is.NoErr(err)
+	req.AddCookie(tablet)
+	resp, err = client.Do(req)
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusUnauthorized)
+}
+
+// Services get tokens with the client credentials grant, and only for their own audience and scopes
+func TestServiceTokenGrant(t *testing.T) {
+	is := is.New(t)
+
+	config := getServerConfig()
+	keys := getKeyRing()
+	config.SERVICE_CLIENTS = `[{"id": "dmi", "secret": "dmisecret", "scopes": ["crm:read", "crm:match"], "audience": ["crm"]}]`
+	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+	authServer := httptest.NewServer(addRoutes(store, tokens.NewRefreshStore(), registry.NewSessionRegistry(), keys, config))
+	defer authServer.Close()
+
+	grant := func(form url.Values, id string, secret string) *http.Response {
+		req, err := http.NewRequest("POST", authServer.URL+"/oauth/token", strings.NewReader(form.Encode()))
+		is.NoErr(err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if id != "" {
+			req.SetBasicAuth(id, secret)
+		}
+		resp, err := authServer.Client().Do(req)
+		is.NoErr(err)
+		return resp
+	}
+	oauthError := func(resp *http.Response) string {
+		var body map[string]string
+		json.NewDecoder(resp.Body).Decode(&body)
+		return body["error"]
+	}
+
+	resp := grant(url.Values{"grant_type": {"client_credentials"}, "scope": {"crm:match"}}, "dmi", "dmisecret")
+	is.Equal(resp.StatusCode, http.StatusOK)
+	var body struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	is.NoErr(json.NewDecoder(resp.Body).Decode(&body))
+	is.Equal(body.TokenType, "Bearer")
+	is.Equal(body.ExpiresIn, int(tokens.AccessTokenTTL.Seconds()))
+
+	claims, err := tokens.NewValidator(keys).Check(body.AccessToken, "crm", "crm:match")
+	is.NoErr(err)
+	is.Equal(claims.Subject, "service:dmi")
+	is.True(!claims.HasScope("crm:read"))
+
+	// The form works as well as Basic
+	resp = grant(url.Values{"grant_type": {"client_credentials"}, "client_id": {"dmi"}, "client_secret": {"dmisecret"}}, "", "")
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	resp = grant(url.Values{"grant_type": {"client_credentials"}}, "dmi", "wrong")
+	is.Equal(resp.StatusCode, http.StatusUnauthorized)
+	is.Equal(oauthError(resp), "invalid_client")
+
+	resp = grant(url.Values{"grant_type": {"client_credentials"}, "scope": {"crm:delete"}}, "dmi", "dmisecret")
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+	is.Equal(oauthError(resp), "invalid_scope")
+
+	resp = grant(url.Values{"grant_type": {"password"}}, "dmi", "dmisecret")
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+	is.Equal(oauthError(resp), "unsupported_grant_type")
+}
+
+func TestRevokeSessions(t *testing.T) {
+	is := is.New(t)
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello world")
+	}))
+	defer source.Close()
+
+	config := getServerConfig()
+	keys := getKeyRing()
+	config.ORIGIN_SERVER = source.URL
+	store := sessions.NewCookieStore([]byte(config.SESSION_KEY))
+	refreshTokens := tokens.NewRefreshStore()
+	sessionRegistry := registry.NewSessionRegistry()
+	authServer := httptest.NewServer(addRoutes(store, refreshTokens, sessionRegistry, keys, config))
+	defer authServer.Close()
+
+	gaiaId := uuid.New().String()
+	cookie := loggedInCookie(t, store, refreshTokens, sessionRegistry, keys, gaiaId, tokens.RoleCustomer, config)
+
+	client := authServer.Client()
+	secret := func() *http.Response {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%v/secret/page.html", authServer.URL), nil)
+		is.NoErr(err)
+		req.AddCookie(cookie)
+		resp, err := client.Do(req)
+		is.NoErr(err)
+		return resp
+	}
+	revoke := func(bearer string) *http.Response {
+		req, err := http.NewRequest("DELETE", fmt.Sprintf("%v/account/sessions/%s", authServer.URL, gaiaId), nil)
+		is.NoErr(err)
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		resp, err := client.Do(req)
+		is.NoErr(err)
+		return resp
+	}
+
+	is.Equal(secret().StatusCode, http.StatusOK)
+
+	is.Equal(revoke("").StatusCode, http.StatusUnauthorized)
+
+	// A customer cannot log other customers out
+	userToken, err := tokens.NewUserToken(uuid.New().String(), tokens.RoleCustomer, keys)
+	is.NoErr(err)
+	is.Equal(revoke(userToken).StatusCode, http.StatusForbidden)
+
+	otherService, err := tokens.NewServiceToken("dmi", []string{"auth"}, "data:read", keys)
+	is.NoErr(err)
+	is.Equal(revoke(otherService).StatusCode, http.StatusForbidden)
+
+	// A token from another issuer is not trusted, whatever its scope
+	otherKeys := getKeyRing()
+	forged, err := tokens.NewServiceToken("crm", []string{"auth"}, "sessions:revoke", otherKeys)
+	is.NoErr(err)
+	is.Equal(revoke(forged).StatusCode, http.StatusUnauthorized)
+
+	serviceToken, err := tokens.NewServiceToken("crm", []string{"auth"}, "sessions:revoke", keys)
+	is.NoErr(err)
+	resp := revoke(serviceToken)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	var revoked map[string]int
+	json.NewDecoder(resp.Body).Decode(&revoked)
+	is.Equal(revoked["revoked"], 1)
+
+	// The access token in the cookie has not expired, but the session is gone
+	is.Equal(secret().StatusCode, http.StatusUnauthorized)
+}
+
+// loggedInCookie starts a user session like a completed login does and returns the session cookie
+func loggedInCookie(t *testing.T, store sessions.Store, refreshTokens *tokens.RefreshStore, sessionRegistry *registry.SessionRegistry, keys *tokens.KeyRing, gaiaId string, role string, config Config) *http.Cookie {
+	is := is.New(t)
+
+	req, err := http.NewRequest("GET", "/", nil)
+	is.NoErr(err)
+	session, err := store.Get(req, "gaia")
+	is.NoErr(err)
+
+	recorder := httptest.NewRecorder()
+	is.NoErr(startUserSession(recorder, req, session, refreshTokens, sessionRegistry, keys, gaiaId, role, "mitid", config))
+	return sessionCookie(recorder.Result())
+}
+
+// browserClient keeps cookies like a browser, but lets the test follow redirects
+func browserClient(ts *httptest.Server) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		panic(err)
+	}
+	client := ts.Client()
+	client.Jar = jar
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return client
+}
+
+// mitidLogin goes through the broker and returns the response from /account/authenticate
+func mitidLogin(t *testing.T, client *http.Client, authServer *httptest.Server, mitid string) *http.Response {
+	is := is.New(t)
+
+	resp, err := client.Get(fmt.Sprintf("%v/account/login?mitid=%s", authServer.URL, mitid))
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusFound)
+
+	resp, err = client.Get(resp.Header.Get("Location"))
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusFound)
+
+	// The broker sends the user to the registered redirect uri, we send them to the test server
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	is.NoErr(err)
+	resp, err = client.Get(fmt.Sprintf("%v%s?%s", authServer.URL, callback.Path, callback.RawQuery))
+	is.NoErr(err)
+	return resp
+}
+
+// sessionCookie returns the last gaia cookie set, handlers may save the session more than once
+func sessionCookie(resp *http.Response) *http.Cookie {
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == "gaia" {
+			cookie = c
+		}
+	}
+	return cookie
+}
+
+// newDiscoveryStub serves an openid configuration and nothing else
+func newDiscoveryStub() *httptest.Server {
+	var stub *httptest.Server
+	stub = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"issuer":"%[1]s","authorization_endpoint":"%[1]s/connect/authorize","token_endpoint":"%[1]s/connect/token","userinfo_endpoint":"%[1]s/connect/userinfo","jwks_uri":"%[1]s/.well-known/jwks"}`, stub.URL)
+	}))
+	return stub
 }
 
 func getServerConfig() Config {
@@ -291,14 +1609,26 @@ func getServerConfig() Config {
 		MITID_CLIENT_ID:     "0a775a87-878c-4b83-abe3-ee29c720c3e7",
 		MITID_CLIENT_SECRET: "rnlguc7CM/wmGSti4KCgCkWBQnfslYr0lMDZeIFsCJweROTROy2ajEigEaPQFl76Py6AVWnhYofl/0oiSAgdtg==", //from Signaturgruppen pp env
 		ENVIRONMENT:         "dev",
-		TOKEN_SIGN_KEY:      "secrettokenkey",
 		SESSION_KEY:         "secretsessionkey",
 	}
 }
 
-func cleanup() {
-	err := os.Remove(testdb)
+// newCRMServer runs CRM trusting tokens signed with keys, like it trusts the auth server
+func newCRMServer(db database.UserStore, keys *tokens.KeyRing) (*httptest.Server, func()) {
+	published := httptest.NewServer(publishKeys(keys))
+	addresses := fixture.NewServer()
+	crm := httptest.NewServer(server.NewServer(db, server.Config{AUTH_SERVER: published.URL, DAR_SERVER: addresses.URL}))
+	return crm, func() {
+		crm.Close()
+		addresses.Close()
+		published.Close()
+	}
+}
+
+func getKeyRing() *tokens.KeyRing {
+	keys, err := tokens.NewKeyRing("ES256")
 	if err != nil {
 		panic(err)
 	}
+	return keys
 }
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/henrikkorsgaard/gaia/auth/identity"
+	"github.com/henrikkorsgaard/gaia/auth/registry"
+	"github.com/henrikkorsgaard/gaia/auth/tokens"
+)
+
+var (
+	ErrRevokeMissingToken = errors.New("error: revoking sessions requires a service token")
+	ErrRevokeScope        = errors.New("error: token is not allowed to revoke sessions")
+)
+
+// TODO: Handle in config
+const postLogoutRedirectURI = "http://localhost:3020/"
+
+/*
+refresh renews the access token in the session with the refresh token.
+The proxy does the same when the access token is about to expire, this
+endpoint is for clients that want to do it up front.
+*/
+func refresh(store sessions.Store, refreshTokens *tokens.RefreshStore, sessionRegistry *registry.SessionRegistry, keys *tokens.KeyRing, config Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+
+		session, err := store.Get(r, "gaia")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = renewUserSession(w, r, session, refreshTokens, sessionRegistry, keys, config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+/*
+logout ends the session in the browser and on the server. With
+?everywhere=true every session of the user is revoked, e.g. the phone
+they lost. If END_PROVIDER_SESSION is set the user is sent on to the
+identity provider to end the session there too.
+*/
+func logout(store sessions.Store, refreshTokens *tokens.RefreshStore, sessionRegistry *registry.SessionRegistry, providers identity.Providers, config Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+
+		session, err := store.Get(r, "gaia")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sid, _ := session.Values["sid"].(string)
+		refreshToken, _ := session.Values["refresh"].(string)
+		providerName, _ := session.Values["provider"].(string)
+
+		if r.URL.Query().Get("everywhere") == "true" {
+			if s, err := sessionRegistry.Check(sid); err == nil {
+				revokeUser(refreshTokens, sessionRegistry, s.GaiaId)
+			}
+		} else {
+			sessionRegistry.Revoke(sid)
+			refreshTokens.Revoke(refreshToken)
+		}
+
+		err = endBrowserSession(w, r, session)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		redirect := "/"
+		if config.END_PROVIDER_SESSION {
+			if provider, err := providers.Get(providerName); err == nil {
+				if ender, ok := provider.(identity.SessionEnder); ok {
+					endSession, err := ender.EndSessionURL(postLogoutRedirectURI)
+					if err == nil && endSession != "" {
+						redirect = endSession
+					}
+				}
+			}
+		}
+
+		http.Redirect(w, r, redirect, http.StatusFound)
+	})
+}
+
+/*
+revokeSessions logs a user out everywhere. It is called by other Gaia
+services, e.g. CRM when a customer is deleted, with a service token
+from /oauth/token for the auth audience with the sessions:revoke scope.
+*/
+func revokeSessions(refreshTokens *tokens.RefreshStore, sessionRegistry *registry.SessionRegistry, keys *tokens.KeyRing) http.Handler {
+	validator := tokens.NewValidator(keys)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+
+		bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if bearer == "" {
+			http.Error(w, ErrRevokeMissingToken.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := validator.Check(bearer, "auth", "sessions:revoke")
+		if errors.Is(err, tokens.ErrTokenAudience) || errors.Is(err, tokens.ErrTokenScope) || (err == nil && !claims.HasRole(tokens.RoleService)) {
+			http.Error(w, ErrRevokeScope.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		revoked := revokeUser(refreshTokens, sessionRegistry, r.PathValue("gaiaId"))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]int{"revoked": revoked})
+	})
+}
+
+/*
+startUserSession registers a new session and puts a new access token and
+a new refresh token family in it. The role is kept in the session for
+renewals, CRM revokes the sessions of a user whose role changes.
+*/
+func startUserSession(w http.ResponseWriter, r *http.Request, session *sessions.Session, refreshTokens *tokens.RefreshStore, sessionRegistry *registry.SessionRegistry, keys *tokens.KeyRing, gaiaId string, role string, provider string, config Config) error {
+	sid, err := sessionRegistry.Add(gaiaId)
+	if err != nil {
+		return err
+	}
+
+	token, err := tokens.NewUserToken(gaiaId, role, keys)
+	if err != nil {
+		return err
+	}
+
+	refreshToken, err := refreshTokens.Issue(gaiaId)
+	if err != nil {
+		return err
+	}
+
+	err = renewSessionId(w, r, session)
+	if err != nil {
+		return err
+	}
+
+	session.Values["sid"] = sid
+	session.Values["role"] = role
+	session.Values["provider"] = provider
+	session.Values["token"] = token
+	session.Values["refresh"] = refreshToken
+	return session.Save(r, w)
+}
+
+/*
+renewSessionId deletes the stored session and gives it a new id when it
+is saved again. It is called when the user is authenticated, so a
+session id planted in the browser before login is never logged in.
+*/
+func renewSessionId(w http.ResponseWriter, r *http.Request, session *sessions.Session) error {
+	options := *session.Options
+	session.Options.MaxAge = -1
+	err := session.Save(r, w)
+	session.Options = &options
+	session.ID = ""
+	return err
+}
+
+// renewUserSession rotates the refresh token in the session and issues a new access token
+func renewUserSession(w http.ResponseWriter, r *http.Request, session *sessions.Session, refreshTokens *tokens.RefreshStore, sessionRegistry *registry.SessionRegistry, keys *tokens.KeyRing, config Config) error {
+	refreshToken, _ := session.Values["refresh"].(string)
+	sid, _ := session.Values["sid"].(string)
+	if session.IsNew || refreshToken == "" {
+		return ErrInvalidSession
+	}
+
+	_, err := sessionRegistry.Check(sid)
+	if err != nil {
+		endBrowserSession(w, r, session)
+		return err
+	}
+
+	gaiaId, next, err := refreshTokens.Rotate(refreshToken)
+	if err != nil {
+		// The refresh token is no good, so neither is the session
+		endBrowserSession(w, r, session)
+		return err
+	}
+
+	role, _ := session.Values["role"].(string)
+	token, err := tokens.NewUserToken(gaiaId, role, keys)
+	if err != nil {
+		return err
+	}
+
+	session.Values["token"] = token
+	session.Values["refresh"] = next
+	return session.Save(r, w)
+}
+
+// revokeUser revokes every session and refresh token of the user, and returns the number of sessions revoked
+func revokeUser(refreshTokens *tokens.RefreshStore, sessionRegistry *registry.SessionRegistry, gaiaId string) int {
+	refreshTokens.RevokeUser(gaiaId)
+	return sessionRegistry.RevokeUser(gaiaId)
+}
+
+// endBrowserSession deletes the gaia session in the browser
+func endBrowserSession(w http.ResponseWriter, r *http.Request, session *sessions.Session) error {
+	for k := range session.Values {
+		delete(session.Values, k)
+	}
+	session.Options.MaxAge = -1
+
+	return session.Save(r, w)
+}
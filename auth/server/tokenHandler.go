@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/henrikkorsgaard/gaia/auth/clients"
+	"github.com/henrikkorsgaard/gaia/auth/tokens"
+)
+
+/*
+issueServiceToken is the OAuth 2.0 client credentials grant (RFC 6749
+section 4.4). Services registered in SERVICE_CLIENTS authenticate with
+HTTP Basic or client_id and client_secret in the form, and get a token
+for their audience with the scope they ask for.
+*/
+func issueServiceToken(serviceClients *clients.Registry, keys *tokens.KeyRing) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			oauthError(w, "invalid_request", http.StatusBadRequest)
+			return
+		}
+
+		if r.PostForm.Get("grant_type") != "client_credentials" {
+			oauthError(w, "unsupported_grant_type", http.StatusBadRequest)
+			return
+		}
+
+		id, secret, ok := r.BasicAuth()
+		if ok {
+			// Basic credentials are form encoded, RFC 6749 section 2.3.1
+			id, _ = url.QueryUnescape(id)
+			secret, _ = url.QueryUnescape(secret)
+		} else {
+			id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+		}
+
+		client, err := serviceClients.Authenticate(id, secret)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gaia"`)
+			oauthError(w, "invalid_client", http.StatusUnauthorized)
+			return
+		}
+
+		scope, err := client.Grant(r.PostForm.Get("scope"))
+		if err != nil {
+			oauthError(w, "invalid_scope", http.StatusBadRequest)
+			return
+		}
+
+		token, err := tokens.NewServiceToken(client.ID, client.Audience, scope, keys)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": token,
+			"token_type":   "Bearer",
+			"expires_in":   int(tokens.AccessTokenTTL.Seconds()),
+			"scope":        scope,
+		})
+	})
+}
+
+func oauthError(w http.ResponseWriter, code string, status int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
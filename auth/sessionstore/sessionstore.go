@@ -0,0 +1,317 @@
+/*
+Package sessionstore keeps the gateway's browser sessions on the server.
+
+SQLiteStore implements sessions.Store from gorilla/sessions, so handlers
+use it like the cookie store. The cookie only carries an opaque session
+id, and the values are encrypted in the database, so neither the
+browser nor a copy of the database reveals the identity or the tokens.
+*/
+package sessionstore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var (
+	ErrSessionStore   = errors.New("error: session store failed")
+	ErrSessionDecrypt = errors.New("error: session data could not be decrypted")
+)
+
+// Used when a store is created without timeouts
+var (
+	DefaultIdleTimeout     = 2 * time.Hour
+	DefaultAbsoluteTimeout = 24 * time.Hour
+)
+
+// Reading a session moves the idle timeout at most this often, so every proxied request is not a write
+var touchInterval = time.Minute
+
+// record is a session row. The id is a hash of the cookie value, and data is encrypted.
+type record struct {
+	Id       string `gorm:"primaryKey"`
+	Data     []byte
+	Created  time.Time
+	Expires  time.Time `gorm:"index"` // moved by activity, the idle timeout
+	Deadline time.Time `gorm:"index"` // fixed at creation, the absolute timeout
+}
+
+func (record) TableName() string {
+	return "sessions"
+}
+
+type SQLiteStore struct {
+	// Options for new sessions and the cookie. MaxAge defaults to the absolute timeout.
+	Options *sessions.Options
+
+	db       *gorm.DB
+	aead     cipher.AEAD
+	idle     time.Duration
+	absolute time.Duration
+}
+
+/*
+NewSQLiteStore opens or creates the session database at path, or an
+in-memory database if path is empty. Values are encrypted with a key
+derived from secret. Sessions end after idle without use, and after
+absolute whatever happens.
+*/
+func NewSQLiteStore(path string, secret []byte, idle time.Duration, absolute time.Duration) (*SQLiteStore, error) {
+	if idle <= 0 {
+		idle = DefaultIdleTimeout
+	}
+	if absolute <= 0 {
+		absolute = DefaultAbsoluteTimeout
+	}
+	if path == "" {
+		path = ":memory:"
+	}
+
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Default.LogMode(logger.Warn)})
+	if err != nil {
+		return nil, errors.Join(ErrSessionStore, err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, errors.Join(ErrSessionStore, err)
+	}
+	// SQLite writes one at a time anyway, and an in-memory database only exists on its connection
+	sqlDB.SetMaxOpenConns(1)
+
+	err = db.AutoMigrate(&record{})
+	if err != nil {
+		return nil, errors.Join(ErrSessionStore, err)
+	}
+
+	key, err := hkdf.Key(sha256.New, secret, nil, "gaia session store", 32)
+	if err != nil {
+		return nil, errors.Join(ErrSessionStore, err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Join(ErrSessionStore, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Join(ErrSessionStore, err)
+	}
+
+	return &SQLiteStore{
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   int(absolute.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+		db:       db,
+		aead:     aead,
+		idle:     idle,
+		absolute: absolute,
+	}, nil
+}
+
+// DB is the session database, for state that has to live as long as the sessions, e.g. the session registry
+func (s *SQLiteStore) DB() *gorm.DB {
+	return s.db
+}
+
+// Get returns the session for name, cached for the request like the other gorilla stores.
+func (s *SQLiteStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+/*
+New returns the stored session of the request, or a new session. An
+unknown, expired or undecryptable session id is not an error, the user
+simply gets a new session.
+*/
+func (s *SQLiteStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil || cookie.Value == "" {
+		return session, nil
+	}
+
+	var rec record
+	result := s.db.Limit(1).Find(&rec, "id = ?", hashId(cookie.Value))
+	if result.Error != nil {
+		return session, errors.Join(ErrSessionStore, result.Error)
+	}
+	now := time.Now()
+	if result.RowsAffected == 0 || now.After(rec.Expires) || now.After(rec.Deadline) {
+		return session, nil
+	}
+
+	values, err := s.decrypt(rec.Data, rec.Id)
+	if err != nil {
+		log.Printf("dropping session: %v", err)
+		return session, nil
+	}
+
+	session.ID = cookie.Value
+	session.Values = values
+	session.IsNew = false
+
+	if rec.Expires.Sub(now) < s.idle-touchInterval {
+		err = s.db.Model(&rec).Update("expires", s.expires(now, rec.Deadline)).Error
+		if err != nil {
+			return session, errors.Join(ErrSessionStore, err)
+		}
+	}
+	return session, nil
+}
+
+// Save stores the values and sets the session id cookie. A negative MaxAge deletes the session.
+func (s *SQLiteStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			err := s.db.Delete(&record{}, "id = ?", hashId(session.ID)).Error
+			if err != nil {
+				return errors.Join(ErrSessionStore, err)
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	now := time.Now()
+	var rec record
+	if session.ID != "" {
+		result := s.db.Limit(1).Find(&rec, "id = ?", hashId(session.ID))
+		if result.Error != nil {
+			return errors.Join(ErrSessionStore, result.Error)
+		}
+		// The session expired or was swept while the request was handled
+		if result.RowsAffected == 0 {
+			session.ID = ""
+		}
+	}
+	if session.ID == "" {
+		id, err := newId()
+		if err != nil {
+			return errors.Join(ErrSessionStore, err)
+		}
+		session.ID = id
+		rec = record{Id: hashId(id), Created: now, Deadline: now.Add(s.absolute)}
+	}
+
+	data, err := s.encrypt(session.Values, rec.Id)
+	if err != nil {
+		return err
+	}
+	rec.Data = data
+	rec.Expires = s.expires(now, rec.Deadline)
+
+	err = s.db.Save(&rec).Error
+	if err != nil {
+		return errors.Join(ErrSessionStore, err)
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), session.ID, session.Options))
+	return nil
+}
+
+// Sweep deletes expired sessions and returns how many.
+func (s *SQLiteStore) Sweep() (int64, error) {
+	now := time.Now()
+	result := s.db.Delete(&record{}, "expires < ? OR deadline < ?", now, now)
+	if result.Error != nil {
+		return 0, errors.Join(ErrSessionStore, result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
+// SweepEvery sweeps every interval until stop is closed.
+func (s *SQLiteStore) SweepEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_, err := s.Sweep()
+			if err != nil {
+				log.Printf("unable to sweep sessions: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *SQLiteStore) expires(now time.Time, deadline time.Time) time.Time {
+	expires := now.Add(s.idle)
+	if expires.After(deadline) {
+		return deadline
+	}
+	return expires
+}
+
+// encrypt seals the gob encoded values. The row id is authenticated with them, so rows cannot be swapped.
+func (s *SQLiteStore) encrypt(values map[any]any, id string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(values)
+	if err != nil {
+		return nil, errors.Join(ErrSessionStore, err)
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, errors.Join(ErrSessionStore, err)
+	}
+	return s.aead.Seal(nonce, nonce, buf.Bytes(), []byte(id)), nil
+}
+
+func (s *SQLiteStore) decrypt(data []byte, id string) (map[any]any, error) {
+	if len(data) < s.aead.NonceSize() {
+		return nil, ErrSessionDecrypt
+	}
+	nonce, sealed := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, sealed, []byte(id))
+	if err != nil {
+		return nil, errors.Join(ErrSessionDecrypt, err)
+	}
+
+	values := map[any]any{}
+	err = gob.NewDecoder(bytes.NewReader(plain)).Decode(&values)
+	if err != nil {
+		return nil, errors.Join(ErrSessionDecrypt, err)
+	}
+	return values, nil
+}
+
+func newId() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashId is the row id of a cookie value, so the database does not hold usable session ids
+func hashId(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,129 @@
+package sessionstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// roundTrip saves values in a new session and returns the cookie the browser gets
+func roundTrip(is *is.I, store *SQLiteStore, values map[any]any) *http.Cookie {
+	req := httptest.NewRequest("GET", "/", nil)
+	session, err := store.Get(req, "gaia")
+	is.NoErr(err)
+	is.True(session.IsNew)
+	for k, v := range values {
+		session.Values[k] = v
+	}
+
+	recorder := httptest.NewRecorder()
+	is.NoErr(session.Save(req, recorder))
+	return recorder.Result().Cookies()[0]
+}
+
+func load(is *is.I, store *SQLiteStore, cookie *http.Cookie) map[any]any {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	session, err := store.Get(req, "gaia")
+	is.NoErr(err)
+	if session.IsNew {
+		return nil
+	}
+	return session.Values
+}
+
+func TestOpaqueCookie(t *testing.T) {
+	is := is.New(t)
+
+	store, err := NewSQLiteStore("", []byte("secret"), time.Hour, 24*time.Hour)
+	is.NoErr(err)
+
+	cookie := roundTrip(is, store, map[any]any{"token": "eyJhbGciOi.secret.token"})
+	is.True(!strings.Contains(cookie.Value, "eyJ"))
+	is.True(cookie.HttpOnly)
+	is.Equal(cookie.SameSite, http.SameSiteLaxMode)
+	is.Equal(cookie.MaxAge, int((24 * time.Hour).Seconds()))
+
+	is.Equal(load(is, store, cookie)["token"], "eyJhbGciOi.secret.token")
+
+	// The database has neither the session id nor the values in the clear
+	var rec record
+	is.NoErr(store.db.First(&rec).Error)
+	is.True(rec.Id != cookie.Value)
+	is.True(!strings.Contains(string(rec.Data), "eyJ"))
+
+	// Another key cannot read the values, the user just gets a new session
+	other, err := NewSQLiteStore("", []byte("other"), time.Hour, 24*time.Hour)
+	is.NoErr(err)
+	other.db = store.db
+	is.Equal(load(is, other, cookie), nil)
+
+	forged := *cookie
+	forged.Value = "forged"
+	is.Equal(load(is, store, &forged), nil)
+}
+
+func TestTimeouts(t *testing.T) {
+	is := is.New(t)
+
+	store, err := NewSQLiteStore("", []byte("secret"), time.Hour, 24*time.Hour)
+	is.NoErr(err)
+	cookie := roundTrip(is, store, map[any]any{"sid": "1"})
+
+	// Idle for too long
+	is.NoErr(store.db.Model(&record{}).Where("1 = 1").Update("expires", time.Now().Add(-time.Second)).Error)
+	is.Equal(load(is, store, cookie), nil)
+
+	// Active, but past the absolute timeout
+	cookie = roundTrip(is, store, map[any]any{"sid": "2"})
+	is.NoErr(store.db.Model(&record{}).Where("1 = 1").Update("deadline", time.Now().Add(-time.Second)).Error)
+	is.Equal(load(is, store, cookie), nil)
+
+	swept, err := store.Sweep()
+	is.NoErr(err)
+	is.Equal(swept, int64(2))
+}
+
+func TestIdleTimeoutMoves(t *testing.T) {
+	is := is.New(t)
+
+	store, err := NewSQLiteStore("", []byte("secret"), time.Hour, 24*time.Hour)
+	is.NoErr(err)
+	cookie := roundTrip(is, store, map[any]any{"sid": "1"})
+
+	soon := time.Now().Add(time.Minute)
+	is.NoErr(store.db.Model(&record{}).Where("1 = 1").Update("expires", soon).Error)
+
+	is.Equal(load(is, store, cookie)["sid"], "1")
+
+	var rec record
+	is.NoErr(store.db.First(&rec).Error)
+	is.True(rec.Expires.After(soon.Add(time.Minute)))
+	is.True(!rec.Expires.After(rec.Deadline))
+}
+
+func TestDelete(t *testing.T) {
+	is := is.New(t)
+
+	store, err := NewSQLiteStore("", []byte("secret"), time.Hour, 24*time.Hour)
+	is.NoErr(err)
+	cookie := roundTrip(is, store, map[any]any{"sid": "1"})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	session, err := store.Get(req, "gaia")
+	is.NoErr(err)
+	session.Options.MaxAge = -1
+	recorder := httptest.NewRecorder()
+	is.NoErr(session.Save(req, recorder))
+	is.Equal(recorder.Result().Cookies()[0].MaxAge, -1)
+
+	var count int64
+	is.NoErr(store.db.Model(&record{}).Count(&count).Error)
+	is.Equal(count, int64(0))
+	is.Equal(load(is, store, cookie), nil)
+}
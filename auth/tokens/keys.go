@@ -0,0 +1,287 @@
+package tokens
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/henrikkorsgaard/gaia/auth/jwks"
+)
+
+var (
+	ErrKeyUnsupportedAlg = errors.New("error: unsupported token signing algorithm")
+	ErrKeyUnsupported    = errors.New("error: unsupported token signing key")
+	ErrKeyUnknown        = errors.New("error: no token signing key matches kid")
+	ErrKeyMissingKid     = errors.New("error: token has no kid header")
+	ErrKeyFile           = errors.New("error: unable to read token signing keys")
+)
+
+// Algorithms we sign and accept Gaia tokens with. All of them can be verified with only the public key.
+var signingAlgs = []string{
+	jwt.SigningMethodRS256.Alg(),
+	jwt.SigningMethodES256.Alg(),
+	jwt.SigningMethodEdDSA.Alg(),
+}
+
+/*
+A retired key is still published and accepted for this long after a
+rotation, so tokens signed just before the rotation stay valid until
+they expire, and backends have time to fetch the new key.
+*/
+var RotationOverlap = AccessTokenTTL + time.Minute
+
+/*
+KeySet finds the public key a token was signed with by its kid header.
+It is implemented by KeyRing in the auth server, and by
+jwks.RemoteKeySet for backends that only know the public keys.
+*/
+type KeySet interface {
+	Key(kid string) (crypto.PublicKey, error)
+}
+
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	retired time.Time // zero for the current key
+}
+
+/*
+KeyRing holds the private keys of the auth server. The newest key signs
+tokens, retired keys are only kept to verify tokens until the overlap
+has passed.
+*/
+type KeyRing struct {
+	mu   sync.Mutex
+	alg  string
+	keys []*signingKey // oldest first, the last key is the current one
+}
+
+/*
+NewKeyRing returns a key ring signing with a freshly generated key for
+alg (RS256, ES256 or EdDSA, ES256 if empty). Keys only live in memory,
+so tokens do not survive a restart. Use LoadKeyRing to share keys
+between restarts and instances.
+*/
+func NewKeyRing(alg string) (*KeyRing, error) {
+	if alg == "" {
+		alg = jwt.SigningMethodES256.Alg()
+	}
+	ring := &KeyRing{alg: alg}
+	err := ring.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+/*
+LoadKeyRing reads PKCS #8 PEM encoded private keys from path. The last
+key in the file signs, earlier keys are treated as retired now and are
+accepted for the overlap. Rotating is then a matter of appending a new
+key to the file and restarting.
+*/
+func LoadKeyRing(path string) (*KeyRing, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Join(ErrKeyFile, err)
+	}
+
+	ring := &KeyRing{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Join(ErrKeyFile, err)
+		}
+
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return nil, ErrKeyUnsupported
+		}
+
+		key, err := newSigningKey(signer)
+		if err != nil {
+			return nil, err
+		}
+		ring.add(key)
+	}
+
+	if len(ring.keys) == 0 {
+		return nil, errors.Join(ErrKeyFile, fmt.Errorf("no PEM encoded keys in %s", path))
+	}
+	ring.alg = ring.current().method.Alg()
+
+	return ring, nil
+}
+
+// Rotate generates a new signing key. The previous key is retired, but still accepted for RotationOverlap.
+func (k *KeyRing) Rotate() error {
+	private, err := generateKey(k.alg)
+	if err != nil {
+		return err
+	}
+
+	key, err := newSigningKey(private)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.add(key)
+	return nil
+}
+
+// RotateEvery rotates the signing key every d until stop is closed.
+func (k *KeyRing) RotateEvery(d time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			k.Rotate()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Sign signs the claims with the current key and sets the kid header.
+func (k *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	k.mu.Lock()
+	key := k.current()
+	k.mu.Unlock()
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// Key returns the public key for kid, as long as the key is current or within its overlap.
+func (k *KeyRing) Key(kid string) (crypto.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.sweep()
+	for _, key := range k.keys {
+		if key.kid == kid {
+			return key.private.Public(), nil
+		}
+	}
+	return nil, ErrKeyUnknown
+}
+
+// JWKS returns the public keys for /.well-known/jwks.json, the current key first.
+func (k *KeyRing) JWKS() (jwks.Set, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.sweep()
+	set := jwks.Set{Keys: []jwks.Key{}}
+	for _, key := range slices.Backward(k.keys) {
+		jwk, err := jwks.NewKey(key.kid, key.private.Public())
+		if err != nil {
+			return set, err
+		}
+		jwk.Alg = key.method.Alg()
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
+
+// add makes key the current key and retires the others. The caller must hold k.mu, or own k.
+func (k *KeyRing) add(key *signingKey) {
+	now := time.Now()
+	for _, old := range k.keys {
+		if old.retired.IsZero() {
+			old.retired = now
+		}
+	}
+	k.keys = append(k.keys, key)
+}
+
+func (k *KeyRing) current() *signingKey {
+	return k.keys[len(k.keys)-1]
+}
+
+// sweep drops retired keys past their overlap. The caller must hold k.mu.
+func (k *KeyRing) sweep() {
+	k.keys = slices.DeleteFunc(k.keys, func(key *signingKey) bool {
+		return !key.retired.IsZero() && time.Since(key.retired) > RotationOverlap
+	})
+}
+
+func generateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case jwt.SigningMethodRS256.Alg():
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.SigningMethodES256.Alg():
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwt.SigningMethodEdDSA.Alg():
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	}
+	return nil, ErrKeyUnsupportedAlg
+}
+
+// newSigningKey picks the signing method from the key type. The kid is derived from the public key, so it is stable across restarts.
+func newSigningKey(private crypto.Signer) (*signingKey, error) {
+	var method jwt.SigningMethod
+	switch pub := private.Public().(type) {
+	case *rsa.PublicKey:
+		method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, ErrKeyUnsupported
+		}
+		method = jwt.SigningMethodES256
+	case ed25519.PublicKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, ErrKeyUnsupported
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		return nil, errors.Join(ErrKeyUnsupported, err)
+	}
+	sum := sha256.Sum256(der)
+
+	return &signingKey{
+		kid:     base64.RawURLEncoding.EncodeToString(sum[:12]),
+		method:  method,
+		private: private,
+	}, nil
+}
+
+// keyFunc looks up the verification key for a token by its kid header.
+func keyFunc(keys KeySet) jwt.Keyfunc {
+	return func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			return nil, ErrKeyMissingKid
+		}
+		return keys.Key(kid)
+	}
+}
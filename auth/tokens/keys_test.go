@@ -0,0 +1,177 @@
+package tokens
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/henrikkorsgaard/gaia/auth/jwks"
+	"github.com/matryer/is"
+)
+
+func TestSigningAlgorithms(t *testing.T) {
+	for _, alg := range []string{"RS256", "ES256", "EdDSA"} {
+		t.Run(alg, func(t *testing.T) {
+			is := is.New(t)
+
+			keys, err := NewKeyRing(alg)
+			is.NoErr(err)
+
+			userId := uuid.NewString()
+			token, err := NewUserToken(userId, RoleCustomer, keys)
+			is.NoErr(err)
+
+			parsed, _, err := jwt.NewParser().ParseUnverified(token, &UserToken{})
+			is.NoErr(err)
+			is.Equal(parsed.Method.Alg(), alg)
+			is.True(parsed.Header["kid"] != "")
+
+			claims, err := ParseToken(token, keys)
+			is.NoErr(err)
+			is.Equal(claims.Subject, userId)
+		})
+	}
+
+	_, err := NewKeyRing("HS256")
+	is.New(t).True(errors.Is(err, ErrKeyUnsupportedAlg))
+}
+
+func TestRejectSharedSecretTokens(t *testing.T) {
+	is := is.New(t)
+
+	keys, err := NewKeyRing("ES256")
+	is.NoErr(err)
+
+	// A token signed with a shared secret must not pass, even if the secret is known
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, UserToken{Scope: "crm:write", RegisteredClaims: jwt.RegisteredClaims{
+		Issuer:    Issuer,
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}}).SignedString([]byte("secret"))
+	is.NoErr(err)
+
+	_, err = ParseToken(token, keys)
+	is.True(err != nil)
+}
+
+func TestKeyRotation(t *testing.T) {
+	is := is.New(t)
+
+	keys, err := NewKeyRing("ES256")
+	is.NoErr(err)
+
+	before, err := NewUserToken(uuid.NewString(), RoleCustomer, keys)
+	is.NoErr(err)
+
+	is.NoErr(keys.Rotate())
+
+	after, err := NewUserToken(uuid.NewString(), RoleCustomer, keys)
+	is.NoErr(err)
+
+	// Both keys are published during the overlap, the new key first
+	set, err := keys.JWKS()
+	is.NoErr(err)
+	is.Equal(len(set.Keys), 2)
+	is.Equal(kid(t, after), set.Keys[0].Kid)
+
+	_, err = ParseToken(before, keys)
+	is.NoErr(err)
+	_, err = ParseToken(after, keys)
+	is.NoErr(err)
+
+	overlap := RotationOverlap
+	RotationOverlap = -time.Second
+	defer func() { RotationOverlap = overlap }()
+
+	_, err = ParseToken(before, keys)
+	is.True(errors.Is(err, ErrKeyUnknown))
+	_, err = ParseToken(after, keys)
+	is.NoErr(err)
+
+	set, err = keys.JWKS()
+	is.NoErr(err)
+	is.Equal(len(set.Keys), 1)
+}
+
+func TestVerifyWithPublishedKeys(t *testing.T) {
+	is := is.New(t)
+
+	keys, err := NewKeyRing("EdDSA")
+	is.NoErr(err)
+
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		set, _ := keys.JWKS()
+		json.NewEncoder(w).Encode(set)
+	}))
+	defer auth.Close()
+
+	// This is what a backend does, it never sees the private key
+	published := jwks.NewRemoteKeySet(auth.URL, nil)
+
+	token, err := NewUserToken(uuid.NewString(), RoleCustomer, keys)
+	is.NoErr(err)
+	_, err = ParseToken(token, published)
+	is.NoErr(err)
+
+	// The new key is found right after the last fetch
+	is.NoErr(keys.Rotate())
+	token, err = NewUserToken(uuid.NewString(), RoleCustomer, keys)
+	is.NoErr(err)
+	_, err = ParseToken(token, published)
+	is.NoErr(err)
+}
+
+func TestLoadKeyRing(t *testing.T) {
+	is := is.New(t)
+
+	path := filepath.Join(t.TempDir(), "keys.pem")
+	var data []byte
+	for range 2 {
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		is.NoErr(err)
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		is.NoErr(err)
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})...)
+	}
+	is.NoErr(os.WriteFile(path, data, 0600))
+
+	keys, err := LoadKeyRing(path)
+	is.NoErr(err)
+
+	again, err := LoadKeyRing(path)
+	is.NoErr(err)
+
+	// The kid is derived from the key, so every instance loading the file signs with the same kid
+	token, err := NewUserToken(uuid.NewString(), RoleCustomer, keys)
+	is.NoErr(err)
+	_, err = ParseToken(token, again)
+	is.NoErr(err)
+
+	set, err := keys.JWKS()
+	is.NoErr(err)
+	is.Equal(len(set.Keys), 2)
+	is.Equal(kid(t, token), set.Keys[0].Kid)
+
+	_, err = LoadKeyRing(filepath.Join(t.TempDir(), "missing.pem"))
+	is.True(errors.Is(err, ErrKeyFile))
+}
+
+func kid(t *testing.T, token string) string {
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &UserToken{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
@@ -0,0 +1,336 @@
+package tokens
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("error: unknown refresh token")
+	ErrRefreshTokenExpired = errors.New("error: refresh token has expired")
+	ErrRefreshTokenRevoked = errors.New("error: refresh token has been revoked")
+	ErrRefreshTokenReused  = errors.New("error: refresh token was reused, token family revoked")
+	ErrRefreshStore        = errors.New("error: refresh tokens could not be stored")
+)
+
+// How long a refresh token can be used before the user has to log in again
+var RefreshTokenTTL = 14 * 24 * time.Hour
+
+/*
+How long a used refresh token still gives the token it was rotated to.
+A page load sends several requests at once with the same session, and
+each of them renews it when the access token is about to expire.
+*/
+var RefreshReuseGrace = 10 * time.Second
+
+// refreshToken is a token row, keyed by the hash of the token
+type refreshToken struct {
+	Hash    string `gorm:"primaryKey"`
+	UserId  string `gorm:"index"`
+	Family  string `gorm:"index"`
+	Expires time.Time
+	Used    time.Time // zero until the token is rotated
+	// The token it was rotated to, sealed with the token itself, see RefreshReuseGrace
+	Successor []byte
+}
+
+func (refreshToken) TableName() string {
+	return "refresh_tokens"
+}
+
+type refreshFamily struct {
+	Family  string `gorm:"primaryKey"`
+	Revoked bool
+}
+
+func (refreshFamily) TableName() string {
+	return "refresh_families"
+}
+
+/*
+RefreshStore keeps refresh tokens server-side. Only a hash of each
+token is kept, so a dump of the store cannot be used to log in.
+
+Every refresh token belongs to a family that starts at login. Using a
+token rotates it: it is marked used and a new token in the same family
+is returned. If a used token is presented again, someone has a copy of
+it, and the whole family is revoked so neither copy works anymore.
+Within RefreshReuseGrace of the rotation the token it was rotated to is
+returned again instead, the requests of one page share a session.
+
+A store from NewSQLiteRefreshStore also writes the tokens to the
+database, so users stay logged in across a restart of the gateway.
+*/
+type RefreshStore struct {
+	mu       sync.Mutex
+	tokens   map[string]*refreshToken // keyed by token hash
+	families map[string]bool          // family id -> revoked
+	db       *gorm.DB                 // nil if the tokens are only kept in memory
+}
+
+// NewRefreshStore keeps the tokens in memory, they are forgotten when the gateway stops
+func NewRefreshStore() *RefreshStore {
+	return &RefreshStore{
+		tokens:   map[string]*refreshToken{},
+		families: map[string]bool{},
+	}
+}
+
+// NewSQLiteRefreshStore keeps the tokens in db too, e.g. the database of the session store, and loads the ones it has
+func NewSQLiteRefreshStore(db *gorm.DB) (*RefreshStore, error) {
+	err := db.AutoMigrate(&refreshToken{}, &refreshFamily{})
+	if err != nil {
+		return nil, errors.Join(ErrRefreshStore, err)
+	}
+
+	var tokens []refreshToken
+	err = db.Find(&tokens, "expires > ?", time.Now()).Error
+	if err != nil {
+		return nil, errors.Join(ErrRefreshStore, err)
+	}
+	var families []refreshFamily
+	err = db.Find(&families).Error
+	if err != nil {
+		return nil, errors.Join(ErrRefreshStore, err)
+	}
+
+	s := NewRefreshStore()
+	s.db = db
+	for i := range tokens {
+		s.tokens[tokens[i].Hash] = &tokens[i]
+	}
+	for _, f := range families {
+		s.families[f.Family] = f.Revoked
+	}
+	return s, nil
+}
+
+// Issue starts a new token family for the user, e.g. at login.
+func (s *RefreshStore) Issue(userId string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep()
+
+	family, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	token, rt, err := newRefreshToken(userId, family)
+	if err != nil {
+		return "", err
+	}
+	if s.db != nil {
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Create(&refreshFamily{Family: family}).Error
+			if err != nil {
+				return err
+			}
+			return tx.Create(rt).Error
+		})
+		if err != nil {
+			return "", errors.Join(ErrRefreshStore, err)
+		}
+	}
+	s.families[family] = false
+	s.tokens[rt.Hash] = rt
+	return token, nil
+}
+
+// Rotate exchanges a refresh token for a new one and returns the user it belongs to.
+func (s *RefreshStore) Rotate(token string) (userId string, next string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rt, ok := s.tokens[hash(token)]
+	if !ok {
+		return "", "", ErrRefreshTokenInvalid
+	}
+
+	if s.families[rt.Family] {
+		return "", "", ErrRefreshTokenRevoked
+	}
+
+	if !rt.Used.IsZero() {
+		if time.Since(rt.Used) <= RefreshReuseGrace {
+			next, err = open(token, rt.Successor)
+			if err == nil {
+				return rt.UserId, next, nil
+			}
+		}
+		s.revokeFamily(rt.Family)
+		return "", "", ErrRefreshTokenReused
+	}
+
+	if time.Now().After(rt.Expires) {
+		return "", "", ErrRefreshTokenExpired
+	}
+
+	next, nextRt, err := newRefreshToken(rt.UserId, rt.Family)
+	if err != nil {
+		return "", "", err
+	}
+	successor, err := seal(token, next)
+	if err != nil {
+		return "", "", err
+	}
+	used := time.Now()
+	if s.db != nil {
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Create(nextRt).Error
+			if err != nil {
+				return err
+			}
+			return tx.Model(rt).Updates(map[string]any{"used": used, "successor": successor}).Error
+		})
+		if err != nil {
+			return "", "", errors.Join(ErrRefreshStore, err)
+		}
+	}
+	s.tokens[nextRt.Hash] = nextRt
+	rt.Successor = successor
+	rt.Used = used
+	return rt.UserId, next, nil
+}
+
+// Revoke revokes the family of the token, e.g. at logout.
+func (s *RefreshStore) Revoke(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rt, ok := s.tokens[hash(token)]; ok {
+		s.revokeFamily(rt.Family)
+	}
+}
+
+// RevokeUser revokes every token family of the user.
+func (s *RefreshStore) RevokeUser(userId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rt := range s.tokens {
+		if rt.UserId == userId {
+			s.revokeFamily(rt.Family)
+		}
+	}
+}
+
+func newRefreshToken(userId, family string) (string, *refreshToken, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	return token, &refreshToken{
+		Hash:    hash(token),
+		UserId:  userId,
+		Family:  family,
+		Expires: time.Now().Add(RefreshTokenTTL),
+	}, nil
+}
+
+// revokeFamily must be called with s.mu held.
+func (s *RefreshStore) revokeFamily(family string) {
+	if s.families[family] {
+		return
+	}
+	s.families[family] = true
+	s.store(func(db *gorm.DB) *gorm.DB {
+		return db.Model(&refreshFamily{}).Where("family = ?", family).Update("revoked", true)
+	})
+}
+
+// sweep forgets expired tokens and families without tokens. It must be called with s.mu held.
+func (s *RefreshStore) sweep() {
+	alive := map[string]bool{}
+	for h, rt := range s.tokens {
+		if time.Now().After(rt.Expires) {
+			delete(s.tokens, h)
+			continue
+		}
+		alive[rt.Family] = true
+	}
+	for family := range s.families {
+		if !alive[family] {
+			delete(s.families, family)
+		}
+	}
+	s.store(func(db *gorm.DB) *gorm.DB { return db.Delete(&refreshToken{}, "expires < ?", time.Now()) })
+	s.store(func(db *gorm.DB) *gorm.DB {
+		return db.Delete(&refreshFamily{}, "family NOT IN (?)", db.Model(&refreshToken{}).Select("family"))
+	})
+}
+
+/*
+store writes a change to the database, if the store has one. If it
+fails the change is logged, the tokens in memory have changed anyway and
+a revocation holds until the gateway restarts. It must be called with
+s.mu held.
+*/
+func (s *RefreshStore) store(change func(db *gorm.DB) *gorm.DB) {
+	if s.db == nil {
+		return
+	}
+	err := change(s.db).Error
+	if err != nil {
+		log.Printf("%v: %v", ErrRefreshStore, err)
+	}
+}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// seal encrypts next with a key only the holder of token has, so the store still cannot be used to log in
+func seal(token, next string) ([]byte, error) {
+	aead, err := successorCipher(token)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, []byte(next), nil), nil
+}
+
+func open(token string, sealed []byte) (string, error) {
+	aead, err := successorCipher(token)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", ErrRefreshTokenInvalid
+	}
+	next, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	return string(next), err
+}
+
+func successorCipher(token string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("successor:" + token))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
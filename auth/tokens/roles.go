@@ -0,0 +1,42 @@
+package tokens
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrUnknownRole = errors.New("error: unknown role")
+
+// Roles are stored on the user in CRM
+const (
+	RoleCustomer = "customer"
+	RoleSupport  = "support" // support agents
+	RoleAdmin    = "admin"
+	RoleService  = "service" // other Gaia services
+)
+
+/*
+RoleScopes is what each role may do. Customers are further limited to
+their own record by the services, the scopes alone do not say whose
+record it is.
+*/
+var RoleScopes = map[string][]string{
+	RoleCustomer: {"crm:read", "crm:write", "data:read", "invoice:read"},
+	RoleSupport:  {"crm:read", "crm:list", "data:read", "invoice:read"},
+	RoleAdmin:    {"crm:read", "crm:write", "crm:delete", "crm:list", "data:read", "invoice:read"},
+	RoleService:  {"crm:read", "crm:write", "crm:list", "crm:match"},
+}
+
+// Scope returns the space separated scope of role.
+func Scope(role string) (string, error) {
+	scopes, ok := RoleScopes[role]
+	if !ok {
+		return "", ErrUnknownRole
+	}
+	return strings.Join(scopes, " "), nil
+}
+
+// IsStaff reports if the token belongs to someone who works on other users' records, rather than a customer.
+func (t *UserToken) IsStaff() bool {
+	return t.HasRole(RoleSupport) || t.HasRole(RoleAdmin) || t.HasRole(RoleService)
+}
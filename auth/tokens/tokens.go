@@ -1,6 +1,9 @@
 package tokens
 
 import (
+	"errors"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -8,42 +11,117 @@ import (
 	_ "github.com/joho/godotenv/autoload"
 )
 
+// Access tokens are short-lived, the session is kept alive with a refresh token
+var AccessTokenTTL = 15 * time.Minute
+
+// Internal tokens only have to live from the gateway to the upstream
+var InternalTokenTTL = time.Minute
+
 type UserToken struct {
-	Scope string `json:"scope"` //e.g. crm, api,
+	Scope string   `json:"scope"`           //e.g. crm, api,
+	Roles []string `json:"roles,omitempty"` //e.g. customer, admin
 	jwt.RegisteredClaims
 }
 
-func NewUserToken(userId string, secret string) (string, error) {
+/*
+NewUserToken is signed with the current key of the ring. Backends verify
+it with the public keys from /.well-known/jwks.json. The scope is given
+by the role of the user.
+*/
+func NewUserToken(userId string, role string, keys *KeyRing) (string, error) {
+	// Users from before roles have none, they are all customers
+	if role == "" {
+		role = RoleCustomer
+	}
+	scope, err := Scope(role)
+	if err != nil {
+		return "", err
+	}
 
 	rc := jwt.RegisteredClaims{
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(AccessTokenTTL)),
 		IssuedAt:  jwt.NewNumericDate(time.Now()),
 		NotBefore: jwt.NewNumericDate(time.Now()),
-		Issuer:    "Gaia",
+		Issuer:    Issuer,
 		Subject:   userId,
 		Audience:  []string{"crm", "data", "invoice"},
 	}
 
 	claims := UserToken{
-		"crm:write data:read invoice:read", rc,
+		Scope:            scope,
+		Roles:            []string{role},
+		RegisteredClaims: rc,
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return keys.Sign(claims)
+}
 
-	return token.SignedString([]byte(secret))
+/*
+NewInternalToken is minted by the gateway for each proxied request. It
+carries the user, scope and roles of the session token, but only for
+the upstream audience, so the session token never leaves the gateway.
+*/
+func NewInternalToken(claims *UserToken, audience string, keys *KeyRing) (string, error) {
+	rc := jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(InternalTokenTTL)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		NotBefore: jwt.NewNumericDate(time.Now()),
+		Issuer:    Issuer,
+		Subject:   claims.Subject,
+		Audience:  []string{audience},
+	}
+
+	return keys.Sign(UserToken{Scope: claims.Scope, Roles: claims.Roles, RegisteredClaims: rc})
 }
 
-func ValidateToken(tokenString string, secret string) (bool, error) {
+/*
+NewServiceToken is issued to other Gaia services rather than users, by
+the client credentials grant on /oauth/token. The subject is the client
+id prefixed with "service:", and the role is service.
+*/
+func NewServiceToken(client string, audience []string, scope string, keys *KeyRing) (string, error) {
+	rc := jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(AccessTokenTTL)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		NotBefore: jwt.NewNumericDate(time.Now()),
+		Issuer:    Issuer,
+		Subject:   "service:" + client,
+		Audience:  audience,
+	}
 
-	//we just want to test if we can parse the token with the server secret.
-	//TODO: Validate time
-	//Note: Claims should be validate elsewhere
-	_, err := jwt.Parse(tokenString, func(token *jwt.Token) (any, error) {
-		return []byte(secret), nil
-	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
-	if err != nil {
-		return false, err
+	return keys.Sign(UserToken{Scope: scope, Roles: []string{RoleService}, RegisteredClaims: rc})
+}
+
+// ParseToken validates a user token and returns its claims. It is short for NewValidator(keys).Validate(token).
+func ParseToken(tokenString string, keys KeySet) (*UserToken, error) {
+	return NewValidator(keys).Validate(tokenString)
+}
+
+// HasRole reports if the user has role
+func (t *UserToken) HasRole(role string) bool {
+	return slices.Contains(t.Roles, role)
+}
+
+// HasScope reports if the space separated scope claim contains scope
+func (t *UserToken) HasScope(scope string) bool {
+	return slices.Contains(strings.Fields(t.Scope), scope)
+}
+
+/*
+ExpiresWithin reports if a correctly signed token expires within d, or
+has already expired. A token signed with a key that is no longer in
+keys is treated as expired, e.g. after a restart with generated keys or
+when a rotated key has been retired, so it is renewed.
+*/
+func ExpiresWithin(tokenString string, keys KeySet, d time.Duration) bool {
+	claims := &UserToken{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, keyFunc(keys), jwt.WithValidMethods(signingAlgs), jwt.WithoutClaimsValidation())
+	if errors.Is(err, ErrKeyUnknown) {
+		return true
+	}
+	if err != nil || claims.ExpiresAt == nil {
+		return false
 	}
 
-	return true, nil
+	return time.Until(claims.ExpiresAt.Time) < d
 }
@@ -0,0 +1,235 @@
+package tokens
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matryer/is"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestRefreshRotate(t *testing.T) {
+	is := is.New(t)
+
+	store := NewRefreshStore()
+	userId := uuid.NewString()
+
+	first, err := store.Issue(userId)
+	is.NoErr(err)
+
+	id, second, err := store.Rotate(first)
+	is.NoErr(err)
+	is.Equal(id, userId)
+	is.True(second != first)
+
+	id, _, err = store.Rotate(second)
+	is.NoErr(err)
+	is.Equal(id, userId)
+
+	_, _, err = store.Rotate("not a token")
+	is.True(errors.Is(err, ErrRefreshTokenInvalid))
+}
+
+func TestRefreshReuseRevokesFamily(t *testing.T) {
+	is := is.New(t)
+
+	grace := RefreshReuseGrace
+	RefreshReuseGrace = 0
+	defer func() { RefreshReuseGrace = grace }()
+
+	store := NewRefreshStore()
+	userId := uuid.NewString()
+
+	first, err := store.Issue(userId)
+	is.NoErr(err)
+	_, second, err := store.Rotate(first)
+	is.NoErr(err)
+
+	// Another login for the same user is a separate family
+	other, err := store.Issue(userId)
+	is.NoErr(err)
+
+	// first has been used, so someone holds a copy
+	_, _, err = store.Rotate(first)
+	is.True(errors.Is(err, ErrRefreshTokenReused))
+
+	// and the legitimate holder is logged out as well
+	_, _, err = store.Rotate(second)
+	is.True(errors.Is(err, ErrRefreshTokenRevoked))
+
+	_, _, err = store.Rotate(other)
+	is.NoErr(err)
+}
+
+func TestRefreshReuseGrace(t *testing.T) {
+	is := is.New(t)
+
+	store := NewRefreshStore()
+	userId := uuid.NewString()
+
+	first, err := store.Issue(userId)
+	is.NoErr(err)
+	_, second, err := store.Rotate(first)
+	is.NoErr(err)
+
+	// Another request of the same page load renews with the same token
+	id, again, err := store.Rotate(first)
+	is.NoErr(err)
+	is.Equal(id, userId)
+	is.Equal(again, second)
+
+	_, _, err = store.Rotate(second)
+	is.NoErr(err)
+
+	// After the grace period it is reuse
+	store.tokens[hash(first)].Used = time.Now().Add(-RefreshReuseGrace - time.Second)
+	_, _, err = store.Rotate(first)
+	is.True(errors.Is(err, ErrRefreshTokenReused))
+}
+
+func TestRefreshExpired(t *testing.T) {
+	is := is.New(t)
+
+	ttl := RefreshTokenTTL
+	RefreshTokenTTL = -time.Second
+	defer func() { RefreshTokenTTL = ttl }()
+
+	store := NewRefreshStore()
+	token, err := store.Issue(uuid.NewString())
+	is.NoErr(err)
+
+	_, _, err = store.Rotate(token)
+	is.True(errors.Is(err, ErrRefreshTokenExpired))
+}
+
+func TestRefreshRevokeUser(t *testing.T) {
+	is := is.New(t)
+
+	store := NewRefreshStore()
+	userId := uuid.NewString()
+
+	laptop, err := store.Issue(userId)
+	is.NoErr(err)
+	phone, err := store.Issue(userId)
+	is.NoErr(err)
+	someoneElse, err := store.Issue(uuid.NewString())
+	is.NoErr(err)
+
+	store.RevokeUser(userId)
+
+	_, _, err = store.Rotate(laptop)
+	is.True(errors.Is(err, ErrRefreshTokenRevoked))
+	_, _, err = store.Rotate(phone)
+	is.True(errors.Is(err, ErrRefreshTokenRevoked))
+	_, _, err = store.Rotate(someoneElse)
+	is.NoErr(err)
+}
+
+func TestSQLiteRefreshStore(t *testing.T) {
+	is := is.New(t)
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "sessions.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	is.NoErr(err)
+
+	store, err := NewSQLiteRefreshStore(db)
+	is.NoErr(err)
+	userId := uuid.NewString()
+	first, err := store.Issue(userId)
+	is.NoErr(err)
+	_, second, err := store.Rotate(first)
+	is.NoErr(err)
+	loggedOut, err := store.Issue(userId)
+	is.NoErr(err)
+	store.Revoke(loggedOut)
+
+	// The rotation, the token it was rotated to and the logout survive a restart
+	restarted, err := NewSQLiteRefreshStore(db)
+	is.NoErr(err)
+	_, again, err := restarted.Rotate(first)
+	is.NoErr(err)
+	is.Equal(again, second)
+	id, _, err := restarted.Rotate(second)
+	is.NoErr(err)
+	is.Equal(id, userId)
+	_, _, err = restarted.Rotate(loggedOut)
+	is.True(errors.Is(err, ErrRefreshTokenRevoked))
+
+	restarted.RevokeUser(userId)
+	restarted, err = NewSQLiteRefreshStore(db)
+	is.NoErr(err)
+	_, _, err = restarted.Rotate(second)
+	is.True(errors.Is(err, ErrRefreshTokenRevoked))
+}
+
+func TestExpiresWithin(t *testing.T) {
+	is := is.New(t)
+
+	keys, err := NewKeyRing("ES256")
+	is.NoErr(err)
+	otherKeys, err := NewKeyRing("ES256")
+	is.NoErr(err)
+
+	token, err := NewUserToken(uuid.NewString(), RoleCustomer, keys)
+	is.NoErr(err)
+
+	is.Equal(ExpiresWithin(token, keys, time.Minute), false)
+	is.Equal(ExpiresWithin(token, keys, AccessTokenTTL+time.Minute), true)
+
+	// Signed with a key we no longer have, e.g. before a restart
+	is.Equal(ExpiresWithin(token, otherKeys, time.Minute), true)
+
+	// A forged token is not renewed
+	forged := token[:len(token)-4] + "AAAA"
+	is.Equal(ExpiresWithin(forged, keys, AccessTokenTTL+time.Minute), false)
+}
+
+func TestRoleScopes(t *testing.T) {
+	is := is.New(t)
+
+	keys, err := NewKeyRing("ES256")
+	is.NoErr(err)
+	v := NewValidator(keys)
+
+	support, err := NewUserToken(uuid.NewString(), RoleSupport, keys)
+	is.NoErr(err)
+	claims, err := v.Validate(support)
+	is.NoErr(err)
+	is.True(claims.HasRole(RoleSupport))
+	is.True(claims.IsStaff())
+	is.True(claims.HasScope("crm:read"))
+	is.True(!claims.HasScope("crm:delete"))
+
+	// Users from before roles are customers
+	legacy, err := NewUserToken(uuid.NewString(), "", keys)
+	is.NoErr(err)
+	claims, err = v.Validate(legacy)
+	is.NoErr(err)
+	is.Equal(claims.Roles, []string{RoleCustomer})
+	is.True(!claims.IsStaff())
+
+	_, err = NewUserToken(uuid.NewString(), "superuser", keys)
+	is.True(errors.Is(err, ErrUnknownRole))
+}
+
+func TestServiceToken(t *testing.T) {
+	is := is.New(t)
+
+	keys, err := NewKeyRing("ES256")
+	is.NoErr(err)
+
+	token, err := NewServiceToken("dmi", []string{"crm"}, "crm:match", keys)
+	is.NoErr(err)
+
+	claims, err := NewValidator(keys).Check(token, "crm", "crm:match")
+	is.NoErr(err)
+	is.Equal(claims.Subject, "service:dmi")
+	is.True(claims.IsStaff())
+
+	_, err = NewValidator(keys).Check(token, "auth")
+	is.True(errors.Is(err, ErrTokenAudience))
+}
@@ -0,0 +1,154 @@
+package tokens
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrTokenMissing     = errors.New("error: request has no bearer token")
+	ErrTokenInvalid     = errors.New("error: token is malformed or has an invalid signature")
+	ErrTokenExpired     = errors.New("error: token has expired")
+	ErrTokenNotYetValid = errors.New("error: token is not valid yet")
+	ErrTokenIssuer      = errors.New("error: token is not issued by Gaia")
+	ErrTokenAudience    = errors.New("error: token is not meant for this service")
+	ErrTokenScope       = errors.New("error: token does not have the required scope")
+	ErrTokenRole        = errors.New("error: user does not have the required role")
+)
+
+// Issuer is the iss claim of every token the auth server signs
+const Issuer = "Gaia"
+
+// Clock skew we accept between the auth server and the services verifying its tokens
+var Leeway = 30 * time.Second
+
+/*
+Validator checks Gaia tokens and returns their claims. It is used by the
+proxy on the session token, and by backends on the bearer token with
+Require.
+*/
+type Validator struct {
+	keys KeySet
+}
+
+func NewValidator(keys KeySet) *Validator {
+	return &Validator{keys: keys}
+}
+
+// Validate checks the signature, exp, nbf and iss of the token and returns its claims.
+func (v *Validator) Validate(tokenString string) (*UserToken, error) {
+	claims := &UserToken{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, keyFunc(v.keys),
+		jwt.WithValidMethods(signingAlgs),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuer(Issuer),
+		jwt.WithLeeway(Leeway),
+	)
+
+	switch {
+	case err == nil:
+		return claims, nil
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return nil, errors.Join(ErrTokenExpired, err)
+	case errors.Is(err, jwt.ErrTokenNotValidYet):
+		return nil, errors.Join(ErrTokenNotYetValid, err)
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return nil, errors.Join(ErrTokenIssuer, err)
+	}
+	return nil, errors.Join(ErrTokenInvalid, err)
+}
+
+/*
+Check validates the token and that it is meant for audience and has
+every one of scopes. An empty audience accepts any audience.
+*/
+func (v *Validator) Check(tokenString string, audience string, scopes ...string) (*UserToken, error) {
+	claims, err := v.Validate(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if audience != "" && !slices.Contains(claims.Audience, audience) {
+		return claims, ErrTokenAudience
+	}
+
+	for _, scope := range scopes {
+		if !claims.HasScope(scope) {
+			return claims, ErrTokenScope
+		}
+	}
+
+	return claims, nil
+}
+
+/*
+Require is middleware that only lets requests through with a bearer
+token for audience with all of scopes. The claims are available to the
+next handler with ClaimsFromContext.
+*/
+func (v *Validator) Require(audience string, scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || bearer == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="gaia"`)
+				http.Error(w, ErrTokenMissing.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			claims, err := v.Check(bearer, audience, scopes...)
+			if err != nil {
+				status := StatusCode(err)
+				if status == http.StatusUnauthorized {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="gaia", error="invalid_token"`)
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), claims)))
+		})
+	}
+}
+
+// RequireRole returns ErrTokenRole unless the user has one of roles. No roles means any user.
+func RequireRole(claims *UserToken, roles ...string) error {
+	if len(roles) == 0 || slices.ContainsFunc(roles, claims.HasRole) {
+		return nil
+	}
+	return ErrTokenRole
+}
+
+type claimsKey struct{}
+
+// NewContext returns ctx carrying the claims of a verified token.
+func NewContext(ctx context.Context, claims *UserToken) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims of a request that passed Require, or another middleware using NewContext.
+func ClaimsFromContext(ctx context.Context) (*UserToken, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*UserToken)
+	return claims, ok
+}
+
+/*
+StatusCode maps a validation error to the HTTP answer. A token we cannot
+trust is 401, so the client should authenticate again. A valid token
+without the audience, scope or role is 403, authenticating again will not help.
+*/
+func StatusCode(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrTokenAudience), errors.Is(err, ErrTokenScope), errors.Is(err, ErrTokenRole):
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
@@ -0,0 +1,120 @@
+package tokens
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/matryer/is"
+)
+
+func TestValidate(t *testing.T) {
+	is := is.New(t)
+
+	keys, err := NewKeyRing("ES256")
+	is.NoErr(err)
+	v := NewValidator(keys)
+
+	sign := func(rc jwt.RegisteredClaims) string {
+		token, err := keys.Sign(UserToken{Scope: "crm:write", RegisteredClaims: rc})
+		is.NoErr(err)
+		return token
+	}
+	now := time.Now()
+
+	token, err := NewUserToken(uuid.NewString(), RoleCustomer, keys)
+	is.NoErr(err)
+	claims, err := v.Validate(token)
+	is.NoErr(err)
+	is.True(claims.HasScope("crm:write"))
+
+	_, err = v.Validate(sign(jwt.RegisteredClaims{Issuer: Issuer, ExpiresAt: jwt.NewNumericDate(now.Add(-time.Hour))}))
+	is.True(errors.Is(err, ErrTokenExpired))
+
+	_, err = v.Validate(sign(jwt.RegisteredClaims{Issuer: Issuer, ExpiresAt: jwt.NewNumericDate(now.Add(2 * time.Hour)), NotBefore: jwt.NewNumericDate(now.Add(time.Hour))}))
+	is.True(errors.Is(err, ErrTokenNotYetValid))
+
+	_, err = v.Validate(sign(jwt.RegisteredClaims{Issuer: "Someone", ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour))}))
+	is.True(errors.Is(err, ErrTokenIssuer))
+
+	// Without exp a token would be valid forever
+	_, err = v.Validate(sign(jwt.RegisteredClaims{Issuer: Issuer}))
+	is.True(errors.Is(err, ErrTokenInvalid))
+
+	_, err = v.Validate("not a token")
+	is.True(errors.Is(err, ErrTokenInvalid))
+
+	// Small clock differences between services are accepted
+	_, err = v.Validate(sign(jwt.RegisteredClaims{Issuer: Issuer, ExpiresAt: jwt.NewNumericDate(now.Add(-Leeway / 2))}))
+	is.NoErr(err)
+}
+
+func TestCheck(t *testing.T) {
+	is := is.New(t)
+
+	keys, err := NewKeyRing("ES256")
+	is.NoErr(err)
+	v := NewValidator(keys)
+
+	token, err := NewUserToken(uuid.NewString(), RoleCustomer, keys)
+	is.NoErr(err)
+
+	_, err = v.Check(token, "crm", "crm:write")
+	is.NoErr(err)
+
+	_, err = v.Check(token, "billing")
+	is.True(errors.Is(err, ErrTokenAudience))
+	is.Equal(StatusCode(err), http.StatusForbidden)
+
+	_, err = v.Check(token, "data", "data:write")
+	is.True(errors.Is(err, ErrTokenScope))
+	is.Equal(StatusCode(err), http.StatusForbidden)
+
+	expired, err := keys.Sign(UserToken{Scope: "crm:write", RegisteredClaims: jwt.RegisteredClaims{Issuer: Issuer, Audience: []string{"crm"}, ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Hour))}})
+	is.NoErr(err)
+	_, err = v.Check(expired, "crm", "crm:write")
+	is.True(errors.Is(err, ErrTokenExpired))
+	is.Equal(StatusCode(err), http.StatusUnauthorized)
+}
+
+func TestRequire(t *testing.T) {
+	is := is.New(t)
+
+	keys, err := NewKeyRing("ES256")
+	is.NoErr(err)
+	userId := uuid.NewString()
+
+	handler := NewValidator(keys).Require("crm", "crm:write")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := ClaimsFromContext(r.Context())
+		is.True(ok)
+		is.Equal(claims.Subject, userId)
+	}))
+
+	call := func(authorization string) *http.Response {
+		req := httptest.NewRequest("PUT", "/users/"+userId, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	resp := call("")
+	is.Equal(resp.StatusCode, http.StatusUnauthorized)
+	is.True(resp.Header.Get("WWW-Authenticate") != "")
+
+	is.Equal(call("Bearer garbage").StatusCode, http.StatusUnauthorized)
+
+	readOnly, err := keys.Sign(UserToken{Scope: "crm:read", RegisteredClaims: jwt.RegisteredClaims{Issuer: Issuer, Subject: userId, Audience: []string{"crm"}, ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}})
+	is.NoErr(err)
+	is.Equal(call("Bearer "+readOnly).StatusCode, http.StatusForbidden)
+
+	token, err := NewUserToken(userId, RoleCustomer, keys)
+	is.NoErr(err)
+	is.Equal(call("Bearer "+token).StatusCode, http.StatusOK)
+}
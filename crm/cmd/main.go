@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/henrikkorsgaard/gaia/crm/database"
 	"github.com/henrikkorsgaard/gaia/crm/server"
@@ -15,8 +18,66 @@ import (
 func main() {
 	dbhost := os.Getenv("DATABASE_HOST")
 	port := os.Getenv("SERVER_PORT")
-	db := database.New(dbhost)
+	db, err := database.Open(dbhost)
+	if err != nil {
+		log.Fatalf("DATABASE_HOST: %v", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err = migrate(db, os.Args[2:], os.Stdout)
+		db.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// Serving with a schema the code does not expect breaks requests in ways that are hard to see
+	if userDatabase, ok := db.(*database.UserDatabase); ok {
+		err = userDatabase.CheckSchema()
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Search scans every user without FTS5, which is fine in tests but not with every customer
+		err = userDatabase.CheckSearch()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	config := server.Config{
+		AUTH_SERVER:   os.Getenv("AUTH_SERVER"),
+		CLIENT_ID:     os.Getenv("CLIENT_ID"),
+		CLIENT_SECRET: os.Getenv("CLIENT_SECRET"),
+		DAR_SERVER:    os.Getenv("DAR_SERVER"),
+	}
+	config.DAR_CACHE_TTL = duration("DAR_CACHE_TTL")
+	config.USER_RETENTION = duration("USER_RETENTION")
+	config.PURGE_INTERVAL = duration("PURGE_INTERVAL")
+	if anonymise := os.Getenv("PURGE_ANONYMISE"); anonymise != "" {
+		config.PURGE_ANONYMISE, err = strconv.ParseBool(anonymise)
+		if err != nil {
+			log.Fatalf("PURGE_ANONYMISE: %v", err)
+		}
+	}
+	if config.AUTH_SERVER == "" {
+		log.Fatal("AUTH_SERVER is required, CRM verifies Gaia tokens with its keys")
+	}
+
+	go server.RunPurge(context.Background(), db, config)
 
 	fmt.Printf("CRM Server is running on port %s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, server.NewServer(db)))
+	log.Fatal(http.ListenAndServe(":"+port, server.NewServer(db, config)))
+}
+
+// duration reads a duration like 24h from the environment, empty is 0
+func duration(name string) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+	return d
 }
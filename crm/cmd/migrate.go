@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/henrikkorsgaard/gaia/crm/database"
+)
+
+var ErrMigrateUsage = errors.New("usage: crm migrate up [version] | down [version] | status")
+
+/*
+migrate changes the schema of the database in DATABASE_HOST.
+
+	crm migrate up            applies every pending migration
+	crm migrate up 3          applies the migrations up to and including version 3
+	crm migrate down          rolls back the last migration
+	crm migrate down 0        rolls back every migration, and drops every table
+	crm migrate status        lists the migrations and when they were applied
+*/
+func migrate(store database.UserStore, args []string, out io.Writer) error {
+	db, ok := store.(*database.UserDatabase)
+	if !ok {
+		return errors.New("error: only SQLite and PostgreSQL databases have a schema to migrate")
+	}
+	if len(args) == 0 || len(args) > 2 {
+		return ErrMigrateUsage
+	}
+
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	var version int
+	switch args[0] {
+	case "status":
+		if len(args) > 1 {
+			return ErrMigrateUsage
+		}
+		migrations, err := db.Migrations()
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			applied := "pending"
+			if m.Applied != nil {
+				applied = "applied " + m.Applied.Format(time.RFC3339)
+			}
+			fmt.Fprintf(out, "%04d %-30s %s\n", m.Version, m.Name, applied)
+		}
+		fmt.Fprintf(out, "version %d of %d\n", current, database.LatestVersion())
+		return nil
+	case "up":
+		version = database.LatestVersion()
+	case "down":
+		version = max(current-1, 0)
+	default:
+		return ErrMigrateUsage
+	}
+
+	if len(args) == 2 {
+		version, err = strconv.Atoi(args[1])
+		if err != nil {
+			return ErrMigrateUsage
+		}
+		if (args[0] == "up" && version < current) || (args[0] == "down" && version > current) {
+			return fmt.Errorf("error: the schema is at version %d, %s does not go to %d", current, args[0], version)
+		}
+	}
+
+	done, err := db.MigrateTo(version)
+	for _, m := range done {
+		fmt.Fprintf(out, "%s %04d %s\n", args[0], m.Version, m.Name)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "version %d of %d\n", version, database.LatestVersion())
+	return nil
+}
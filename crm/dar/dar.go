@@ -0,0 +1,225 @@
+/*
+Package dar verifies Danish addresses against DAR, the Danish address
+register, through the DAWA API of Dataforsyningen.
+
+A DAR id is either an address (adresse, with floor and door) or an
+access address (adgangsadresse, the building entrance the DAWA
+autocomplete returns with adgangsadresserOnly). Lookup accepts both.
+*/
+package dar
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAddressUnknown     = errors.New("error: unknown DAR address id")
+	ErrAddressInactive    = errors.New("error: DAR address is no longer in use")
+	ErrAddressUnavailable = errors.New("error: DAR address service is unavailable")
+)
+
+// DefaultServer is the DAWA API of Dataforsyningen
+const DefaultServer = "https://api.dataforsyningen.dk"
+
+// Used when the client is created without a cache ttl
+var DefaultCacheTTL = 24 * time.Hour
+
+// Address is a verified DAR address in the structure CRM stores.
+type Address struct {
+	DarId            string  `json:"dar_id"`
+	AccessAddressId  string  `json:"access_address_id"` // the adgangsadresse, the same as DarId for an access address
+	Text             string  `json:"text"`              // normalised, e.g. "Landgreven 10, 1. th, 1301 København K"
+	Street           string  `json:"street"`
+	Number           string  `json:"number"`
+	Floor            string  `json:"floor,omitempty"`
+	Door             string  `json:"door,omitempty"`
+	District         string  `json:"district,omitempty"` // supplerende bynavn
+	Postcode         string  `json:"postcode"`
+	City             string  `json:"city"`
+	MunicipalityCode string  `json:"municipality_code"`
+	Longitude        float64 `json:"longitude"`
+	Latitude         float64 `json:"latitude"`
+}
+
+// mini is the flat struktur=mini answer of /adresser and /adgangsadresser
+type mini struct {
+	Id                string  `json:"id"`
+	Status            int     `json:"status"`
+	Vejnavn           string  `json:"vejnavn"`
+	Husnr             string  `json:"husnr"`
+	Etage             string  `json:"etage"`
+	Door              string  `json:"dør"`
+	Supplerendebynavn string  `json:"supplerendebynavn"`
+	Postnr            string  `json:"postnr"`
+	Postnrnavn        string  `json:"postnrnavn"`
+	Kommunekode       string  `json:"kommunekode"`
+	Adgangsadresseid  string  `json:"adgangsadresseid"`
+	X                 float64 `json:"x"`
+	Y                 float64 `json:"y"`
+	Betegnelse        string  `json:"betegnelse"`
+}
+
+// DAR status 1 is in use and 3 is provisional, 2 and 4 are retired
+func (m mini) active() bool {
+	return m.Status == 0 || m.Status == 1 || m.Status == 3
+}
+
+func (m mini) address() Address {
+	a := Address{
+		DarId:            m.Id,
+		AccessAddressId:  m.Adgangsadresseid,
+		Text:             m.Betegnelse,
+		Street:           m.Vejnavn,
+		Number:           m.Husnr,
+		Floor:            m.Etage,
+		Door:             m.Door,
+		District:         m.Supplerendebynavn,
+		Postcode:         m.Postnr,
+		City:             m.Postnrnavn,
+		MunicipalityCode: m.Kommunekode,
+		Longitude:        m.X,
+		Latitude:         m.Y,
+	}
+	if a.AccessAddressId == "" {
+		a.AccessAddressId = a.DarId
+	}
+	if a.Text == "" {
+		a.Text = a.format()
+	}
+	return a
+}
+
+// format writes the address like DAWA's betegnelse
+func (a Address) format() string {
+	parts := []string{strings.TrimSpace(a.Street + " " + a.Number)}
+	if a.Floor != "" || a.Door != "" {
+		parts = append(parts, strings.TrimSpace(a.Floor+". "+a.Door))
+	}
+	if a.District != "" {
+		parts = append(parts, a.District)
+	}
+	parts = append(parts, a.Postcode+" "+a.City)
+	return strings.Join(parts, ", ")
+}
+
+/*
+Client looks up DAR ids and caches the answers, also for unknown ids,
+so a user retrying onboarding does not hit Dataforsyningen every time.
+It is safe for concurrent use.
+*/
+type Client struct {
+	server string
+	ttl    time.Duration
+	http   *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cached
+}
+
+type cached struct {
+	address Address
+	err     error
+	expires time.Time
+}
+
+// NewClient uses DefaultServer if server is empty, e.g. a fixture.Server in tests.
+func NewClient(server string, ttl time.Duration) *Client {
+	if server == "" {
+		server = DefaultServer
+	}
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	return &Client{
+		server: strings.TrimSuffix(server, "/"),
+		ttl:    ttl,
+		http:   &http.Client{Timeout: 10 * time.Second},
+		cache:  map[string]cached{},
+	}
+}
+
+// Lookup returns the verified address with the DAR id.
+func (c *Client) Lookup(darId string) (Address, error) {
+	c.mu.Lock()
+	entry, ok := c.cache[darId]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.address, entry.err
+	}
+
+	address, err := c.fetch(darId)
+	// An unavailable service is not an answer, so it is not cached
+	if errors.Is(err, ErrAddressUnavailable) {
+		return address, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep()
+	c.cache[darId] = cached{address: address, err: err, expires: time.Now().Add(c.ttl)}
+	return address, err
+}
+
+// sweep forgets expired answers. The lock must be held.
+func (c *Client) sweep() {
+	now := time.Now()
+	for id, entry := range c.cache {
+		if now.After(entry.expires) {
+			delete(c.cache, id)
+		}
+	}
+}
+
+func (c *Client) fetch(darId string) (Address, error) {
+	if darId == "" {
+		return Address{}, ErrAddressUnknown
+	}
+
+	// Most ids from the onboarding are access addresses, but an address with floor and door is more precise
+	for _, resource := range []string{"adresser", "adgangsadresser"} {
+		m, found, err := c.get(resource, darId)
+		if err != nil {
+			return Address{}, err
+		}
+		if !found {
+			continue
+		}
+		if !m.active() {
+			return Address{}, ErrAddressInactive
+		}
+		return m.address(), nil
+	}
+	return Address{}, ErrAddressUnknown
+}
+
+func (c *Client) get(resource string, darId string) (m mini, found bool, err error) {
+	u := fmt.Sprintf("%s/%s/%s?struktur=mini", c.server, resource, url.PathEscape(darId))
+	resp, err := c.http.Get(u)
+	if err != nil {
+		return m, false, errors.Join(ErrAddressUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return m, false, nil
+	// DAWA answers 400 for an id that is not a UUID
+	case resp.StatusCode == http.StatusBadRequest:
+		return m, false, ErrAddressUnknown
+	case resp.StatusCode != http.StatusOK:
+		return m, false, errors.Join(ErrAddressUnavailable, fmt.Errorf("%s answered %d", resource, resp.StatusCode))
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	if err != nil {
+		return m, false, errors.Join(ErrAddressUnavailable, err)
+	}
+	return m, true, nil
+}
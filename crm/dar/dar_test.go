@@ -0,0 +1,83 @@
+package dar
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/henrikkorsgaard/gaia/crm/dar/fixture"
+	"github.com/matryer/is"
+)
+
+func TestLookup(t *testing.T) {
+	is := is.New(t)
+
+	server := fixture.NewServer()
+	defer server.Close()
+	client := NewClient(server.URL, 0)
+
+	a, err := client.Lookup(fixture.Landgreven10)
+	is.NoErr(err)
+	is.Equal(a.Text, "Landgreven 10, 1301 København K")
+	is.Equal(a.Street, "Landgreven")
+	is.Equal(a.Number, "10")
+	is.Equal(a.Postcode, "1301")
+	is.Equal(a.City, "København K")
+	is.Equal(a.MunicipalityCode, "0101")
+	is.Equal(a.AccessAddressId, fixture.Landgreven10)
+	is.True(a.Latitude > 55 && a.Longitude > 12)
+
+	a, err = client.Lookup(fixture.Landgreven10FirstRight)
+	is.NoErr(err)
+	is.Equal(a.Floor, "1")
+	is.Equal(a.Door, "th")
+	is.Equal(a.AccessAddressId, fixture.Landgreven10)
+
+	_, err = client.Lookup("c6a8d1b8-7b5e-4a3e-9e0b-1f0a2b3c4d5e")
+	is.True(errors.Is(err, ErrAddressUnknown))
+	_, err = client.Lookup("Landgreven 10")
+	is.True(errors.Is(err, ErrAddressUnknown))
+	_, err = client.Lookup(fixture.Retired)
+	is.True(errors.Is(err, ErrAddressInactive))
+}
+
+func TestLookupCache(t *testing.T) {
+	is := is.New(t)
+
+	server := fixture.NewServer()
+	defer server.Close()
+	client := NewClient(server.URL, 0)
+
+	for range 3 {
+		_, err := client.Lookup(fixture.ConstantinHansensGade)
+		is.NoErr(err)
+	}
+	// Not an address, so an access address
+	is.Equal(server.Requests(), 2)
+
+	for range 3 {
+		_, err := client.Lookup("c6a8d1b8-7b5e-4a3e-9e0b-1f0a2b3c4d5e")
+		is.True(errors.Is(err, ErrAddressUnknown))
+	}
+	is.Equal(server.Requests(), 4)
+}
+
+func TestLookupUnavailable(t *testing.T) {
+	is := is.New(t)
+
+	server := fixture.NewServer()
+	client := NewClient(server.URL, 0)
+	server.Close()
+
+	_, err := client.Lookup(fixture.Landgreven10)
+	is.True(errors.Is(err, ErrAddressUnavailable))
+}
+
+func TestFormat(t *testing.T) {
+	is := is.New(t)
+
+	a := Address{Street: "Landgreven", Number: "10", Floor: "1", Door: "th", Postcode: "1301", City: "København K"}
+	is.Equal(a.format(), "Landgreven 10, 1. th, 1301 København K")
+
+	a = Address{Street: "Hovedgaden", Number: "3", District: "Tved", Postcode: "5700", City: "Svendborg"}
+	is.Equal(a.format(), "Hovedgaden 3, Tved, 5700 Svendborg")
+}
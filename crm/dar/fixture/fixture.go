@@ -0,0 +1,94 @@
+/*
+Package fixture serves a few DAR addresses like the DAWA API, so tests
+and local development do not depend on Dataforsyningen.
+*/
+package fixture
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+)
+
+// DAR ids served by the fixture
+const (
+	Landgreven10           = "0a3f507a-b2e6-32b8-e044-0003ba298018" // access address
+	Landgreven10FirstRight = "0a3f50c1-5d5e-32b8-e044-0003ba298018" // address with floor and door
+	ConstantinHansensGade  = "45380a0c-9ad1-4370-84d2-50fc574b2063" // access address
+	Retired                = "5f1c6b2e-0d53-4c1d-9a53-2f9e5b3a7c11" // address that is no longer in use
+)
+
+// Addresses in the struktur=mini format of /adresser
+var Addresses = map[string]map[string]any{
+	Landgreven10FirstRight: {
+		"id": Landgreven10FirstRight, "status": 1, "vejnavn": "Landgreven", "husnr": "10", "etage": "1", "dør": "th",
+		"supplerendebynavn": "", "postnr": "1301", "postnrnavn": "København K", "kommunekode": "0101",
+		"adgangsadresseid": Landgreven10, "x": 12.5863, "y": 55.6846,
+		"betegnelse": "Landgreven 10, 1. th, 1301 København K",
+	},
+	Retired: {
+		"id": Retired, "status": 2, "vejnavn": "Landgreven", "husnr": "12", "etage": "", "dør": "",
+		"supplerendebynavn": "", "postnr": "1301", "postnrnavn": "København K", "kommunekode": "0101",
+		"adgangsadresseid": "", "x": 12.5865, "y": 55.6847,
+		"betegnelse": "Landgreven 12, 1301 København K",
+	},
+}
+
+// AccessAddresses in the struktur=mini format of /adgangsadresser
+var AccessAddresses = map[string]map[string]any{
+	Landgreven10: {
+		"id": Landgreven10, "status": 1, "vejnavn": "Landgreven", "husnr": "10",
+		"supplerendebynavn": "", "postnr": "1301", "postnrnavn": "København K", "kommunekode": "0101",
+		"x": 12.5863, "y": 55.6846,
+		"betegnelse": "Landgreven 10, 1301 København K",
+	},
+	ConstantinHansensGade: {
+		"id": ConstantinHansensGade, "status": 1, "vejnavn": "Constantin Hansens Gade", "husnr": "12",
+		"supplerendebynavn": "", "postnr": "1799", "postnrnavn": "København V", "kommunekode": "0101",
+		"x": 12.5543, "y": 55.6686,
+		"betegnelse": "Constantin Hansens Gade 12, 1799 København V",
+	},
+}
+
+type Server struct {
+	*httptest.Server
+	requests atomic.Int64
+}
+
+func NewServer() *Server {
+	s := &Server{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /adresser/{id}", s.serve(Addresses))
+	mux.HandleFunc("GET /adgangsadresser/{id}", s.serve(AccessAddresses))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Requests is the number of lookups the server has answered
+func (s *Server) Requests() int {
+	return int(s.requests.Load())
+}
+
+func (s *Server) serve(resources map[string]map[string]any) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+		id := r.PathValue("id")
+		if len(id) != 36 || strings.Count(id, "-") != 4 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"type": "QueryParameterFormatError", "title": "id: String does not match pattern"})
+			return
+		}
+
+		resource, ok := resources[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"type": "ResourceNotFoundError", "title": "The resource was not found"})
+			return
+		}
+		json.NewEncoder(w).Encode(resource)
+	}
+}
@@ -1,102 +1,603 @@
 package database
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/matryer/is"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
-var testdb = "test.db"
+/*
+forEachStore runs the test against every UserStore, each time in an
+empty store with the latest schema.
+*/
+func forEachStore(t *testing.T, test func(t *testing.T, db UserStore)) {
+	forEachDatabase(t, func(t *testing.T, db *UserDatabase) {
+		_, err := db.MigrateTo(LatestVersion())
+		if err != nil {
+			t.Fatal(err)
+		}
+		test(t, db)
+	})
 
-func TestCreateUser(t *testing.T) {
-	defer cleanup()
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore())
+	})
+}
 
-	is := is.New(t)
-	db := New(testdb)
-	u1 := User{
-		Name:    "Bruno Latour",
-		Address: "Landgreven 10, 1301 København K",
-		DarId:   "0a3f507a-b2e6-32b8-e044-0003ba298018",
+/*
+forEachDatabase runs the test against an empty SQLite and PostgreSQL
+database, without migrations. PostgreSQL is skipped unless
+CRM_TEST_POSTGRES is a DSN, e.g. postgres://postgres@localhost/crm_test.
+Every test gets its own schema there, which is dropped after.
+*/
+func forEachDatabase(t *testing.T, test func(t *testing.T, db *UserDatabase)) {
+	t.Run("sqlite", func(t *testing.T) {
+		db, err := NewSQLite(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		test(t, db)
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv("CRM_TEST_POSTGRES")
+		if dsn == "" {
+			t.Skip("CRM_TEST_POSTGRES is not set")
+		}
+		test(t, newTestPostgres(t, dsn))
+	})
+}
+
+func newTestPostgres(t *testing.T, dsn string) *UserDatabase {
+	admin, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := "crm_test_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	err = admin.Exec("CREATE SCHEMA " + schema).Error
+	if err != nil {
+		t.Fatal(err)
 	}
+	t.Cleanup(func() {
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if sqlDB, err := admin.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
 
-	u2, err := db.CreateUser(u1)
-	is.NoErr(err)
-	is.Equal(u2.GaiaId != "", true)
+	if strings.Contains(dsn, "://") {
+		separator := "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+		dsn += separator + "search_path=" + schema
+	} else {
+		dsn += " search_path=" + schema
+	}
+	db, err := NewPostgres(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
 }
 
-func TestGetUser(t *testing.T) {
-	defer cleanup()
+func TestOpen(t *testing.T) {
+	is := is.New(t)
+
+	db, err := Open("memory")
+	is.NoErr(err)
+	_, ok := db.(*MemoryStore)
+	is.True(ok)
+
+	db, err = Open(filepath.Join(t.TempDir(), "crm.db"))
+	is.NoErr(err)
+	_, ok = db.(*UserDatabase)
+	is.True(ok)
+	is.NoErr(db.Close())
+
+	_, err = Open(filepath.Join(t.TempDir(), "missing", "crm.db"))
+	is.True(errors.Is(err, ErrDatabaseConnection))
+}
 
+// CRM is built with -tags sqlite_fts5, and refuses SQLite without FTS5
+func TestCheckSearch(t *testing.T) {
 	is := is.New(t)
-	db := New(testdb)
-
-	id := uuid.New().String()
-	u1 := User{
-		GaiaId:  id,
-		Name:    "Bruno Latour",
-		Address: "Landgreven 10, 1301 København K",
-		DarId:   "0a3f507a-b2e6-32b8-e044-0003ba298018",
-	}
 
-	_, err := db.CreateUser(u1)
+	db, err := NewSQLite(filepath.Join(t.TempDir(), "crm.db"))
 	is.NoErr(err)
+	defer db.Close()
+	is.Equal(db.fts, builtWithFTS5)
+	if builtWithFTS5 {
+		is.NoErr(db.CheckSearch())
+	} else {
+		is.True(errors.Is(db.CheckSearch(), ErrDatabaseSearchFTS5))
+	}
 
-	u2, err := db.GetUserById(id)
+	_, err = db.MigrateTo(LatestVersion())
 	is.NoErr(err)
-	is.Equal(id, u2.GaiaId)
-	is.Equal(u1.Name, u2.Name)
+	is.Equal(db.db.Migrator().HasTable(ftsTable), builtWithFTS5)
+	is.Equal(db.db.Migrator().HasTable(searchTable), !builtWithFTS5)
+}
+
+func TestCreateUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db UserStore) {
+		is := is.New(t)
+		u1 := User{
+			Name:  "Bruno Latour",
+			DarId: "0a3f507a-b2e6-32b8-e044-0003ba298018",
+		}
+
+		u2, err := db.CreateUser(u1)
+		is.NoErr(err)
+		is.Equal(u2.GaiaId != "", true)
+	})
+}
+
+func TestGetUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db UserStore) {
+		is := is.New(t)
+
+		id := uuid.New().String()
+		u1 := User{
+			GaiaId: id,
+			Name:   "Bruno Latour",
+			DarId:  "0a3f507a-b2e6-32b8-e044-0003ba298018",
+		}
+
+		_, err := db.CreateUser(u1)
+		is.NoErr(err)
+
+		u2, err := db.GetUserById(id)
+		is.NoErr(err)
+		is.Equal(id, u2.GaiaId)
+		is.Equal(u1.Name, u2.Name)
+		is.Equal(u2.Role, "customer")
+
+		// An update without created_at keeps when the user was created
+		is.NoErr(db.UpdateUserById(User{GaiaId: id, Name: "Bruno Latour", Role: "customer"}))
+		u3, err := db.GetUserById(id)
+		is.NoErr(err)
+		is.Equal(u3.Created, u2.Created)
+
+		u4, err := db.GetUserById(uuid.New().String())
+		is.NoErr(err)
+		is.Equal(u4.GaiaId, "")
+
+		// Updating a user that is not there does not create it
+		missing := uuid.New().String()
+		err = db.UpdateUserById(User{GaiaId: missing, Name: "Michel Serres"})
+		is.True(errors.Is(err, ErrDatabaseUserUnknown))
+		u5, err := db.GetUserById(missing)
+		is.NoErr(err)
+		is.Equal(u5.GaiaId, "")
+	})
 }
 
 func TestBulkCreate(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db UserStore) {
+		is := is.New(t)
+		u1 := User{
+			Name:  "Bruno Latour",
+			DarId: "0a3f507a-b2e6-32b8-e044-0003ba298018",
+		}
 
-	is := is.New(t)
-	db := New(testdb)
-	u1 := User{
-		Name:    "Bruno Latour",
-		Address: "Landgreven 10, 1301 København K",
-		DarId:   "0a3f507a-b2e6-32b8-e044-0003ba298018",
-	}
+		u2 := User{
+			Name:  "Bruno Latour",
+			DarId: "0a3f507a-b2e6-32b8-e044-0003ba298018",
+		}
 
-	u2 := User{
-		Name:    "Bruno Latour",
-		Address: "Landgreven 10, 1301 København K",
-		DarId:   "0a3f507a-b2e6-32b8-e044-0003ba298018",
-	}
+		u3 := User{
+			Name:  "Bruno Latour",
+			DarId: "0a3f507a-b2e6-32b8-e044-0003ba298018",
+		}
 
-	u3 := User{
-		Name:    "Bruno Latour",
-		Address: "Landgreven 10, 1301 København K",
-		DarId:   "0a3f507a-b2e6-32b8-e044-0003ba298018",
-	}
+		u4 := User{
+			Name:  "Bruno Latour",
+			DarId: "0a3f507a-b2e6-32b8-e044-0003ba298018",
+		}
 
-	u4 := User{
-		Name:    "Bruno Latour",
-		Address: "Landgreven 10, 1301 København K",
-		DarId:   "0a3f507a-b2e6-32b8-e044-0003ba298018",
-	}
+		rows, users, err := db.BulkCreateUsers([]User{u1, u2, u3, u4})
+		is.NoErr(err)
+		is.Equal(rows, int64(4))
+		for _, u := range users {
+			is.Equal(u.GaiaId != "", true)
+		}
 
-	rows, users, err := db.BulkCreateUsers([]User{u1, u2, u3, u4})
-	is.NoErr(err)
-	is.Equal(rows, int64(4))
-	for _, u := range users {
-		is.Equal(u.GaiaId != "", true)
-	}
+		users, err = db.GetUsers()
+		is.NoErr(err)
+		is.Equal(len(users), 4)
+	})
+}
+
+func TestSharedAddress(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db UserStore) {
+		is := is.New(t)
+
+		landgreven := Address{DarId: "0a3f507a-b2e6-32b8-e044-0003ba298018", Text: "Landgreven 10, 1301 København K", Street: "Landgreven", Number: "10"}
+		_, _, err := db.BulkCreateUsers([]User{
+			{Name: "Bruno Latour", Address: &landgreven},
+			{Name: "Donna Haraway", Address: &landgreven},
+			{Name: "Isabelle Stengers"},
+		})
+		is.NoErr(err)
+
+		users, err := db.GetUsersAtAddress(landgreven.DarId)
+		is.NoErr(err)
+		is.Equal(len(users), 2)
+		is.Equal(users[0].DarId, landgreven.DarId)
+		is.Equal(users[0].Address.Street, "Landgreven")
+
+		// DAR changed the address, every user at it sees the change
+		moved := users[1]
+		moved.Address.Text = "Landgreven 10, 1301 København"
+		is.NoErr(db.UpdateUserById(moved))
+		address, err := db.GetAddress(landgreven.DarId)
+		is.NoErr(err)
+		is.Equal(address.Text, "Landgreven 10, 1301 København")
+		user, err := db.GetUserById(users[0].GaiaId)
+		is.NoErr(err)
+		is.Equal(user.Address.Text, "Landgreven 10, 1301 København")
+	})
 }
 
-func TestGetUsers(t *testing.T) {
-	defer cleanup()
+// Clients sent the address as text before it was structured
+func TestAddressText(t *testing.T) {
 	is := is.New(t)
-	db := New(testdb)
-	users, err := db.GetUsers()
-	is.NoErr(err)
-	is.Equal(len(users), 4)
+
+	var user User
+	is.NoErr(json.Unmarshal([]byte(`{"name":"Bruno Latour","address":"Landgreven 10","dar_id":"abc"}`), &user))
+	is.Equal(user.Address.Text, "Landgreven 10")
+	is.Equal(user.DarId, "abc")
+
+	is.NoErr(json.Unmarshal([]byte(`{"address":{"dar_id":"abc","street":"Landgreven"}}`), &user))
+	is.Equal(user.Address.Street, "Landgreven")
 }
 
-func cleanup() {
-	err := os.Remove(testdb)
-	if err != nil {
-		panic(err)
-	}
+func TestMoveUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db UserStore) {
+		is := is.New(t)
+
+		landgreven := Address{DarId: "0a3f507a-b2e6-32b8-e044-0003ba298018", Text: "Landgreven 10, 1301 København K"}
+		vesterbro := Address{DarId: "45380a0c-9ad1-4370-84d2-50fc574b2063", Text: "Constantin Hansens Gade 12, 1799 København V"}
+		date := func(s string) time.Time {
+			d, err := time.Parse(time.DateOnly, s)
+			is.NoErr(err)
+			return d
+		}
+
+		user, err := db.CreateUser(User{Name: "Bruno Latour"})
+		is.NoErr(err)
+
+		_, err = db.MoveUser(user.GaiaId, landgreven, date("2020-01-01"))
+		is.NoErr(err)
+		residence, err := db.MoveUser(user.GaiaId, vesterbro, date("2023-06-01"))
+		is.NoErr(err)
+		is.Equal(residence.DarId, vesterbro.DarId)
+
+		_, err = db.MoveUser(user.GaiaId, landgreven, date("2023-06-01"))
+		is.True(errors.Is(err, ErrDatabaseMoveDate))
+		_, err = db.MoveUser(user.GaiaId, vesterbro, date("2024-01-01"))
+		is.True(errors.Is(err, ErrDatabaseMoveSame))
+
+		user, err = db.GetUserById(user.GaiaId)
+		is.NoErr(err)
+		is.Equal(user.DarId, vesterbro.DarId)
+		is.Equal(user.Address.Text, vesterbro.Text)
+
+		residences, err := db.GetResidences(user.GaiaId)
+		is.NoErr(err)
+		is.Equal(len(residences), 2)
+		is.Equal(residences[0].Address.Text, landgreven.Text)
+		is.Equal(*residences[0].MovedOut, date("2023-06-01"))
+		is.True(residences[1].MovedOut == nil)
+
+		residents := func(darId string, on string) int {
+			users, err := db.GetResidents(darId, date(on))
+			is.NoErr(err)
+			return len(users)
+		}
+		is.Equal(residents(landgreven.DarId, "2019-12-31"), 0)
+		is.Equal(residents(landgreven.DarId, "2020-01-01"), 1)
+		is.Equal(residents(landgreven.DarId, "2023-05-31"), 1)
+		// The move out day belongs to the new address
+		is.Equal(residents(landgreven.DarId, "2023-06-01"), 0)
+		is.Equal(residents(vesterbro.DarId, "2023-06-01"), 1)
+
+		// Changing the DAR id of the user is a move today
+		user.DarId = landgreven.DarId
+		user.Address = nil
+		is.NoErr(db.UpdateUserById(user))
+		residences, err = db.GetResidences(user.GaiaId)
+		is.NoErr(err)
+		is.Equal(len(residences), 3)
+		is.Equal(residences[2].DarId, landgreven.DarId)
+		is.True(residences[1].MovedOut != nil)
+	})
+}
+
+func TestSubscriptions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db UserStore) {
+		is := is.New(t)
+
+		landgreven := Address{DarId: "0a3f507a-b2e6-32b8-e044-0003ba298018", Text: "Landgreven 10, 1301 København K"}
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+		// Loaded before the customer has a user
+		pending, err := db.CreateSubscription(Subscription{Address: &landgreven, Product: "electricity", SupplyPointId: "571313100000000001", Status: SubscriptionPending, Start: start})
+		is.NoErr(err)
+		is.Equal(pending.DarId, landgreven.DarId)
+		_, err = db.CreateSubscription(Subscription{DarId: landgreven.DarId, Product: "electricity", SupplyPointId: "571313100000000001", Status: SubscriptionPending, Start: start})
+		is.True(errors.Is(err, ErrDatabaseSupplyPoint))
+
+		user, err := db.CreateUser(User{Name: "Bruno Latour", Address: &landgreven})
+		is.NoErr(err)
+		claimed, err := db.ClaimSubscriptions(user.GaiaId, user.DarId)
+		is.NoErr(err)
+		is.Equal(len(claimed), 1)
+		claimed, err = db.ClaimSubscriptions(uuid.New().String(), user.DarId)
+		is.NoErr(err)
+		is.Equal(len(claimed), 0)
+
+		subscriptions, err := db.GetSubscriptions(user.GaiaId)
+		is.NoErr(err)
+		is.Equal(len(subscriptions), 1)
+		is.Equal(subscriptions[0].Id, pending.Id)
+		is.Equal(subscriptions[0].Status, SubscriptionActive)
+		is.Equal(subscriptions[0].Address.Text, landgreven.Text)
+		is.Equal(subscriptions[0].Start, start)
+
+		subscription, err := db.GetSubscription(user.GaiaId, pending.Id)
+		is.NoErr(err)
+		is.Equal(subscription.SupplyPointId, "571313100000000001")
+		subscription, err = db.GetSubscription(uuid.New().String(), pending.Id)
+		is.NoErr(err)
+		is.Equal(subscription.Id, "")
+
+		// A deleted user's subscriptions end, and the supply point is free for the next customer
+		is.NoErr(db.DeleteUser(user.GaiaId))
+		subscriptions, err = db.GetSubscriptions(user.GaiaId)
+		is.NoErr(err)
+		is.Equal(subscriptions[0].Status, SubscriptionEnded)
+		is.True(subscriptions[0].End != nil)
+		_, err = db.CreateSubscription(Subscription{DarId: landgreven.DarId, Product: "electricity", SupplyPointId: "571313100000000001", Status: SubscriptionPending, Start: start})
+		is.NoErr(err)
+
+		is.NoErr(db.DeleteSubscription(user.GaiaId, pending.Id))
+		subscriptions, err = db.GetSubscriptions(user.GaiaId)
+		is.NoErr(err)
+		is.Equal(len(subscriptions), 0)
+	})
+}
+
+func TestDeleteUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db UserStore) {
+		is := is.New(t)
+
+		landgreven := Address{DarId: "0a3f507a-b2e6-32b8-e044-0003ba298018", Text: "Landgreven 10, 1301 København K", Street: "Landgreven"}
+		user, err := db.CreateUser(User{Name: "Bruno Latour", MitIdUUID: "mitid-1"})
+		is.NoErr(err)
+		_, err = db.MoveUser(user.GaiaId, landgreven, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		is.NoErr(err)
+		before := time.Now().UTC().Add(-time.Hour)
+
+		is.NoErr(db.DeleteUser(user.GaiaId))
+		deleted, err := db.GetUserById(user.GaiaId)
+		is.NoErr(err)
+		is.Equal(deleted.GaiaId, "")
+		deleted, err = db.GetUserMitIDUUID("mitid-1")
+		is.NoErr(err)
+		is.Equal(deleted.GaiaId, "")
+		users, err := db.GetUsers()
+		is.NoErr(err)
+		is.Equal(len(users), 0)
+		found, err := db.SearchUsers("latour", 0)
+		is.NoErr(err)
+		is.Equal(len(found), 0)
+		err = db.UpdateUserById(User{GaiaId: user.GaiaId, Name: "Bruno Latour"})
+		is.True(errors.Is(err, ErrDatabaseUserDeleted))
+
+		// Kept for bookkeeping: deleted users can be listed, and were residents
+		page, err := db.QueryUsers(UserQuery{Deleted: true})
+		is.NoErr(err)
+		is.Equal(page.Total, int64(1))
+		is.True(page.Users[0].Deleted.Valid)
+		residents, err := db.GetResidents(landgreven.DarId, before)
+		is.NoErr(err)
+		is.Equal(len(residents), 1)
+		residences, err := db.GetResidences(user.GaiaId)
+		is.NoErr(err)
+		is.Equal(len(residences), 1)
+		is.True(residences[0].MovedOut != nil)
+
+		restored, err := db.RestoreUser(user.GaiaId)
+		is.NoErr(err)
+		is.Equal(restored.Name, "Bruno Latour")
+		is.Equal(restored.Address.Street, "Landgreven")
+		found, err = db.SearchUsers("latour", 0)
+		is.NoErr(err)
+		is.Equal(len(found), 1)
+		residences, err = db.GetResidences(user.GaiaId)
+		is.NoErr(err)
+		is.Equal(len(residences), 2)
+		is.True(residences[1].MovedOut == nil)
+		restored, err = db.RestoreUser(user.GaiaId)
+		is.NoErr(err)
+		is.Equal(restored.GaiaId, "")
+
+		// The customer onboarded again before support restored the old user
+		is.NoErr(db.DeleteUser(user.GaiaId))
+		again, err := db.CreateUser(User{Name: "Bruno Latour", MitIdUUID: "mitid-1"})
+		is.NoErr(err)
+		_, err = db.RestoreUser(user.GaiaId)
+		is.True(errors.Is(err, ErrDatabaseRestoreConflict))
+
+		// Purged when deleted longer ago than the retention
+		purged, err := db.PurgeUsers(before, false)
+		is.NoErr(err)
+		is.Equal(purged, int64(0))
+		purged, err = db.PurgeUsers(time.Now().Add(time.Second), false)
+		is.NoErr(err)
+		is.Equal(purged, int64(1))
+		page, err = db.QueryUsers(UserQuery{Deleted: true})
+		is.NoErr(err)
+		is.Equal(page.Total, int64(0))
+		residences, err = db.GetResidences(user.GaiaId)
+		is.NoErr(err)
+		is.Equal(len(residences), 0)
+
+		// or anonymised
+		is.NoErr(db.DeleteUser(again.GaiaId))
+		purged, err = db.PurgeUsers(time.Now().Add(time.Second), true)
+		is.NoErr(err)
+		is.Equal(purged, int64(1))
+		purged, err = db.PurgeUsers(time.Now().Add(time.Second), true)
+		is.NoErr(err)
+		is.Equal(purged, int64(0))
+		page, err = db.QueryUsers(UserQuery{Deleted: true})
+		is.NoErr(err)
+		is.Equal(page.Total, int64(1))
+		is.Equal(page.Users[0].Name, "")
+		is.Equal(page.Users[0].MitIdUUID, "")
+	})
+}
+
+func TestQueryUsers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db UserStore) {
+		is := is.New(t)
+
+		landgreven := Address{DarId: "0a3f507a-b2e6-32b8-e044-0003ba298018", Text: "Landgreven 10, 1301 København K", Postcode: "1301"}
+		vesterbro := Address{DarId: "45380a0c-9ad1-4370-84d2-50fc574b2063", Text: "Constantin Hansens Gade 12, 1799 København V", Postcode: "1799"}
+
+		var users []User
+		for i := range 120 {
+			user := User{Name: fmt.Sprintf("Customer %03d", i), Created: int64(1000 + i/2)}
+			if i%3 == 0 {
+				user.Address = &landgreven
+				user.MitIdUUID = uuid.New().String()
+			} else {
+				user.Address = &vesterbro
+			}
+			users = append(users, user)
+		}
+		users = append(users, User{Name: "Bruno_Latour", Created: 2000})
+		_, _, err := db.BulkCreateUsers(users)
+		is.NoErr(err)
+
+		// Paging through every user sees each one once, in order
+		for _, sort := range []string{"", "name", "-name", "created", "-created", "updated"} {
+			seen := map[string]bool{}
+			query := UserQuery{Sort: sort, Limit: 25}
+			var previous string
+			for {
+				page, err := db.QueryUsers(query)
+				is.NoErr(err)
+				is.Equal(page.Total, int64(121))
+				for _, user := range page.Users {
+					is.True(!seen[user.GaiaId])
+					seen[user.GaiaId] = true
+					if sort == "name" {
+						is.True(user.Name > previous)
+					}
+					previous = user.Name
+				}
+				if page.Next == "" {
+					break
+				}
+				query.Cursor = page.Next
+			}
+			is.Equal(len(seen), 121)
+		}
+
+		page, err := db.QueryUsers(UserQuery{Postcode: "1301"})
+		is.NoErr(err)
+		is.Equal(page.Total, int64(40))
+		is.Equal(len(page.Users), 40)
+		is.Equal(page.Next, "")
+
+		mitid := false
+		page, err = db.QueryUsers(UserQuery{DarId: vesterbro.DarId, MitID: &mitid, CreatedAfter: 1010, CreatedBefore: 1020})
+		is.NoErr(err)
+		is.Equal(page.Total, int64(13))
+		is.Equal(page.Users[0].Address.Postcode, "1799")
+
+		// LIKE wildcards in the name are matched literally
+		page, err = db.QueryUsers(UserQuery{Name: "o_l"})
+		is.NoErr(err)
+		is.Equal(page.Total, int64(1))
+		page, err = db.QueryUsers(UserQuery{Name: "CUSTOMER 01"})
+		is.NoErr(err)
+		is.Equal(page.Total, int64(10))
+
+		page, err = db.QueryUsers(UserQuery{Sort: "name", Limit: 1})
+		is.NoErr(err)
+		_, err = db.QueryUsers(UserQuery{Sort: "created", Cursor: page.Next})
+		is.True(errors.Is(err, ErrDatabaseCursor))
+		_, err = db.QueryUsers(UserQuery{Cursor: "nonsense"})
+		is.True(errors.Is(err, ErrDatabaseCursor))
+		_, err = db.QueryUsers(UserQuery{Sort: "role"})
+		is.True(errors.Is(err, ErrDatabaseSort))
+	})
+}
+
+func TestSearchUsers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db UserStore) {
+		is := is.New(t)
+
+		landgreven := Address{DarId: "0a3f507a-b2e6-32b8-e044-0003ba298018", Text: "Landgreven 10, 1301 København K", Street: "Landgreven", Postcode: "1301", City: "København K"}
+		aabenraa := Address{DarId: "5f1c6b2e-0d53-4c1d-9a53-2f9e5b3a7c11", Text: "Storegade 1, 6200 Aabenraa", Street: "Storegade", Postcode: "6200", City: "Aabenraa"}
+		_, users, err := db.BulkCreateUsers([]User{
+			{Name: "Bruno Latour", Address: &landgreven},
+			{Name: "Søren Kierkegaard", Address: &aabenraa},
+			{Name: "Isabelle Stengers"},
+		})
+		is.NoErr(err)
+
+		names := func(query string) []string {
+			found, err := db.SearchUsers(query, 0)
+			is.NoErr(err)
+			names := []string{}
+			for _, user := range found {
+				names = append(names, user.Name)
+			}
+			return names
+		}
+
+		is.Equal(names("Latour, Landgreven"), []string{"Bruno Latour"})
+		is.Equal(names("lat land 1301"), []string{"Bruno Latour"})
+		is.Equal(names("latour storegade"), []string{})
+		is.Equal(names("københavn"), []string{"Bruno Latour"})
+		is.Equal(names("Søren"), []string{"Søren Kierkegaard"})
+		is.Equal(names("soeren åbenrå"), []string{"Søren Kierkegaard"})
+		is.Equal(names("STENG"), []string{"Isabelle Stengers"})
+		is.Equal(names("%"), []string{})
+
+		// The index follows changes of the name, the address and deletes
+		bruno := users[0]
+		bruno.Name = "Bruno Latour-Jensen"
+		bruno.Address = &aabenraa
+		is.NoErr(db.UpdateUserById(bruno))
+		is.Equal(names("jensen aabenraa"), []string{"Bruno Latour-Jensen"})
+		is.Equal(names("latour landgreven"), []string{})
+
+		aabenraa.Text = "Storegade 1, 6200 Åbenrå"
+		aabenraa.City = "Åbenrå"
+		is.NoErr(db.UpdateUserById(User{GaiaId: users[2].GaiaId, Name: "Isabelle Stengers", Address: &aabenraa}))
+		is.Equal(len(names("åbenrå storegade")), 3)
+
+		is.NoErr(db.DeleteUser(users[1].GaiaId))
+		is.Equal(names("søren"), []string{})
+	})
 }
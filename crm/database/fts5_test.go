@@ -0,0 +1,6 @@
+//go:build sqlite_fts5
+
+package database
+
+// The SQLite tests search the FTS5 index, like CRM does
+const builtWithFTS5 = true
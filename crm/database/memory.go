@@ -0,0 +1,585 @@
+package database
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+/*
+MemoryStore is the UserStore in maps. It is for tests, and for running
+CRM without a database with DATABASE_HOST=memory. Everything is gone
+when the process stops.
+*/
+type MemoryStore struct {
+	mu            sync.Mutex
+	users         map[string]User
+	addresses     map[string]Address
+	residences    []Residence
+	residenceId   uint
+	subscriptions map[string]Subscription
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:         map[string]User{},
+		addresses:     map[string]Address{},
+		subscriptions: map[string]Subscription{},
+	}
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func (m *MemoryStore) GetUserById(userId string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[userId]
+	if !ok || user.Deleted.Valid {
+		return User{}, nil
+	}
+	return m.withAddress(user), nil
+}
+
+func (m *MemoryStore) GetUserMitIDUUID(mitidUUID string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := m.findUsers(false, func(user User) bool { return user.MitIdUUID == mitidUUID })
+	if len(users) == 0 {
+		return User{}, nil
+	}
+	return users[0], nil
+}
+
+func (m *MemoryStore) GetUserBySubject(provider, subject string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := m.findUsers(false, func(user User) bool { return user.Provider == provider && user.Subject == subject })
+	if len(users) == 0 {
+		return User{}, nil
+	}
+	return users[0], nil
+}
+
+func (m *MemoryStore) GetUsers() ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.findUsers(false, func(User) bool { return true }), nil
+}
+
+func (m *MemoryStore) GetUsersAtAddress(darId string) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.findUsers(false, func(user User) bool { return user.DarId == darId }), nil
+}
+
+func (m *MemoryStore) QueryUsers(query UserQuery) (page UserPage, err error) {
+	sort, column, descending, limit, err := pageOf(query)
+	if err != nil {
+		return page, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	users := m.findUsers(query.Deleted, func(user User) bool { return matchUser(user, query) })
+	page.Total = int64(len(users))
+
+	order := func(a, b User) int {
+		c := compareUsers(column, a, b)
+		if descending {
+			return -c
+		}
+		return c
+	}
+	slices.SortFunc(users, order)
+
+	if query.Cursor != "" {
+		last, err := cursorUser(query.Cursor, sort, column)
+		if err != nil {
+			return page, err
+		}
+		i := 0
+		for i < len(users) && order(users[i], last) <= 0 {
+			i++
+		}
+		users = users[i:]
+	}
+
+	page.Users = users[:min(len(users), limit+1)]
+	nextPage(&page, sort, column, limit)
+	return page, nil
+}
+
+// matchUser is filterUsers for a user in memory
+func matchUser(user User, query UserQuery) bool {
+	if query.Deleted && !user.Deleted.Valid {
+		return false
+	}
+	if query.Name != "" && !strings.Contains(strings.ToLower(user.Name), strings.ToLower(query.Name)) {
+		return false
+	}
+	if query.DarId != "" && user.DarId != query.DarId {
+		return false
+	}
+	if query.Postcode != "" && (user.Address == nil || user.Address.Postcode != query.Postcode) {
+		return false
+	}
+	if query.CreatedAfter != 0 && user.Created < query.CreatedAfter {
+		return false
+	}
+	if query.CreatedBefore != 0 && user.Created >= query.CreatedBefore {
+		return false
+	}
+	if query.UpdatedAfter != 0 && user.Updated < query.UpdatedAfter {
+		return false
+	}
+	if query.UpdatedBefore != 0 && user.Updated >= query.UpdatedBefore {
+		return false
+	}
+	if query.MitID != nil && *query.MitID != (user.MitIdUUID != "") {
+		return false
+	}
+	return true
+}
+
+// compareUsers orders users by the sort column, then by id like QueryUsers does
+func compareUsers(column string, a, b User) int {
+	var c int
+	switch column {
+	case "users.name":
+		c = strings.Compare(a.Name, b.Name)
+	case "users.created":
+		c = cmp.Compare(a.Created, b.Created)
+	case "users.updated":
+		c = cmp.Compare(a.Updated, b.Updated)
+	}
+	if c == 0 {
+		c = strings.Compare(a.GaiaId, b.GaiaId)
+	}
+	return c
+}
+
+func (m *MemoryStore) SearchUsers(query string, limit int) (users []User, err error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return users, nil
+	}
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	limit = min(limit, MaxPageSize)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	documents := map[string]string{}
+	users = m.findUsers(false, func(user User) bool {
+		document := " " + searchDocument(user)
+		for _, term := range terms {
+			if !strings.Contains(document, " "+term) {
+				return false
+			}
+		}
+		documents[user.GaiaId] = document
+		return true
+	})
+	slices.SortFunc(users, func(a, b User) int {
+		return strings.Compare(documents[a.GaiaId], documents[b.GaiaId])
+	})
+	return users[:min(len(users), limit)], nil
+}
+
+func (m *MemoryStore) GetAddress(darId string) (Address, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.addresses[darId], nil
+}
+
+func (m *MemoryStore) UpdateUserById(user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.users[user.GaiaId]
+	if !ok {
+		return ErrDatabaseUserUnknown
+	}
+	if stored.Deleted.Valid {
+		return ErrDatabaseUserDeleted
+	}
+	m.saveUser(user)
+	return nil
+}
+
+func (m *MemoryStore) CreateUser(user User) (User, error) {
+	_, users, err := m.BulkCreateUsers([]User{user})
+	if err != nil {
+		return User{}, err
+	}
+	return users[0], nil
+}
+
+func (m *MemoryStore) BulkCreateUsers(users []User) (int64, []User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range users {
+		if users[i].GaiaId == "" {
+			users[i].GaiaId = uuid.New().String()
+		}
+		users[i] = m.saveUser(users[i])
+	}
+	return int64(len(users)), users, nil
+}
+
+func (m *MemoryStore) DeleteUser(userId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userId]
+	if !ok || user.Deleted.Valid {
+		return nil
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	m.recordMove(userId, "", now)
+	// The subscriptions stay with the address for the next customer, but they have ended
+	for id, subscription := range m.subscriptions {
+		if subscription.GaiaId == userId && subscription.Status != SubscriptionEnded {
+			subscription.Status = SubscriptionEnded
+			subscription.End = &now
+			m.subscriptions[id] = subscription
+		}
+	}
+	user.Deleted = gorm.DeletedAt{Time: now, Valid: true}
+	m.users[userId] = user
+	return nil
+}
+
+func (m *MemoryStore) RestoreUser(userId string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userId]
+	if !ok || !user.Deleted.Valid {
+		return User{}, nil
+	}
+	taken := m.findUsers(false, func(other User) bool {
+		return (user.MitIdUUID != "" && other.MitIdUUID == user.MitIdUUID) ||
+			(user.Subject != "" && other.Provider == user.Provider && other.Subject == user.Subject)
+	})
+	if len(taken) > 0 {
+		return User{}, ErrDatabaseRestoreConflict
+	}
+
+	user.Deleted = gorm.DeletedAt{}
+	m.users[userId] = user
+	if user.DarId != "" {
+		m.recordMove(userId, user.DarId, time.Now().UTC().Truncate(time.Second))
+	}
+	return m.withAddress(user), nil
+}
+
+func (m *MemoryStore) PurgeUsers(deletedBefore time.Time, anonymise bool) (purged int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, user := range m.users {
+		if !user.Deleted.Valid || !user.Deleted.Time.Before(deletedBefore) {
+			continue
+		}
+		if anonymise && user.Name == "" && user.MitIdUUID == "" && user.Subject == "" && user.DarId == "" {
+			continue
+		}
+		purged++
+
+		m.residences = slices.DeleteFunc(m.residences, func(residence Residence) bool {
+			return residence.GaiaId == id
+		})
+		if anonymise {
+			user.Name, user.MitIdUUID, user.Provider, user.Subject, user.DarId = "", "", "", "", ""
+			m.users[id] = user
+			continue
+		}
+		for subscriptionId, subscription := range m.subscriptions {
+			if subscription.GaiaId == id {
+				delete(m.subscriptions, subscriptionId)
+			}
+		}
+		delete(m.users, id)
+	}
+	return purged, nil
+}
+
+func (m *MemoryStore) MoveUser(gaiaId string, address Address, movedIn time.Time) (residence Residence, err error) {
+	movedIn = movedIn.UTC().Truncate(time.Second)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, current := range m.residences {
+		if current.GaiaId != gaiaId || current.MovedOut != nil {
+			continue
+		}
+		if current.DarId == address.DarId {
+			return residence, ErrDatabaseMoveSame
+		}
+		if !movedIn.After(current.MovedIn) {
+			return residence, ErrDatabaseMoveDate
+		}
+	}
+
+	if address.DarId != "" {
+		m.upsertAddress(&address)
+	}
+	residence = m.recordMove(gaiaId, address.DarId, movedIn)
+	residence.Address = &address
+
+	if user, ok := m.users[gaiaId]; ok {
+		user.DarId = address.DarId
+		m.users[gaiaId] = user
+	}
+	return residence, nil
+}
+
+func (m *MemoryStore) GetResidences(gaiaId string) (residences []Residence, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, residence := range m.residences {
+		if residence.GaiaId == gaiaId {
+			residence.Address = m.address(residence.DarId)
+			residences = append(residences, residence)
+		}
+	}
+	slices.SortFunc(residences, func(a, b Residence) int {
+		return a.MovedIn.Compare(b.MovedIn)
+	})
+	return residences, nil
+}
+
+func (m *MemoryStore) GetResidents(darId string, on time.Time) (users []User, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, residence := range m.residences {
+		if residence.DarId != darId || residence.MovedIn.After(on) || (residence.MovedOut != nil && !residence.MovedOut.After(on)) {
+			continue
+		}
+		if user, ok := m.users[residence.GaiaId]; ok {
+			users = append(users, m.withAddress(user))
+		}
+	}
+	return users, nil
+}
+
+func (m *MemoryStore) GetSubscriptions(gaiaId string) (subscriptions []Subscription, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, subscription := range m.subscriptions {
+		if subscription.GaiaId == gaiaId {
+			subscription.Address = m.address(subscription.DarId)
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	slices.SortFunc(subscriptions, func(a, b Subscription) int {
+		return cmp.Or(a.Start.Compare(b.Start), strings.Compare(a.Id, b.Id))
+	})
+	return subscriptions, nil
+}
+
+func (m *MemoryStore) GetSubscription(gaiaId string, id string) (Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	subscription, ok := m.subscriptions[id]
+	if !ok || subscription.GaiaId != gaiaId {
+		return Subscription{}, nil
+	}
+	subscription.Address = m.address(subscription.DarId)
+	return subscription, nil
+}
+
+func (m *MemoryStore) CreateSubscription(subscription Subscription) (Subscription, error) {
+	if subscription.Id == "" {
+		subscription.Id = uuid.New().String()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.saveSubscription(subscription)
+}
+
+func (m *MemoryStore) UpdateSubscription(subscription Subscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.saveSubscription(subscription)
+	return err
+}
+
+func (m *MemoryStore) DeleteSubscription(gaiaId string, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if subscription, ok := m.subscriptions[id]; ok && subscription.GaiaId == gaiaId {
+		delete(m.subscriptions, id)
+	}
+	return nil
+}
+
+func (m *MemoryStore) ClaimSubscriptions(gaiaId string, darId string) (subscriptions []Subscription, err error) {
+	if darId == "" {
+		return subscriptions, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, subscription := range m.subscriptions {
+		if subscription.DarId != darId || subscription.GaiaId != "" || subscription.Status != SubscriptionPending {
+			continue
+		}
+		subscription.GaiaId = gaiaId
+		subscription.Status = SubscriptionActive
+		subscription.Updated = time.Now().Unix()
+		m.subscriptions[id] = subscription
+		subscriptions = append(subscriptions, subscription)
+	}
+	slices.SortFunc(subscriptions, func(a, b Subscription) int {
+		return cmp.Or(a.Start.Compare(b.Start), strings.Compare(a.Id, b.Id))
+	})
+	return subscriptions, nil
+}
+
+// findUsers returns the users matching, with their address, the oldest first. Deleted users are only unscoped.
+func (m *MemoryStore) findUsers(unscoped bool, match func(User) bool) []User {
+	users := []User{}
+	for _, user := range m.users {
+		if user.Deleted.Valid && !unscoped {
+			continue
+		}
+		user = m.withAddress(user)
+		if match(user) {
+			users = append(users, user)
+		}
+	}
+	slices.SortFunc(users, func(a, b User) int {
+		return compareUsers("users.created", a, b)
+	})
+	return users
+}
+
+// withAddress is Preload("Address"), users are stored without it
+func (m *MemoryStore) withAddress(user User) User {
+	user.Address = m.address(user.DarId)
+	return user
+}
+
+func (m *MemoryStore) address(darId string) *Address {
+	address, ok := m.addresses[darId]
+	if !ok {
+		return nil
+	}
+	return &address
+}
+
+// saveUser is UpdateUserById without the lock, it returns the user as stored
+func (m *MemoryStore) saveUser(user User) User {
+	if user.Address != nil && user.Address.DarId != "" {
+		user.DarId = user.Address.DarId
+		m.upsertAddress(user.Address)
+	}
+
+	stored, ok := m.users[user.GaiaId]
+	if (ok && stored.DarId != user.DarId) || (!ok && user.DarId != "") {
+		m.recordMove(user.GaiaId, user.DarId, time.Now().UTC().Truncate(time.Second))
+	}
+
+	now := time.Now().Unix()
+	if user.Created == 0 {
+		user.Created = stored.Created
+	}
+	if user.Created == 0 {
+		user.Created = now
+	}
+	if !ok && user.Role == "" {
+		user.Role = "customer"
+	}
+	user.Deleted = stored.Deleted
+	user.Updated = now
+
+	address := user.Address
+	user.Address = nil
+	m.users[user.GaiaId] = user
+	user.Address = address
+	return user
+}
+
+func (m *MemoryStore) upsertAddress(address *Address) {
+	now := time.Now().Unix()
+	if stored, ok := m.addresses[address.DarId]; ok {
+		address.Created = stored.Created
+	}
+	if address.Created == 0 {
+		address.Created = now
+	}
+	address.Updated = now
+	m.addresses[address.DarId] = *address
+}
+
+func (m *MemoryStore) recordMove(gaiaId string, darId string, at time.Time) (residence Residence) {
+	for i := range m.residences {
+		if m.residences[i].GaiaId == gaiaId && m.residences[i].MovedOut == nil {
+			movedOut := at
+			m.residences[i].MovedOut = &movedOut
+		}
+	}
+	if darId == "" {
+		return residence
+	}
+
+	m.residenceId++
+	residence = Residence{Id: m.residenceId, GaiaId: gaiaId, DarId: darId, MovedIn: at}
+	m.residences = append(m.residences, residence)
+	return residence
+}
+
+func (m *MemoryStore) saveSubscription(subscription Subscription) (Subscription, error) {
+	if subscription.Address != nil && subscription.Address.DarId != "" {
+		subscription.DarId = subscription.Address.DarId
+		m.upsertAddress(subscription.Address)
+	}
+
+	if subscription.SupplyPointId != "" && subscription.Status != SubscriptionEnded {
+		for _, other := range m.subscriptions {
+			if other.SupplyPointId == subscription.SupplyPointId && other.Status != SubscriptionEnded && other.Id != subscription.Id {
+				return subscription, ErrDatabaseSupplyPoint
+			}
+		}
+	}
+
+	now := time.Now().Unix()
+	stored, ok := m.subscriptions[subscription.Id]
+	if subscription.Created == 0 {
+		subscription.Created = stored.Created
+	}
+	if subscription.Created == 0 {
+		subscription.Created = now
+	}
+	if !ok && subscription.Status == "" {
+		subscription.Status = SubscriptionActive
+	}
+	subscription.Updated = now
+
+	address := subscription.Address
+	subscription.Address = nil
+	m.subscriptions[subscription.Id] = subscription
+	subscription.Address = address
+	return subscription, nil
+}
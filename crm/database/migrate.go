@@ -0,0 +1,358 @@
+package database
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrDatabaseSchemaBehind = errors.New("error: the database schema is behind, run crm migrate up")
+	ErrDatabaseSchemaAhead  = errors.New("error: the database schema is newer than this CRM")
+	ErrDatabaseVersion      = errors.New("error: there is no migration with that version")
+)
+
+/*
+The migrations are numbered SQL files, one set per dialect:
+
+	migrations/sqlite/0002_name.up.sql
+	migrations/sqlite/0002_name.down.sql
+	migrations/postgres/0002_name.up.sql
+	migrations/postgres/0002_name.down.sql
+
+A migration runs in a transaction with the row in schema_version that
+records it. The search index is not part of the schema, it depends on
+how SQLite is built and is rebuilt when the schema is current.
+*/
+//go:embed migrations
+var migrationFiles embed.FS
+
+var dialects = []string{"sqlite", "postgres"}
+
+// Migration is a version of the schema, Applied is nil until the database has it
+type Migration struct {
+	Version int        `json:"version"`
+	Name    string     `json:"name"`
+	Applied *time.Time `json:"applied,omitempty"`
+
+	up   map[string]string // SQL by dialect
+	down map[string]string
+}
+
+var migrations = loadMigrations()
+
+// LatestVersion is the version of the schema this CRM needs
+func LatestVersion() int {
+	return len(migrations)
+}
+
+func loadMigrations() []Migration {
+	byVersion := map[int]*Migration{}
+	err := fs.WalkDir(migrationFiles, "migrations", func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		dialect := path.Base(path.Dir(file))
+		name, direction, ok := strings.Cut(strings.TrimSuffix(path.Base(file), ".sql"), ".")
+		number, name, found := strings.Cut(name, "_")
+		version, err := strconv.Atoi(number)
+		if !ok || !found || err != nil || (direction != "up" && direction != "down") {
+			return fmt.Errorf("%s is not NNNN_name.up.sql or NNNN_name.down.sql", file)
+		}
+
+		sql, err := migrationFiles.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name, up: map[string]string{}, down: map[string]string{}}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return fmt.Errorf("%s: migration %d is named %s", file, version, m.Name)
+		}
+		if direction == "up" {
+			m.up[dialect] = string(sql)
+		} else {
+			m.down[dialect] = string(sql)
+		}
+		return nil
+	})
+
+	// Versions count from 1 without gaps, and every dialect migrates both ways
+	loaded := make([]Migration, len(byVersion))
+	for version := 1; err == nil && version <= len(byVersion); version++ {
+		m, ok := byVersion[version]
+		if !ok {
+			err = fmt.Errorf("migration %d is missing", version)
+			break
+		}
+		for _, dialect := range dialects {
+			if m.up[dialect] == "" || m.down[dialect] == "" {
+				err = fmt.Errorf("migration %04d_%s is missing %s up or down", version, m.Name, dialect)
+			}
+		}
+		loaded[version-1] = *m
+	}
+	if err != nil {
+		panic(errors.Join(ErrDatabaseMigration, err))
+	}
+	return loaded
+}
+
+const createSchemaVersion = `CREATE TABLE IF NOT EXISTS schema_version (
+	version integer PRIMARY KEY,
+	name text NOT NULL,
+	applied timestamp NOT NULL
+)`
+
+// SchemaVersion is the version of the last migration applied, 0 for an empty database
+func (db *UserDatabase) SchemaVersion() (version int, err error) {
+	if !db.db.Migrator().HasTable("schema_version") {
+		return 0, nil
+	}
+	err = db.db.Raw("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version).Error
+	return version, err
+}
+
+// CheckSchema returns an error unless the database has exactly the migrations of this CRM
+func (db *UserDatabase) CheckSchema() error {
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return errors.Join(ErrDatabaseConnection, err)
+	}
+	if version < LatestVersion() {
+		return fmt.Errorf("%w: it is at version %d, CRM needs %d", ErrDatabaseSchemaBehind, version, LatestVersion())
+	}
+	if version > LatestVersion() {
+		return fmt.Errorf("%w: it is at version %d, CRM knows %d", ErrDatabaseSchemaAhead, version, LatestVersion())
+	}
+	return nil
+}
+
+// Migrations returns every migration, with when the database got it
+func (db *UserDatabase) Migrations() ([]Migration, error) {
+	status := make([]Migration, len(migrations))
+	copy(status, migrations)
+	if !db.db.Migrator().HasTable("schema_version") {
+		return status, nil
+	}
+
+	var applied []struct {
+		Version int
+		Applied time.Time
+	}
+	err := db.db.Raw("SELECT version, applied FROM schema_version").Scan(&applied).Error
+	if err != nil {
+		return status, errors.Join(ErrDatabaseConnection, err)
+	}
+	for _, row := range applied {
+		if row.Version >= 1 && row.Version <= len(status) {
+			status[row.Version-1].Applied = &row.Applied
+		}
+	}
+	return status, nil
+}
+
+/*
+MigrateTo applies, or rolls back, migrations one at a time until the
+schema is at version, e.g. LatestVersion(). It returns the migrations
+it applied or rolled back.
+*/
+func (db *UserDatabase) MigrateTo(version int) (done []Migration, err error) {
+	if version < 0 || version > LatestVersion() {
+		return done, ErrDatabaseVersion
+	}
+	dialect := db.db.Dialector.Name()
+
+	err = db.db.Exec(createSchemaVersion).Error
+	if err != nil {
+		return done, errors.Join(ErrDatabaseMigration, err)
+	}
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return done, errors.Join(ErrDatabaseMigration, err)
+	}
+	// Users without a version are from before versioned migrations
+	legacy := current == 0 && db.db.Migrator().HasTable("users")
+
+	for current != version {
+		// Up applies the next migration, down rolls back the current one
+		var m Migration
+		if current < version {
+			m = migrations[current]
+		} else {
+			m = migrations[current-1]
+		}
+
+		err = db.db.Transaction(func(tx *gorm.DB) error {
+			if current > version {
+				err := tx.Exec(m.down[dialect]).Error
+				if err != nil {
+					return err
+				}
+				return tx.Exec("DELETE FROM schema_version WHERE version = ?", m.Version).Error
+			}
+
+			var err error
+			if m.Version == 1 && legacy {
+				err = adoptLegacy(tx, m.up[dialect])
+			} else {
+				err = tx.Exec(m.up[dialect]).Error
+			}
+			if err != nil {
+				return err
+			}
+			return tx.Exec("INSERT INTO schema_version (version, name, applied) VALUES (?, ?, ?)", m.Version, m.Name, time.Now().UTC().Truncate(time.Second)).Error
+		})
+		if err != nil {
+			return done, errors.Join(ErrDatabaseMigration, fmt.Errorf("%04d_%s: %w", m.Version, m.Name, err))
+		}
+
+		done = append(done, m)
+		if current > version {
+			current--
+		} else {
+			current++
+		}
+	}
+
+	if current == LatestVersion() {
+		err = db.setupSearch()
+		if err != nil {
+			return done, errors.Join(ErrDatabaseMigration, err)
+		}
+	}
+	return done, nil
+}
+
+/*
+adoptLegacy brings a database from before versioned migrations to the
+baseline. AutoMigrate made it, so depending on the CRM that made it
+users may miss columns and keep the address in their own row.
+*/
+func adoptLegacy(tx *gorm.DB, baseline string) error {
+	integer := "integer"
+	if tx.Dialector.Name() == "postgres" {
+		integer = "bigint"
+	}
+	columns := [][2]string{
+		{"mitid_uuid", "text"}, {"provider", "text"}, {"subject", "text"}, {"role", "text DEFAULT 'customer'"},
+		{"name", "text"}, {"dar_id", "text"}, {"updated", integer}, {"created", integer},
+	}
+	for _, column := range columns {
+		if tx.Migrator().HasColumn("users", column[0]) {
+			continue
+		}
+		err := tx.Exec("ALTER TABLE users ADD COLUMN " + column[0] + " " + column[1]).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	err := tx.Exec(baseline).Error
+	if err != nil {
+		return err
+	}
+	err = migrateAddresses(tx)
+	if err != nil {
+		return err
+	}
+	return migrateResidences(tx)
+}
+
+// The address columns users had before addresses had a table, after dar_id and text
+var legacyAddressColumns = []string{"street", "number", "floor", "door", "district", "postcode", "city", "municipality_code", "longitude", "latitude"}
+
+/*
+migrateAddresses moves the addresses users had in their own row into
+the addresses table. Users created before addresses were verified only
+have the address text, users verified with DAR also have the structured
+fields. The text of users without a DAR id is kept as an unverified
+address, see UnverifiedAddressPrefix.
+*/
+func migrateAddresses(tx *gorm.DB) error {
+	legacy := tx.Migrator()
+	if !legacy.HasColumn("users", "address") {
+		return nil
+	}
+
+	columns := []string{"dar_id", "text"}
+	values := []string{"dar_id", "address"}
+	for _, column := range legacyAddressColumns {
+		if legacy.HasColumn("users", column) {
+			columns = append(columns, column)
+			values = append(values, column)
+		}
+	}
+
+	// The row updated last has the newest address
+	err := tx.Exec(fmt.Sprintf(`INSERT INTO addresses (%s, created, updated)
+		SELECT %s, created, updated FROM users WHERE dar_id != '' ORDER BY updated DESC
+		ON CONFLICT DO NOTHING`,
+		strings.Join(columns, ", "), strings.Join(values, ", "))).Error
+	if err != nil {
+		return err
+	}
+
+	unverified := "(dar_id IS NULL OR dar_id = '') AND address IS NOT NULL AND address != ''"
+	darId := "'" + UnverifiedAddressPrefix + "' || gaia_id"
+	err = tx.Exec("INSERT INTO addresses (dar_id, text, created, updated) SELECT " + darId + ", address, created, updated FROM users WHERE " + unverified).Error
+	if err != nil {
+		return err
+	}
+	result := tx.Exec("UPDATE users SET dar_id = " + darId + " WHERE " + unverified)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("%d users had an address without a DAR id, it is kept as %s<gaia_id>", result.RowsAffected, UnverifiedAddressPrefix)
+	}
+
+	for _, column := range append([]string{"address"}, legacyAddressColumns...) {
+		if !legacy.HasColumn("users", column) {
+			continue
+		}
+		err = tx.Exec("ALTER TABLE users DROP COLUMN " + column).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+migrateResidences starts a residence for users who had an address
+before residences were recorded. Nobody knows when they moved in, so
+the residence starts when the user was created.
+*/
+func migrateResidences(tx *gorm.DB) error {
+	var users []struct {
+		GaiaId  string
+		DarId   string
+		Created int64
+	}
+	err := tx.Table("users").Select("gaia_id, dar_id, created").
+		Where("dar_id != '' AND gaia_id NOT IN (SELECT gaia_id FROM residences)").
+		Scan(&users).Error
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		_, err := recordMove(tx, user.GaiaId, user.DarId, time.Unix(user.Created, 0).UTC())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
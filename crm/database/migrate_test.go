@@ -0,0 +1,143 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+/*
+migrationChecks check a database right after the migration with the
+version. The database had testdata/NNNN_name.sql loaded at the version
+before, so the checks see what the migration did to existing data.
+*/
+var migrationChecks = map[int]func(is *is.I, db *UserDatabase){
+	1: func(is *is.I, db *UserDatabase) {
+		users, err := db.GetUsersAtAddress("0a3f507a-b2e6-32b8-e044-0003ba298018")
+		is.NoErr(err)
+		is.Equal(len(users), 2)
+		is.Equal(users[0].Address.Text, "Landgreven 10, 1301 København K")
+		is.Equal(users[0].Address.Street, "Landgreven")
+		is.Equal(users[0].Address.City, "København K")
+		is.Equal(users[0].Address.Longitude, 12.5863)
+		is.True(!db.db.Migrator().HasColumn("users", "address"))
+		is.True(!db.db.Migrator().HasColumn("users", "street"))
+
+		// The address without a DAR id is kept, unverified
+		user, err := db.GetUserById("3")
+		is.NoErr(err)
+		is.Equal(user.Name, "Isabelle Stengers")
+		is.Equal(user.Role, "customer")
+		is.Equal(user.DarId, UnverifiedAddressPrefix+"3")
+		is.Equal(user.Address.Text, "Somewhere")
+
+		user, err = db.GetUserById("4")
+		is.NoErr(err)
+		is.True(user.Address == nil)
+
+		// The residence starts when the user was created
+		residences, err := db.GetResidences("1")
+		is.NoErr(err)
+		is.Equal(len(residences), 1)
+		is.Equal(residences[0].MovedIn, time.Unix(1, 0).UTC())
+
+		found, err := db.SearchUsers("latour landgreven", 0)
+		is.NoErr(err)
+		is.Equal(len(found), 1)
+	},
+	2: func(is *is.I, db *UserDatabase) {
+		users, err := db.GetUsers()
+		is.NoErr(err)
+		is.Equal(len(users), 2)
+		is.True(!users[0].Deleted.Valid)
+
+		is.NoErr(db.DeleteUser("1"))
+		users, err = db.GetUsers()
+		is.NoErr(err)
+		is.Equal(len(users), 1)
+		is.Equal(users[0].Name, "Donna Haraway")
+
+		// Rolling back would lose the deleted user before the retention period ends
+		_, err = db.MigrateTo(1)
+		is.True(errors.Is(err, ErrDatabaseMigration))
+		version, err := db.SchemaVersion()
+		is.NoErr(err)
+		is.Equal(version, 2)
+		_, err = db.RestoreUser("1")
+		is.NoErr(err)
+	},
+}
+
+func TestMigrations(t *testing.T) {
+	for _, m := range migrations {
+		t.Run(fmt.Sprintf("%04d_%s", m.Version, m.Name), func(t *testing.T) {
+			forEachDatabase(t, func(t *testing.T, db *UserDatabase) {
+				is := is.New(t)
+				check, ok := migrationChecks[m.Version]
+				is.True(ok) // every migration has a check
+
+				_, err := db.MigrateTo(m.Version - 1)
+				is.NoErr(err)
+				fixture, err := os.ReadFile(filepath.Join("testdata", fmt.Sprintf("%04d_%s.sql", m.Version, m.Name)))
+				is.NoErr(err) // every migration has a fixture
+				is.NoErr(db.db.Exec(string(fixture)).Error)
+
+				done, err := db.MigrateTo(m.Version)
+				is.NoErr(err)
+				is.Equal(len(done), 1)
+				if m.Version < LatestVersion() {
+					// The checks read with the latest code, search needs the latest schema
+					_, err = db.MigrateTo(LatestVersion())
+					is.NoErr(err)
+				}
+				check(is, db)
+
+				// Up again does nothing, down and up again is the same schema
+				done, err = db.MigrateTo(LatestVersion())
+				is.NoErr(err)
+				is.Equal(len(done), 0)
+				_, err = db.MigrateTo(m.Version - 1)
+				is.NoErr(err)
+				version, err := db.SchemaVersion()
+				is.NoErr(err)
+				is.Equal(version, m.Version-1)
+				_, err = db.MigrateTo(LatestVersion())
+				is.NoErr(err)
+			})
+		})
+	}
+}
+
+func TestSchema(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db *UserDatabase) {
+		is := is.New(t)
+
+		is.True(errors.Is(db.CheckSchema(), ErrDatabaseSchemaBehind))
+		status, err := db.Migrations()
+		is.NoErr(err)
+		is.Equal(len(status), LatestVersion())
+		is.True(status[0].Applied == nil)
+
+		done, err := db.MigrateTo(LatestVersion())
+		is.NoErr(err)
+		is.Equal(len(done), LatestVersion())
+		is.NoErr(db.CheckSchema())
+		status, err = db.Migrations()
+		is.NoErr(err)
+		for _, m := range status {
+			is.True(m.Applied != nil)
+		}
+
+		_, err = db.MigrateTo(LatestVersion() + 1)
+		is.True(errors.Is(err, ErrDatabaseVersion))
+
+		// A newer CRM migrated the database
+		is.NoErr(db.db.Exec("INSERT INTO schema_version (version, name, applied) VALUES (?, ?, ?)", LatestVersion()+1, "newer", time.Now()).Error)
+		is.True(errors.Is(db.CheckSchema(), ErrDatabaseSchemaAhead))
+	})
+}
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS subscriptions;
+DROP TABLE IF EXISTS residences;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS addresses;
+DROP TABLE IF EXISTS users_search;
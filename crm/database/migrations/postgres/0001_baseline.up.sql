@@ -0,0 +1,67 @@
+-- The schema AutoMigrate made before migrations were versioned
+CREATE TABLE IF NOT EXISTS addresses (
+	dar_id text,
+	access_address_id text,
+	text text,
+	street text,
+	number text,
+	floor text,
+	door text,
+	district text,
+	postcode text,
+	city text,
+	municipality_code text,
+	longitude double precision,
+	latitude double precision,
+	updated bigint,
+	created bigint,
+	PRIMARY KEY (dar_id)
+);
+CREATE INDEX IF NOT EXISTS idx_addresses_access_address_id ON addresses (access_address_id);
+
+CREATE TABLE IF NOT EXISTS users (
+	mitid_uuid text,
+	gaia_id text,
+	provider text,
+	subject text,
+	role text DEFAULT 'customer',
+	name text,
+	dar_id text,
+	updated bigint,
+	created bigint,
+	PRIMARY KEY (gaia_id)
+);
+CREATE INDEX IF NOT EXISTS idx_users_created ON users (created);
+CREATE INDEX IF NOT EXISTS idx_users_updated ON users (updated);
+CREATE INDEX IF NOT EXISTS idx_users_dar_id ON users (dar_id);
+CREATE INDEX IF NOT EXISTS idx_users_name ON users (name);
+CREATE INDEX IF NOT EXISTS idx_provider_subject ON users (provider, subject);
+
+CREATE TABLE IF NOT EXISTS residences (
+	id bigserial PRIMARY KEY,
+	gaia_id text,
+	dar_id text,
+	moved_in timestamptz,
+	moved_out timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_residences_gaia_id ON residences (gaia_id);
+CREATE INDEX IF NOT EXISTS idx_residences_dar_id ON residences (dar_id);
+CREATE INDEX IF NOT EXISTS idx_residences_moved_in ON residences (moved_in);
+CREATE INDEX IF NOT EXISTS idx_residences_moved_out ON residences (moved_out);
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+	id text,
+	gaia_id text,
+	dar_id text,
+	product text,
+	supply_point_id text,
+	status text DEFAULT 'active',
+	start timestamptz,
+	"end" timestamptz,
+	updated bigint,
+	created bigint,
+	PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_gaia_id ON subscriptions (gaia_id);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_dar_id ON subscriptions (dar_id);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_supply_point_id ON subscriptions (supply_point_id);
@@ -0,0 +1,10 @@
+-- Without deleted_at a deleted user would be live again, and they are kept for the retention period,
+-- so the rollback is refused until every deleted user is restored or purged
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM users WHERE deleted_at IS NOT NULL) THEN
+		RAISE EXCEPTION 'deleted users must be restored or purged before 0002_soft_delete is rolled back';
+	END IF;
+END $$;
+DROP INDEX IF EXISTS idx_users_deleted_at;
+ALTER TABLE users DROP COLUMN deleted_at;
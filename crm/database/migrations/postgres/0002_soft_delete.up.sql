@@ -0,0 +1,3 @@
+-- Deleted users are kept for the retention period, see PurgeUsers
+ALTER TABLE users ADD COLUMN deleted_at timestamptz;
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
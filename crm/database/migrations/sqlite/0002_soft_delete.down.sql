@@ -0,0 +1,9 @@
+-- Without deleted_at a deleted user would be live again, and they are kept for the retention period,
+-- so the rollback is refused until every deleted user is restored or purged
+CREATE TEMP TABLE soft_delete_guard (
+	deleted integer CONSTRAINT "deleted users must be restored or purged before 0002_soft_delete is rolled back" CHECK (deleted = 0)
+);
+INSERT INTO soft_delete_guard SELECT COUNT(*) FROM users WHERE deleted_at IS NOT NULL;
+DROP TABLE soft_delete_guard;
+DROP INDEX IF EXISTS idx_users_deleted_at;
+ALTER TABLE users DROP COLUMN deleted_at;
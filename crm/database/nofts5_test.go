@@ -0,0 +1,6 @@
+//go:build !sqlite_fts5
+
+package database
+
+// The SQLite tests search the plain table, like PostgreSQL does
+const builtWithFTS5 = false
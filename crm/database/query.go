@@ -0,0 +1,228 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrDatabaseSort   = errors.New("error: sort is name, created or updated, with - for descending")
+	ErrDatabaseCursor = errors.New("error: the cursor is not from this query")
+)
+
+// Page sizes for QueryUsers
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// The columns users can be sorted by
+var sortColumns = map[string]string{
+	"name":    "users.name",
+	"created": "users.created",
+	"updated": "users.updated",
+}
+
+/*
+UserQuery filters, sorts and pages the users. The zero value is the
+first page of every user, the oldest first.
+*/
+type UserQuery struct {
+	Name          string //part of the name, case insensitive
+	DarId         string
+	Postcode      string
+	CreatedAfter  int64 //unix time, inclusive
+	CreatedBefore int64 //unix time, exclusive
+	UpdatedAfter  int64
+	UpdatedBefore int64
+	MitID         *bool  //only users with, or without, a MitID UUID
+	Deleted       bool   //only deleted users, e.g. to find one to restore
+	Sort          string //name, created or updated, -name etc. for descending. Defaults to created.
+	Limit         int    //defaults to DefaultPageSize, at most MaxPageSize
+	Cursor        string //Next of the previous page
+}
+
+// UserPage is one page of a UserQuery, Total counts the users on every page
+type UserPage struct {
+	Users []User `json:"users"`
+	Total int64  `json:"total"`
+	Next  string `json:"next,omitempty"` //cursor of the next page, empty on the last page
+}
+
+/*
+cursor is where a page ended: the sort value and the id of the last user.
+Pages continue after it, so users created while paging are neither
+skipped nor repeated.
+*/
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	Id    string `json:"id"`
+}
+
+/*
+QueryUsers returns a page of the users matching the query. Paging uses
+a cursor rather than an offset, so a page deep into tens of thousands of
+users is as cheap as the first.
+*/
+func (db *UserDatabase) QueryUsers(query UserQuery) (page UserPage, err error) {
+	sort, column, descending, limit, err := pageOf(query)
+	if err != nil {
+		return page, err
+	}
+
+	filtered := filterUsers(db.db.Model(&User{}), query)
+	result := filtered.Count(&page.Total)
+	if result.Error != nil {
+		return page, errors.Join(ErrDatabaseGetUser, result.Error)
+	}
+
+	direction, after := "ASC", ">"
+	if descending {
+		direction, after = "DESC", "<"
+	}
+	users := filterUsers(db.db.Preload("Address"), query).
+		Order(column + " " + direction).
+		Order("users.gaia_id " + direction).
+		Limit(limit + 1)
+
+	if query.Cursor != "" {
+		last, err := cursorUser(query.Cursor, sort, column)
+		if err != nil {
+			return page, err
+		}
+		var value any = last.Name
+		switch column {
+		case "users.created":
+			value = last.Created
+		case "users.updated":
+			value = last.Updated
+		}
+		users = users.Where("("+column+" "+after+" ?) OR ("+column+" = ? AND users.gaia_id "+after+" ?)", value, value, last.GaiaId)
+	}
+
+	result = users.Find(&page.Users)
+	if result.Error != nil {
+		return page, errors.Join(ErrDatabaseGetUser, result.Error)
+	}
+
+	nextPage(&page, sort, column, limit)
+	return page, nil
+}
+
+// pageOf checks the sort of the query and applies the page size limits
+func pageOf(query UserQuery) (sort string, column string, descending bool, limit int, err error) {
+	sort = query.Sort
+	if sort == "" {
+		sort = "created"
+	}
+	descending = strings.HasPrefix(sort, "-")
+	column, ok := sortColumns[strings.TrimPrefix(sort, "-")]
+	if !ok {
+		return sort, column, descending, limit, ErrDatabaseSort
+	}
+
+	limit = query.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	limit = min(limit, MaxPageSize)
+	return sort, column, descending, limit, nil
+}
+
+// cursorUser is the last user of the previous page, as far as the cursor knows it
+func cursorUser(s string, sort string, column string) (user User, err error) {
+	c, err := decodeCursor(s)
+	if err != nil || c.Sort != sort {
+		return user, ErrDatabaseCursor
+	}
+
+	user.GaiaId = c.Id
+	switch column {
+	case "users.name":
+		user.Name = c.Value
+	case "users.created":
+		user.Created, err = strconv.ParseInt(c.Value, 10, 64)
+	case "users.updated":
+		user.Updated, err = strconv.ParseInt(c.Value, 10, 64)
+	}
+	if err != nil {
+		return user, ErrDatabaseCursor
+	}
+	return user, nil
+}
+
+// nextPage cuts the page to limit users, one more was read to know if there is a next page
+func nextPage(page *UserPage, sort string, column string, limit int) {
+	if len(page.Users) <= limit {
+		return
+	}
+
+	page.Users = page.Users[:limit]
+	last := page.Users[limit-1]
+	value := last.Name
+	switch column {
+	case "users.created":
+		value = strconv.FormatInt(last.Created, 10)
+	case "users.updated":
+		value = strconv.FormatInt(last.Updated, 10)
+	}
+	page.Next = encodeCursor(cursor{Sort: sort, Value: value, Id: last.GaiaId})
+}
+
+func filterUsers(tx *gorm.DB, query UserQuery) *gorm.DB {
+	if query.Deleted {
+		tx = tx.Unscoped().Where("users.deleted_at IS NOT NULL")
+	}
+	if query.Name != "" {
+		tx = tx.Where("lower(users.name) LIKE ? ESCAPE '\\'", "%"+escapeLike(strings.ToLower(query.Name))+"%")
+	}
+	if query.DarId != "" {
+		tx = tx.Where("users.dar_id = ?", query.DarId)
+	}
+	if query.Postcode != "" {
+		tx = tx.Where("users.dar_id IN (SELECT dar_id FROM addresses WHERE postcode = ?)", query.Postcode)
+	}
+	if query.CreatedAfter != 0 {
+		tx = tx.Where("users.created >= ?", query.CreatedAfter)
+	}
+	if query.CreatedBefore != 0 {
+		tx = tx.Where("users.created < ?", query.CreatedBefore)
+	}
+	if query.UpdatedAfter != 0 {
+		tx = tx.Where("users.updated >= ?", query.UpdatedAfter)
+	}
+	if query.UpdatedBefore != 0 {
+		tx = tx.Where("users.updated < ?", query.UpdatedBefore)
+	}
+	if query.MitID != nil && *query.MitID {
+		tx = tx.Where("users.mitid_uuid != ''")
+	}
+	if query.MitID != nil && !*query.MitID {
+		tx = tx.Where("(users.mitid_uuid = '' OR users.mitid_uuid IS NULL)")
+	}
+	return tx
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (c cursor, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
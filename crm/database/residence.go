@@ -0,0 +1,140 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrDatabaseMoveUser  = errors.New("error moving user in database")
+	ErrDatabaseMoveDate  = errors.New("error moving user, a move must be after the last one")
+	ErrDatabaseMoveSame  = errors.New("error moving user, the user already lives at the address")
+	ErrDatabaseResidence = errors.New("error get residence(s) in database")
+)
+
+/*
+Residence is a period a user lived at an address, from MovedIn up to,
+but not including, MovedOut. A user has at most one residence without
+MovedOut, the address they live at now, and it has the DarId of the
+user. Consumption and invoicing use the periods to know who lived where
+when.
+*/
+type Residence struct {
+	Id       uint       `gorm:"primaryKey" json:"id"`
+	GaiaId   string     `gorm:"index" json:"gaia_id"`
+	DarId    string     `gorm:"index" json:"dar_id"`
+	Address  *Address   `gorm:"foreignKey:DarId;references:DarId" json:"address,omitempty"`
+	MovedIn  time.Time  `gorm:"index" json:"moved_in"`
+	MovedOut *time.Time `gorm:"index" json:"moved_out,omitempty"` //nil while the user lives there
+}
+
+/*
+MoveUser ends the residence the user has now and starts one at address
+on movedIn. The address is stored like saveAddress does, so it must be
+verified with DAR first. A move before the current residence started
+returns ErrDatabaseMoveDate, history is only corrected by support.
+*/
+func (db *UserDatabase) MoveUser(gaiaId string, address Address, movedIn time.Time) (residence Residence, err error) {
+	movedIn = movedIn.UTC().Truncate(time.Second)
+
+	err = db.db.Transaction(func(tx *gorm.DB) error {
+		var current Residence
+		result := tx.Limit(1).Find(&current, "gaia_id = ? AND moved_out IS NULL", gaiaId)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 && current.DarId == address.DarId {
+			return ErrDatabaseMoveSame
+		}
+		if result.RowsAffected > 0 && !movedIn.After(current.MovedIn) {
+			return ErrDatabaseMoveDate
+		}
+
+		user := User{GaiaId: gaiaId, Address: &address}
+		err := db.saveAddress(tx, &user)
+		if err != nil {
+			return err
+		}
+
+		residence, err = recordMove(tx, gaiaId, user.DarId, movedIn)
+		if err != nil {
+			return err
+		}
+		residence.Address = &address
+
+		err = tx.Model(&User{}).Where("gaia_id = ?", gaiaId).Update("dar_id", user.DarId).Error
+		if err != nil {
+			return err
+		}
+		return db.indexUsers(tx, "gaia_id = ?", gaiaId)
+	})
+	if errors.Is(err, ErrDatabaseMoveDate) || errors.Is(err, ErrDatabaseMoveSame) {
+		return residence, err
+	}
+	if err != nil {
+		return residence, errors.Join(ErrDatabaseMoveUser, err)
+	}
+
+	return residence, nil
+}
+
+// GetResidences returns the address history of the user, the earliest first
+func (db *UserDatabase) GetResidences(gaiaId string) (residences []Residence, err error) {
+	result := db.db.Preload("Address").Order("moved_in").Find(&residences, "gaia_id = ?", gaiaId)
+	if result.Error != nil {
+		return residences, errors.Join(ErrDatabaseResidence, result.Error)
+	}
+	return residences, err
+}
+
+/*
+GetResidents returns the users who lived at the address with the DAR id
+on the date. It is history, so users deleted since are included.
+*/
+func (db *UserDatabase) GetResidents(darId string, on time.Time) (users []User, err error) {
+	on = on.UTC()
+	result := db.db.Unscoped().Preload("Address").
+		Joins("JOIN residences ON residences.gaia_id = users.gaia_id").
+		Where("residences.dar_id = ? AND residences.moved_in <= ? AND (residences.moved_out IS NULL OR residences.moved_out > ?)", darId, on, on).
+		Find(&users)
+	if result.Error != nil {
+		return users, errors.Join(ErrDatabaseResidence, result.Error)
+	}
+	return users, err
+}
+
+/*
+trackResidence records a move if the user is saved with another DAR id
+than the one stored, e.g. when the address is changed with PUT
+/users/{id}. The move happens now.
+*/
+func trackResidence(tx *gorm.DB, user User) error {
+	var stored []string
+	err := tx.Model(&User{}).Where("gaia_id = ?", user.GaiaId).Pluck("dar_id", &stored).Error
+	if err != nil {
+		return err
+	}
+	if len(stored) > 0 && stored[0] == user.DarId {
+		return nil
+	}
+	if len(stored) == 0 && user.DarId == "" {
+		return nil
+	}
+
+	_, err = recordMove(tx, user.GaiaId, user.DarId, time.Now().UTC().Truncate(time.Second))
+	return err
+}
+
+// recordMove ends the open residence of the user and starts one at the DAR id, unless the user moved away without a new address
+func recordMove(tx *gorm.DB, gaiaId string, darId string, at time.Time) (residence Residence, err error) {
+	err = tx.Model(&Residence{}).Where("gaia_id = ? AND moved_out IS NULL", gaiaId).Update("moved_out", at).Error
+	if err != nil || darId == "" {
+		return residence, err
+	}
+
+	residence = Residence{GaiaId: gaiaId, DarId: darId, MovedIn: at}
+	err = tx.Omit("Address").Create(&residence).Error
+	return residence, err
+}
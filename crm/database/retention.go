@@ -0,0 +1,105 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrDatabaseRestoreUser     = errors.New("error restoring user in database")
+	ErrDatabaseRestoreConflict = errors.New("error restoring user, another user has the same identity")
+	ErrDatabasePurge           = errors.New("error purging deleted users in database")
+)
+
+/*
+RestoreUser undoes DeleteUser. The user moves back into the address
+they had, from now. The subscriptions that ended stay ended. If the
+customer has onboarded again since, the new user has the identity and
+ErrDatabaseRestoreConflict is returned. An empty user is returned if no
+deleted user has the id.
+*/
+func (db *UserDatabase) RestoreUser(userId string) (user User, err error) {
+	err = db.db.Transaction(func(tx *gorm.DB) error {
+		var deleted User
+		result := tx.Unscoped().Limit(1).Find(&deleted, "gaia_id = ? AND deleted_at IS NOT NULL", userId)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		var taken int64
+		identity := tx.Model(&User{}).Where("(mitid_uuid != '' AND mitid_uuid = ?) OR (subject != '' AND provider = ? AND subject = ?)", deleted.MitIdUUID, deleted.Provider, deleted.Subject)
+		err := identity.Count(&taken).Error
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			return ErrDatabaseRestoreConflict
+		}
+
+		err = tx.Unscoped().Model(&User{}).Where("gaia_id = ?", userId).Update("deleted_at", nil).Error
+		if err != nil {
+			return err
+		}
+		if deleted.DarId != "" {
+			_, err = recordMove(tx, userId, deleted.DarId, time.Now().UTC().Truncate(time.Second))
+			if err != nil {
+				return err
+			}
+		}
+		err = db.indexUsers(tx, "gaia_id = ?", userId)
+		if err != nil {
+			return err
+		}
+		return tx.Preload("Address").Find(&user, "gaia_id = ?", userId).Error
+	})
+	if errors.Is(err, ErrDatabaseRestoreConflict) {
+		return user, err
+	}
+	if err != nil {
+		return user, errors.Join(ErrDatabaseRestoreUser, err)
+	}
+	return user, nil
+}
+
+/*
+PurgeUsers removes the users deleted before deletedBefore for good,
+with their address history and subscriptions. With anonymise the user
+is kept, without the name, identity and address, so the subscriptions
+still count in statistics. It returns how many users were purged.
+*/
+func (db *UserDatabase) PurgeUsers(deletedBefore time.Time, anonymise bool) (purged int64, err error) {
+	err = db.db.Transaction(func(tx *gorm.DB) error {
+		expired := tx.Unscoped().Model(&User{}).Where("deleted_at IS NOT NULL AND deleted_at < ?", deletedBefore.UTC())
+		if anonymise {
+			// Anonymised users are not purged again
+			expired = expired.Where("name != '' OR mitid_uuid != '' OR subject != '' OR dar_id != ''")
+		}
+		var ids []string
+		err := expired.Pluck("gaia_id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		purged = int64(len(ids))
+
+		err = tx.Delete(&Residence{}, "gaia_id IN ?", ids).Error
+		if err != nil {
+			return err
+		}
+		if anonymise {
+			return tx.Unscoped().Model(&User{}).Where("gaia_id IN ?", ids).
+				Updates(map[string]any{"name": "", "mitid_uuid": "", "provider": "", "subject": "", "dar_id": ""}).Error
+		}
+
+		err = tx.Delete(&Subscription{}, "gaia_id IN ?", ids).Error
+		if err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&User{}, "gaia_id IN ?", ids).Error
+	})
+	if err != nil {
+		return 0, errors.Join(ErrDatabasePurge, err)
+	}
+	return purged, nil
+}
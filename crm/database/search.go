@@ -0,0 +1,207 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrDatabaseSearch     = errors.New("error searching users in database")
+	ErrDatabaseSearchFTS5 = errors.New("error: SQLite is built without FTS5, build CRM with -tags sqlite_fts5")
+)
+
+// Used when SearchUsers is called without a limit
+const DefaultSearchLimit = 20
+
+/*
+The search index has a row per user with the normalised name and
+address. It is an FTS5 table when SQLite is built with FTS5, which CRM
+is (go build -tags sqlite_fts5, see CheckSearch). In PostgreSQL it is a
+plain table searched with LIKE, which finds the same users but reads
+every row.
+*/
+const (
+	ftsTable    = "users_fts"
+	searchTable = "users_search"
+)
+
+// CheckSearch returns an error if the database is SQLite without FTS5, CRM is built with -tags sqlite_fts5
+func (db *UserDatabase) CheckSearch() error {
+	if db.db.Dialector.Name() == "sqlite" && !db.fts {
+		return ErrDatabaseSearchFTS5
+	}
+	return nil
+}
+
+// searchIndex is the FTS5 table in SQLite with FTS5, the plain table otherwise, e.g. in PostgreSQL
+func (db *UserDatabase) searchIndex() string {
+	if db.fts {
+		return ftsTable
+	}
+	return searchTable
+}
+
+// Danish letters are spelled out, so "Aabenraa" finds "Åbenrå" and "Soeren" finds "Søren"
+var foldLetters = strings.NewReplacer(
+	"æ", "ae", "ø", "oe", "å", "aa",
+	"ä", "ae", "ö", "oe", "ü", "ue",
+	"é", "e", "è", "e", "ê", "e", "ë", "e",
+	"á", "a", "à", "a", "â", "a",
+	"í", "i", "ì", "i", "î", "i", "ï", "i",
+	"ó", "o", "ò", "o", "ô", "o",
+	"ú", "u", "ù", "u", "û", "u",
+	"ñ", "n", "ç", "c", "ß", "ss",
+)
+
+// searchTerms lowercases, folds and splits text into the words the index holds
+func searchTerms(text string) []string {
+	text = foldLetters.Replace(strings.ToLower(text))
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func searchDocument(user User) string {
+	text := []string{user.Name}
+	if user.Address != nil {
+		text = append(text, user.Address.Text, user.Address.Street, user.Address.Postcode, user.Address.City)
+	}
+	return strings.Join(searchTerms(strings.Join(text, " ")), " ")
+}
+
+/*
+setupSearch creates the search index and fills it if it is missing
+users, e.g. for a database from before search or from a build without
+FTS5.
+*/
+func (db *UserDatabase) setupSearch() error {
+	var err error
+	table := db.searchIndex()
+	rebuild := false
+	if table == ftsTable {
+		err = db.db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS " + ftsTable + " USING fts5(gaia_id UNINDEXED, document, tokenize = 'unicode61 remove_diacritics 2')").Error
+		if err != nil {
+			return err
+		}
+		// A build without FTS5 has changed users since the FTS5 index was written
+		rebuild = db.db.Migrator().HasTable(searchTable)
+	} else {
+		err = db.db.Exec("CREATE TABLE IF NOT EXISTS " + searchTable + " (gaia_id TEXT PRIMARY KEY, document TEXT)").Error
+		if err != nil {
+			return err
+		}
+	}
+
+	var users, indexed int64
+	err = db.db.Model(&User{}).Count(&users).Error
+	if err != nil {
+		return err
+	}
+	err = db.db.Table(table).Count(&indexed).Error
+	if err != nil {
+		return err
+	}
+	if !rebuild && users == indexed {
+		return nil
+	}
+
+	return db.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("DELETE FROM " + table).Error
+		if err != nil {
+			return err
+		}
+		err = db.indexUsers(tx, "1 = 1")
+		if err != nil {
+			return err
+		}
+		if rebuild {
+			return tx.Migrator().DropTable(searchTable)
+		}
+		return nil
+	})
+}
+
+/*
+indexUsers writes the search documents of the users matching the
+condition. It is called in the transaction that changes the users or
+their address.
+*/
+func (db *UserDatabase) indexUsers(tx *gorm.DB, condition string, args ...any) error {
+	var users []User
+	err := tx.Preload("Address").Where(condition, args...).Find(&users).Error
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		err = db.unindexUser(tx, user.GaiaId)
+		if err != nil {
+			return err
+		}
+		err = tx.Exec("INSERT INTO "+db.searchIndex()+" (gaia_id, document) VALUES (?, ?)", user.GaiaId, searchDocument(user)).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *UserDatabase) unindexUser(tx *gorm.DB, gaiaId string) error {
+	return tx.Exec("DELETE FROM "+db.searchIndex()+" WHERE gaia_id = ?", gaiaId).Error
+}
+
+/*
+SearchUsers finds the users whose name or address has words starting
+with every word of the query, e.g. "Latour, Landgreven". The best
+matches come first when the index is an FTS5 table.
+*/
+func (db *UserDatabase) SearchUsers(query string, limit int) (users []User, err error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return users, nil
+	}
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	limit = min(limit, MaxPageSize)
+
+	var ids []string
+	if db.fts {
+		match := make([]string, len(terms))
+		for i, term := range terms {
+			match[i] = `"` + term + `"*`
+		}
+		err = db.db.Raw("SELECT gaia_id FROM "+ftsTable+" WHERE "+ftsTable+" MATCH ? ORDER BY rank LIMIT ?", strings.Join(match, " "), limit).Scan(&ids).Error
+	} else {
+		search := db.db.Table(searchTable).Select("gaia_id")
+		for _, term := range terms {
+			search = search.Where("(' ' || document) LIKE ? ESCAPE '\\'", "% "+escapeLike(term)+"%")
+		}
+		err = search.Order("document").Limit(limit).Scan(&ids).Error
+	}
+	if err != nil {
+		return users, errors.Join(ErrDatabaseSearch, err)
+	}
+
+	var found []User
+	err = db.db.Preload("Address").Find(&found, "gaia_id IN ?", ids).Error
+	if err != nil {
+		return users, errors.Join(ErrDatabaseSearch, err)
+	}
+
+	// In the order of the index
+	byId := make(map[string]User, len(found))
+	for _, user := range found {
+		byId[user.GaiaId] = user
+	}
+	users = make([]User, 0, len(ids))
+	for _, id := range ids {
+		if user, ok := byId[id]; ok {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
@@ -0,0 +1,167 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrDatabaseGetSubscription    = errors.New("error get subscription(s) in database")
+	ErrDatabaseCreateSubscription = errors.New("error creating subscription in database")
+	ErrDatabaseUpdateSubscription = errors.New("error updating subscription in database")
+	ErrDatabaseDeleteSubscription = errors.New("error deleting subscription in database")
+	ErrDatabaseSupplyPoint        = errors.New("error saving subscription, the supply point has another subscription")
+)
+
+// Subscription statuses
+const (
+	SubscriptionPending = "pending" //loaded before the customer has a Gaia user
+	SubscriptionActive  = "active"
+	SubscriptionEnded   = "ended"
+)
+
+/*
+Subscription is a product delivered to a supply point at an address,
+e.g. electricity to a metering point. It is what the invoice and data
+audiences of a user token are about.
+
+Subscriptions can be loaded before the customer has a Gaia user. They
+are pending without a GaiaId, and the user who onboards with the same
+DAR id claims them.
+*/
+type Subscription struct {
+	Id            string     `gorm:"primaryKey" json:"id"`
+	GaiaId        string     `gorm:"index" json:"gaia_id,omitempty"`
+	DarId         string     `gorm:"index" json:"dar_id"`
+	Address       *Address   `gorm:"foreignKey:DarId;references:DarId" json:"address,omitempty"`
+	Product       string     `json:"product"`
+	SupplyPointId string     `gorm:"index" json:"supply_point_id,omitempty"` //e.g. the GSRN of an electricity metering point
+	Status        string     `gorm:"default:active" json:"status"`           //pending, active or ended
+	Start         time.Time  `json:"start"`
+	End           *time.Time `json:"end,omitempty"`
+	Updated       int64      `gorm:"autoUpdateTime" json:"updated_at"`
+	Created       int64      `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// GetSubscriptions returns the subscriptions of the user, the earliest first
+func (db *UserDatabase) GetSubscriptions(gaiaId string) (subscriptions []Subscription, err error) {
+	result := db.db.Preload("Address").Order("start").Find(&subscriptions, "gaia_id = ?", gaiaId)
+	if result.Error != nil {
+		return subscriptions, errors.Join(ErrDatabaseGetSubscription, result.Error)
+	}
+	return subscriptions, err
+}
+
+// GetSubscription returns an empty subscription if the user has none with the id.
+// Pending subscriptions have no user, they are found with gaiaId "".
+func (db *UserDatabase) GetSubscription(gaiaId string, id string) (subscription Subscription, err error) {
+	result := db.db.Preload("Address").Find(&subscription, "gaia_id = ? AND id = ?", gaiaId, id)
+	if result.Error != nil {
+		return subscription, errors.Join(ErrDatabaseGetSubscription, result.Error)
+	}
+	return subscription, err
+}
+
+/*
+CreateSubscription stores the subscription and its address. The address
+must be verified with DAR first. A supply point only has one subscription
+that has not ended.
+*/
+func (db *UserDatabase) CreateSubscription(subscription Subscription) (Subscription, error) {
+	if subscription.Id == "" {
+		subscription.Id = uuid.New().String()
+	}
+
+	err := db.db.Transaction(func(tx *gorm.DB) error {
+		return db.saveSubscription(tx, &subscription)
+	})
+	if errors.Is(err, ErrDatabaseSupplyPoint) {
+		return subscription, err
+	}
+	if err != nil {
+		return subscription, errors.Join(ErrDatabaseCreateSubscription, err)
+	}
+	return subscription, nil
+}
+
+func (db *UserDatabase) UpdateSubscription(subscription Subscription) error {
+	err := db.db.Transaction(func(tx *gorm.DB) error {
+		return db.saveSubscription(tx, &subscription)
+	})
+	if errors.Is(err, ErrDatabaseSupplyPoint) {
+		return err
+	}
+	if err != nil {
+		return errors.Join(ErrDatabaseUpdateSubscription, err)
+	}
+	return nil
+}
+
+func (db *UserDatabase) DeleteSubscription(gaiaId string, id string) error {
+	result := db.db.Delete(&Subscription{}, "gaia_id = ? AND id = ?", gaiaId, id)
+	if result.Error != nil {
+		return errors.Join(ErrDatabaseDeleteSubscription, result.Error)
+	}
+	return nil
+}
+
+/*
+ClaimSubscriptions gives the user the pending subscriptions at the
+address with the DAR id and activates them. Only the exact DAR id
+matches, an access address does not claim the subscriptions of every
+apartment behind it.
+*/
+func (db *UserDatabase) ClaimSubscriptions(gaiaId string, darId string) (subscriptions []Subscription, err error) {
+	if darId == "" {
+		return subscriptions, nil
+	}
+
+	err = db.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Find(&subscriptions, "dar_id = ? AND gaia_id = '' AND status = ?", darId, SubscriptionPending).Error
+		if err != nil || len(subscriptions) == 0 {
+			return err
+		}
+
+		ids := make([]string, len(subscriptions))
+		for i := range subscriptions {
+			ids[i] = subscriptions[i].Id
+			subscriptions[i].GaiaId = gaiaId
+			subscriptions[i].Status = SubscriptionActive
+		}
+		return tx.Model(&Subscription{}).Where("id IN ?", ids).
+			Updates(map[string]any{"gaia_id": gaiaId, "status": SubscriptionActive}).Error
+	})
+	if err != nil {
+		return subscriptions, errors.Join(ErrDatabaseUpdateSubscription, err)
+	}
+	return subscriptions, nil
+}
+
+func (db *UserDatabase) saveSubscription(tx *gorm.DB, subscription *Subscription) error {
+	if subscription.Address != nil && subscription.Address.DarId != "" {
+		subscription.DarId = subscription.Address.DarId
+		err := db.upsertAddress(tx, subscription.Address)
+		if err != nil {
+			return err
+		}
+	}
+
+	if subscription.SupplyPointId != "" && subscription.Status != SubscriptionEnded {
+		var taken int64
+		err := tx.Model(&Subscription{}).
+			Where("supply_point_id = ? AND status != ? AND id != ?", subscription.SupplyPointId, SubscriptionEnded, subscription.Id).
+			Count(&taken).Error
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			return ErrDatabaseSupplyPoint
+		}
+	}
+
+	return tx.Omit(clause.Associations).Save(subscription).Error
+}
@@ -0,0 +1,9 @@
+-- Users kept their address in their own row before addresses had a table, and had no residences
+CREATE TABLE users (mitid_uuid text, gaia_id text PRIMARY KEY, role text DEFAULT 'customer',
+	name text, address text, dar_id text, street text, postcode text, city text, longitude real, updated integer, created integer);
+
+INSERT INTO users (gaia_id, name, address, dar_id, street, postcode, city, longitude, updated, created) VALUES
+	('1', 'Bruno Latour', 'Landgreven 10, 1301 København K', '0a3f507a-b2e6-32b8-e044-0003ba298018', 'Landgreven', '1301', 'København K', 12.5863, 2, 1),
+	('2', 'Donna Haraway', 'Landgreven 10, 1301 København K', '0a3f507a-b2e6-32b8-e044-0003ba298018', 'Landgreven', '1301', 'København K', 12.5863, 1, 1),
+	('3', 'Isabelle Stengers', 'Somewhere', '', '', '', '', 0, 1, 1),
+	('4', 'Michel Serres', '', '', '', '', '', 0, 1, 1);
@@ -0,0 +1,4 @@
+-- Users deleted before soft delete are gone, so every user is live
+INSERT INTO users (gaia_id, name, role, dar_id, updated, created) VALUES
+	('1', 'Bruno Latour', 'customer', '', 1, 1),
+	('2', 'Donna Haraway', 'admin', '', 1, 1);
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/henrikkorsgaard/gaia/auth/tokens"
+)
+
+var (
+	ErrAccessOtherUser  = errors.New("error: customers may only access their own record")
+	ErrAccessRoleChange = errors.New("error: only admins may change the role of a user")
+	ErrAccessMove       = errors.New("error: customers change their address with POST /users/{id}/moves")
+)
+
+/*
+access requires a Gaia token for crm with scope, and one of roles if
+any are given. Customers only get through to /users/{id} with their own
+id, staff and services may work on every user.
+*/
+func access(validator *tokens.Validator, scope string, roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return validator.Require("crm", scope)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, _ := tokens.ClaimsFromContext(r.Context())
+
+			err := tokens.RequireRole(claims, roles...)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+
+			id := r.PathValue("id")
+			if id != "" && !claims.IsStaff() && claims.Subject != id {
+				http.Error(w, ErrAccessOtherUser.Error(), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
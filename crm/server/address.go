@@ -0,0 +1,57 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/henrikkorsgaard/gaia/crm/dar"
+	"github.com/henrikkorsgaard/gaia/crm/database"
+)
+
+/*
+verifyAddress looks up the DAR id of the user and replaces the address
+with the verified one. Whatever address text the client sent is
+ignored, DAR decides how the address is written.
+*/
+func verifyAddress(addresses *dar.Client, user *database.User) error {
+	address, err := lookupAddress(addresses, user.DarId)
+	if err != nil {
+		return err
+	}
+
+	user.DarId = address.DarId
+	user.Address = address
+	return nil
+}
+
+// lookupAddress returns the address DAR has for the DAR id
+func lookupAddress(addresses *dar.Client, darId string) (*database.Address, error) {
+	a, err := addresses.Lookup(darId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &database.Address{
+		DarId:            a.DarId,
+		AccessAddressId:  a.AccessAddressId,
+		Text:             a.Text,
+		Street:           a.Street,
+		Number:           a.Number,
+		Floor:            a.Floor,
+		Door:             a.Door,
+		District:         a.District,
+		Postcode:         a.Postcode,
+		City:             a.City,
+		MunicipalityCode: a.MunicipalityCode,
+		Longitude:        a.Longitude,
+		Latitude:         a.Latitude,
+	}, nil
+}
+
+// addressStatus is 422 for an address DAR does not know, and 502 when DAR cannot be reached
+func addressStatus(err error) int {
+	if errors.Is(err, dar.ErrAddressUnavailable) {
+		return http.StatusBadGateway
+	}
+	return http.StatusUnprocessableEntity
+}
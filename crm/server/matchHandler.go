@@ -4,18 +4,19 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/henrikkorsgaard/gaia/crm/dar"
 	"github.com/henrikkorsgaard/gaia/crm/database"
 )
 
 var (
-	ErrMatchMissingMitIdUUID = "error: missing mitid_uuid. unable to match without mitid_uuid."
+	ErrMatchMissingIdentity = "error: missing mitid_uuid or provider and subject. unable to match."
 )
 
 /*
 	matchHandler will return a user with an id OR 404 if unable to match
 */
 
-func matchHandler(db *database.UserDatabase) http.Handler {
+func matchHandler(db database.UserStore, addresses *dar.Client) http.Handler {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			if r.Method == http.MethodPost {
@@ -23,29 +24,70 @@ func matchHandler(db *database.UserDatabase) http.Handler {
 				json.NewDecoder(r.Body).Decode(&userRequest)
 
 				/*
-					We always need the MitIdUUID.
+					We always need an identity, either the MitIdUUID or the provider and subject.
 					- To match an existing user
 					- OR to create a new user with address
 				*/
-				if userRequest.MitIdUUID == "" {
-					//400: Missing mitid_uuid
-					http.Error(w, ErrMatchMissingMitIdUUID, http.StatusBadRequest)
+				hasSubject := userRequest.Provider != "" && userRequest.Subject != ""
+				if userRequest.MitIdUUID == "" && !hasSubject {
+					//400: Missing identity
+					http.Error(w, ErrMatchMissingIdentity, http.StatusBadRequest)
 					return
 				}
 
-				// Initial Mitid match
-				user, err := db.GetUserMitIDUUID(userRequest.MitIdUUID)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
+				var user database.User
+				var err error
+
+				// Provider match
+				if hasSubject {
+					user, err = db.GetUserBySubject(userRequest.Provider, userRequest.Subject)
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+						return
+					}
+				}
+
+				// Mitid match, e.g. a user created before we recorded provider and subject
+				if user.GaiaId == "" && userRequest.MitIdUUID != "" {
+					user, err = db.GetUserMitIDUUID(userRequest.MitIdUUID)
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+						return
+					}
+				}
+
+				// Record which provider and subject the user was matched on
+				if user.GaiaId != "" && hasSubject && (user.Provider != userRequest.Provider || user.Subject != userRequest.Subject) {
+					user.Provider = userRequest.Provider
+					user.Subject = userRequest.Subject
+					err = db.UpdateUserById(user)
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+						return
+					}
 				}
 
 				if user.GaiaId == "" && userRequest.DarId != "" {
+					// The address comes from the browser during onboarding, so it is only trusted once DAR knows it
+					userRequest.Address = nil
+					err = verifyAddress(addresses, &userRequest)
+					if err != nil {
+						http.Error(w, err.Error(), addressStatus(err))
+						return
+					}
+
 					user, err = db.CreateUser(userRequest)
 					if err != nil {
 						http.Error(w, err.Error(), http.StatusInternalServerError)
 						return
 					}
+
+					// Subscriptions loaded for the address before the user onboarded, only a new user claims them
+					_, err = db.ClaimSubscriptions(user.GaiaId, user.DarId)
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+						return
+					}
 				}
 
 				// Check if any match was succesful and return user
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/henrikkorsgaard/gaia/crm/dar"
+	"github.com/henrikkorsgaard/gaia/crm/database"
+)
+
+var (
+	ErrMoveMissingAddress = errors.New("error: a move needs the dar_id of the new address")
+	ErrMoveFuture         = errors.New("error: moves are recorded when they have happened")
+	ErrDate               = errors.New("error: dates are YYYY-MM-DD or RFC 3339")
+)
+
+type moveRequest struct {
+	DarId   string `json:"dar_id"`
+	MovedIn string `json:"moved_in"` //YYYY-MM-DD or RFC 3339, defaults to now
+}
+
+/*
+moveHandler records that a user moved to another address.
+
+	POST /users/{id}/moves  {"dar_id": "...", "moved_in": "2025-03-01"}
+	GET  /users/{id}/moves  the address history of the user
+*/
+func moveHandler(db database.UserStore, addresses *dar.Client) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			id := r.PathValue("id")
+
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+			if r.Method == http.MethodGet {
+				residences, err := db.GetResidences(id)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(residences)
+				return
+			}
+
+			if r.Method == http.MethodPost {
+				var move moveRequest
+				json.NewDecoder(r.Body).Decode(&move)
+				if move.DarId == "" {
+					http.Error(w, ErrMoveMissingAddress.Error(), http.StatusBadRequest)
+					return
+				}
+
+				movedIn, err := parseDate(move.MovedIn, time.Now())
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if movedIn.After(time.Now()) {
+					http.Error(w, ErrMoveFuture.Error(), http.StatusBadRequest)
+					return
+				}
+
+				user, err := db.GetUserById(id)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if user.GaiaId == "" {
+					http.Error(w, ErrUserNotFound.Error(), http.StatusNotFound)
+					return
+				}
+
+				user.DarId = move.DarId
+				err = verifyAddress(addresses, &user)
+				if err != nil {
+					http.Error(w, err.Error(), addressStatus(err))
+					return
+				}
+
+				residence, err := db.MoveUser(id, *user.Address, movedIn)
+				if errors.Is(err, database.ErrDatabaseMoveDate) || errors.Is(err, database.ErrDatabaseMoveSame) {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(residence)
+				return
+			}
+
+			http.Error(w, "", http.StatusMethodNotAllowed)
+		},
+	)
+}
+
+/*
+residentHandler answers who lived at an address on a date, e.g. for
+invoicing the consumption at the address.
+
+	GET /addresses/{darid}/residents?on=2025-03-01
+*/
+func residentHandler(db database.UserStore) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			on, err := parseDate(r.URL.Query().Get("on"), time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			users, err := db.GetResidents(r.PathValue("darid"), on)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(users)
+		},
+	)
+}
+
+// parseDate reads a date as the start of the day in UTC, or a time in RFC 3339. Empty is fallback.
+func parseDate(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, ErrDate
+	}
+	return t, nil
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/henrikkorsgaard/gaia/crm/database"
+)
+
+// The Danish Bookkeeping Act keeps records for 5 years
+const (
+	DefaultRetention     = 5 * 365 * 24 * time.Hour
+	DefaultPurgeInterval = 24 * time.Hour
+)
+
+/*
+RunPurge purges the users deleted longer than USER_RETENTION ago, right
+away and then every PURGE_INTERVAL, until ctx is done. A failed purge is
+logged and tried again at the next interval.
+*/
+func RunPurge(ctx context.Context, db database.UserStore, config Config) {
+	retention := config.USER_RETENTION
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	interval := config.PURGE_INTERVAL
+	if interval <= 0 {
+		interval = DefaultPurgeInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purged, err := db.PurgeUsers(time.Now().Add(-retention), config.PURGE_ANONYMISE)
+		if err != nil {
+			log.Printf("purge: %v", err)
+		}
+		if purged > 0 {
+			log.Printf("purge: purged %d users deleted more than %v ago", purged, retention)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -3,7 +3,12 @@ package server
 import (
 	"net/http"
 	"slices"
+	"time"
 
+	"github.com/henrikkorsgaard/gaia/auth/clients"
+	"github.com/henrikkorsgaard/gaia/auth/jwks"
+	"github.com/henrikkorsgaard/gaia/auth/tokens"
+	"github.com/henrikkorsgaard/gaia/crm/dar"
 	"github.com/henrikkorsgaard/gaia/crm/database"
 )
 
@@ -13,10 +18,25 @@ var originAllowlist = []string{
 	"http://localhost:8000",
 }
 
+type Config struct {
+	//Auth gateway, publishes the keys Gaia tokens are verified with and logs deleted users out. Without it every token is rejected.
+	AUTH_SERVER string `env:"AUTH_SERVER"`
+	//Client credentials of CRM in the SERVICE_CLIENTS of the auth server
+	CLIENT_ID     string `env:"CLIENT_ID"`
+	CLIENT_SECRET string `env:"CLIENT_SECRET"`
+	//DAWA API addresses are verified with, defaults to Dataforsyningen
+	DAR_SERVER    string        `env:"DAR_SERVER"`
+	DAR_CACHE_TTL time.Duration `env:"DAR_CACHE_TTL"`
+	//Deleted users are kept this long for bookkeeping, then purged every PURGE_INTERVAL, by default 5 years and daily
+	USER_RETENTION  time.Duration `env:"USER_RETENTION"`
+	PURGE_INTERVAL  time.Duration `env:"PURGE_INTERVAL"`
+	PURGE_ANONYMISE bool          `env:"PURGE_ANONYMISE"` //keep purged users without name, identity and address
+}
+
 // Pattern adopted from https://grafana.com/blog/2024/02/09/how-i-write-http-services-in-go-after-13-years/
-func NewServer(db *database.UserDatabase) http.Handler {
+func NewServer(db database.UserStore, config Config) http.Handler {
 
-	var handler http.Handler = addRoutes(db)
+	var handler http.Handler = addRoutes(db, config)
 	// we want cors check first, because that is the simplest access check
 	handler = checkCORS(handler)
 
@@ -24,13 +44,36 @@ func NewServer(db *database.UserDatabase) http.Handler {
 }
 
 // refactored into independent route function to aid testing
-func addRoutes(db *database.UserDatabase) *http.ServeMux {
+func addRoutes(db database.UserStore, config Config) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.Handle("/healthy", healthy())
 	//Returns JSON
-	mux.Handle("/users/{id}", userIdHandler(db)) //GET, PUT, POST, DELETE
-	mux.Handle("/users", userHandler(db))        //GET List
-	mux.Handle("/match", matchHandler(db))
+	// Every user route requires a Gaia token. Without an auth server the keys cannot be fetched and every token is rejected.
+	validator := tokens.NewValidator(jwks.NewRemoteKeySet(config.AUTH_SERVER+"/.well-known/jwks.json", nil))
+	serviceTokens := clients.NewTokenSource(config.AUTH_SERVER, config.CLIENT_ID, config.CLIENT_SECRET, "sessions:revoke")
+	addresses := dar.NewClient(config.DAR_SERVER, config.DAR_CACHE_TTL)
+	mux.Handle("GET /users/{id}", access(validator, "crm:read")(userIdHandler(db, addresses, serviceTokens, config)))
+	mux.Handle("PUT /users/{id}", access(validator, "crm:write")(userIdHandler(db, addresses, serviceTokens, config)))
+	mux.Handle("DELETE /users/{id}", access(validator, "crm:delete", tokens.RoleAdmin, tokens.RoleService)(userIdHandler(db, addresses, serviceTokens, config)))
+	mux.Handle("POST /users/{id}/restore", access(validator, "crm:delete", tokens.RoleAdmin, tokens.RoleService)(restoreHandler(db)))
+	mux.Handle("GET /users/{id}/moves", access(validator, "crm:read")(moveHandler(db, addresses)))
+	mux.Handle("POST /users/{id}/moves", access(validator, "crm:write")(moveHandler(db, addresses)))
+	mux.Handle("GET /users/{id}/subscriptions", access(validator, "crm:read")(subscriptionHandler(db, addresses)))
+	mux.Handle("POST /users/{id}/subscriptions", access(validator, "crm:write", tokens.RoleAdmin, tokens.RoleService)(subscriptionHandler(db, addresses)))
+	mux.Handle("GET /users/{id}/subscriptions/{subscription}", access(validator, "crm:read")(subscriptionIdHandler(db, addresses)))
+	mux.Handle("PUT /users/{id}/subscriptions/{subscription}", access(validator, "crm:write", tokens.RoleAdmin, tokens.RoleService)(subscriptionIdHandler(db, addresses)))
+	mux.Handle("DELETE /users/{id}/subscriptions/{subscription}", access(validator, "crm:delete", tokens.RoleAdmin, tokens.RoleService)(subscriptionIdHandler(db, addresses)))
+	// Subscriptions loaded before the customer has a user, claimed by DAR id when they onboard
+	mux.Handle("POST /subscriptions", access(validator, "crm:write", tokens.RoleAdmin, tokens.RoleService)(subscriptionHandler(db, addresses)))
+	mux.Handle("GET /subscriptions/{subscription}", access(validator, "crm:read", tokens.RoleAdmin, tokens.RoleService)(subscriptionIdHandler(db, addresses)))
+	mux.Handle("PUT /subscriptions/{subscription}", access(validator, "crm:write", tokens.RoleAdmin, tokens.RoleService)(subscriptionIdHandler(db, addresses)))
+	mux.Handle("DELETE /subscriptions/{subscription}", access(validator, "crm:delete", tokens.RoleAdmin, tokens.RoleService)(subscriptionIdHandler(db, addresses)))
+	mux.Handle("GET /addresses/{darid}/residents", access(validator, "crm:read", tokens.RoleSupport, tokens.RoleAdmin, tokens.RoleService)(residentHandler(db)))
+	mux.Handle("GET /users", access(validator, "crm:list", tokens.RoleSupport, tokens.RoleAdmin, tokens.RoleService)(userHandler(db, addresses)))
+	mux.Handle("GET /users/search", access(validator, "crm:list", tokens.RoleSupport, tokens.RoleAdmin, tokens.RoleService)(searchHandler(db)))
+	mux.Handle("POST /users", access(validator, "crm:write", tokens.RoleAdmin, tokens.RoleService)(userHandler(db, addresses)))
+	// Matching creates users, only the auth server and other services may do it
+	mux.Handle("POST /match", access(validator, "crm:match", tokens.RoleService)(matchHandler(db, addresses)))
 	mux.Handle("/", viewHandler(db))
 	return mux
 }
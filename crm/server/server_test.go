@@ -1,42 +1,120 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/henrikkorsgaard/gaia/auth/tokens"
+	"github.com/henrikkorsgaard/gaia/crm/dar/fixture"
 	"github.com/henrikkorsgaard/gaia/crm/database"
 	"github.com/matryer/is"
 )
 
-var testdb = "test.db"
+// newAuthServer publishes keys and issues service tokens like the auth gateway, and records the users whose sessions CRM revokes
+func newAuthServer(keys *tokens.KeyRing) (*httptest.Server, *[]string) {
+	revoked := &[]string{}
+	validator := tokens.NewValidator(keys)
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/.well-known/jwks.json" {
+			set, _ := keys.JWKS()
+			json.NewEncoder(w).Encode(set)
+			return
+		}
+		if r.URL.Path == "/oauth/token" {
+			id, secret, _ := r.BasicAuth()
+			if id != testConfig.CLIENT_ID || secret != testConfig.CLIENT_SECRET {
+				http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+				return
+			}
+			token, _ := tokens.NewServiceToken(id, []string{"auth"}, r.FormValue("scope"), keys)
+			json.NewEncoder(w).Encode(map[string]any{"access_token": token, "token_type": "Bearer", "expires_in": 900})
+			return
+		}
+		if gaiaId, ok := strings.CutPrefix(r.URL.Path, "/account/sessions/"); ok && r.Method == http.MethodDelete {
+			_, err := validator.Check(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), "auth", "sessions:revoke")
+			if err != nil {
+				http.Error(w, err.Error(), tokens.StatusCode(err))
+				return
+			}
+			*revoked = append(*revoked, gaiaId)
+			fmt.Fprint(w, `{"revoked": 1}`)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	return auth, revoked
+}
+
+var testConfig = Config{CLIENT_ID: "crm", CLIENT_SECRET: "crmsecret"}
+
+// Addresses are verified against the fixture, not Dataforsyningen
+func TestMain(m *testing.M) {
+	addresses := fixture.NewServer()
+	testConfig.DAR_SERVER = addresses.URL
+	code := m.Run()
+	addresses.Close()
+	os.Exit(code)
+}
+
+// withAuthServer is testConfig with the auth server
+func withAuthServer(auth *httptest.Server) Config {
+	config := testConfig
+	config.AUTH_SERVER = auth.URL
+	return config
+}
+
+// newTestServer serves CRM with a fake auth server, and signs tokens with its keys
+func newTestServer(is *is.I, db database.UserStore) (ts *httptest.Server, sign func(gaiaId string, role string) string, close func()) {
+	keys, err := tokens.NewKeyRing("ES256")
+	is.NoErr(err)
+	auth, _ := newAuthServer(keys)
+	ts = httptest.NewServer(addRoutes(db, withAuthServer(auth)))
+
+	sign = func(gaiaId string, role string) string {
+		token, err := tokens.NewUserToken(gaiaId, role, keys)
+		is.NoErr(err)
+		return token
+	}
+	return ts, sign, func() {
+		ts.Close()
+		auth.Close()
+	}
+}
 
 func TestGetUser(t *testing.T) {
-	defer cleanup()
 	is := is.New(t)
 
-	db := database.New(testdb)
+	db := database.NewMemoryStore()
 	id := uuid.New().String()
 	u1 := database.User{
-		GaiaId:  id, // This allow us to take control of the user creation
-		Name:    "Bruno Latour",
-		Address: "Landgreven 10, 1301 København K",
-		DarId:   "0a3f507a-b2e6-32b8-e044-0003ba298018",
+		GaiaId: id, // This allow us to take control of the user creation
+		Name:   "Bruno Latour",
+		DarId:  "0a3f507a-b2e6-32b8-e044-0003ba298018",
 	}
 	_, err := db.CreateUser(u1)
 	is.NoErr(err)
 
-	ts := httptest.NewServer(addRoutes(db))
-	defer ts.Close()
+	ts, sign, close := newTestServer(is, db)
+	defer close()
 
 	client := ts.Client()
-	r, err := client.Get(fmt.Sprintf("%v/users/%s", ts.URL, id))
+	req, err := http.NewRequest("GET", fmt.Sprintf("%v/users/%s", ts.URL, id), nil)
+	is.NoErr(err)
+	req.Header.Set("Authorization", "Bearer "+sign(id, tokens.RoleCustomer))
+	r, err := client.Do(req)
 	is.NoErr(err)
+	is.Equal(r.StatusCode, http.StatusOK)
 
 	var u2 database.User
 	json.NewDecoder(r.Body).Decode(&u2)
@@ -46,17 +124,20 @@ func TestGetUser(t *testing.T) {
 }
 
 func TestCreateUser(t *testing.T) {
-	defer cleanup()
 	is := is.New(t)
 
-	db := database.New(testdb)
-	ts := httptest.NewServer(addRoutes(db))
-	defer ts.Close()
+	db := database.NewMemoryStore()
+	ts, sign, close := newTestServer(is, db)
+	defer close()
 	client := ts.Client()
 
 	var data = `{"name":"Bruno Latour", "address": "Landgreven 10, 1301 København K", "dar_id": "0a3f507a-b2e6-32b8-e044-0003ba298018"}`
-	_, err := client.Post(fmt.Sprintf("%v/users", ts.URL), "application/json", strings.NewReader(data))
+	req, err := http.NewRequest("POST", fmt.Sprintf("%v/users", ts.URL), strings.NewReader(data))
+	is.NoErr(err)
+	req.Header.Set("Authorization", "Bearer "+sign(uuid.New().String(), tokens.RoleService))
+	r, err := client.Do(req)
 	is.NoErr(err)
+	is.Equal(r.StatusCode, http.StatusCreated)
 
 	users, err := db.GetUsers()
 	is.NoErr(err)
@@ -64,60 +145,316 @@ func TestCreateUser(t *testing.T) {
 }
 
 func TestUpdateUser(t *testing.T) {
-	defer cleanup()
 	is := is.New(t)
 
-	db := database.New(testdb)
+	db := database.NewMemoryStore()
 
 	id := uuid.New().String()
 	u1 := database.User{
-		GaiaId:  id,
-		Name:    "Bruno Latour",
-		Address: "Landgreven 10, 1301 København K",
-		DarId:   "0a3f507a-b2e6-32b8-e044-0003ba298018",
+		GaiaId: id,
+		Name:   "Bruno Latour",
+		DarId:  "0a3f507a-b2e6-32b8-e044-0003ba298018",
 	}
 
 	_, err := db.CreateUser(u1)
 	is.NoErr(err)
 
-	ts := httptest.NewServer(addRoutes(db))
-	defer ts.Close()
+	ts, sign, close := newTestServer(is, db)
+	defer close()
 	client := ts.Client()
 
 	var data = `{"gaia_id":"` + id + `", "name":"Bruno Latour", "address": "Constantin Hansens Gade 12, 1799 København V", "dar_id": "45380a0c-9ad1-4370-84d2-50fc574b2063"}`
 	req, err := http.NewRequest("PUT", fmt.Sprintf("%v/users/%s", ts.URL, id), strings.NewReader(data))
 	is.NoErr(err)
+	req.Header.Set("Authorization", "Bearer "+sign(id, tokens.RoleCustomer))
 
+	// Customers move, staff correct the address
 	r, err := client.Do(req)
 	is.NoErr(err)
+	is.Equal(r.StatusCode, http.StatusForbidden)
+
+	req, err = http.NewRequest("PUT", fmt.Sprintf("%v/users/%s", ts.URL, id), strings.NewReader(data))
+	is.NoErr(err)
+	req.Header.Set("Authorization", "Bearer "+sign(uuid.New().String(), tokens.RoleAdmin))
+	r, err = client.Do(req)
+	is.NoErr(err)
 	is.Equal(r.StatusCode, http.StatusOK)
 
 	users, err := db.GetUsers()
 	is.NoErr(err)
-	is.Equal("Constantin Hansens Gade 12, 1799 København V", users[0].Address)
+	is.Equal("Constantin Hansens Gade 12, 1799 København V", users[0].Address.Text)
+}
+
+func TestUpdateUserScope(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+
+	id := uuid.New().String()
+	_, err := db.CreateUser(database.User{GaiaId: id, Name: "Bruno Latour"})
+	is.NoErr(err)
+
+	keys, err := tokens.NewKeyRing("ES256")
+	is.NoErr(err)
+	auth, _ := newAuthServer(keys)
+	defer auth.Close()
+
+	ts := httptest.NewServer(addRoutes(db, withAuthServer(auth)))
+	defer ts.Close()
+	client := ts.Client()
+
+	put := func(token string) int {
+		data := `{"gaia_id":"` + id + `", "name":"Bruno Latour", "address": "Constantin Hansens Gade 12, 1799 København V"}`
+		req, err := http.NewRequest("PUT", fmt.Sprintf("%v/users/%s", ts.URL, id), strings.NewReader(data))
+		is.NoErr(err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		r, err := client.Do(req)
+		is.NoErr(err)
+		return r.StatusCode
+	}
+
+	sign := func(scope string, audience string, expires time.Time) string {
+		token, err := keys.Sign(tokens.UserToken{Scope: scope, RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokens.Issuer,
+			Subject:   id,
+			Audience:  []string{audience},
+			ExpiresAt: jwt.NewNumericDate(expires),
+		}})
+		is.NoErr(err)
+		return token
+	}
+
+	is.Equal(put(""), http.StatusUnauthorized)
+	is.Equal(put(sign("crm:write", "crm", time.Now().Add(-time.Hour))), http.StatusUnauthorized)
+	is.Equal(put(sign("crm:write", "data", time.Now().Add(time.Hour))), http.StatusForbidden)
+	is.Equal(put(sign("crm:read", "crm", time.Now().Add(time.Hour))), http.StatusForbidden)
+
+	token, err := tokens.NewUserToken(id, tokens.RoleCustomer, keys)
+	is.NoErr(err)
+	is.Equal(put(token), http.StatusOK)
+
+	r, err := client.Get(fmt.Sprintf("%v/users/%s", ts.URL, id))
+	is.NoErr(err)
+	is.Equal(r.StatusCode, http.StatusUnauthorized)
+}
+
+func TestRoles(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+
+	customerA, err := db.CreateUser(database.User{Name: "Bruno Latour"})
+	is.NoErr(err)
+	customerB, err := db.CreateUser(database.User{Name: "Donna Haraway"})
+	is.NoErr(err)
+	is.Equal(customerA.Role, tokens.RoleCustomer)
+
+	keys, err := tokens.NewKeyRing("ES256")
+	is.NoErr(err)
+	auth, revoked := newAuthServer(keys)
+	defer auth.Close()
+
+	ts := httptest.NewServer(addRoutes(db, withAuthServer(auth)))
+	defer ts.Close()
+	client := ts.Client()
+
+	as := func(role string) string {
+		token, err := tokens.NewUserToken(customerA.GaiaId, role, keys)
+		is.NoErr(err)
+		return token
+	}
+	call := func(token string, method string, path string, body string) int {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		is.NoErr(err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r, err := client.Do(req)
+		is.NoErr(err)
+		return r.StatusCode
+	}
+	a := "/users/" + customerA.GaiaId
+	b := "/users/" + customerB.GaiaId
+
+	customer := as(tokens.RoleCustomer)
+	is.Equal(call(customer, "GET", a, ""), http.StatusOK)
+	is.Equal(call(customer, "GET", b, ""), http.StatusForbidden)
+	is.Equal(call(customer, "PUT", b, `{"name": "Bruno Latour"}`), http.StatusForbidden)
+	is.Equal(call(customer, "GET", "/users", ""), http.StatusForbidden)
+	is.Equal(call(customer, "DELETE", a, ""), http.StatusForbidden)
+	is.Equal(call(customer, "PUT", a, `{"name": "Bruno Latour", "role": "admin"}`), http.StatusForbidden)
+	// Updating without a role keeps the role
+	is.Equal(call(customer, "PUT", a, `{"name": "Bruno Latour"}`), http.StatusOK)
+	user, err := db.GetUserById(customerA.GaiaId)
+	is.NoErr(err)
+	is.Equal(user.Role, tokens.RoleCustomer)
+
+	support := as(tokens.RoleSupport)
+	is.Equal(call(support, "GET", b, ""), http.StatusOK)
+	is.Equal(call(support, "PUT", b, `{"name": "Donna Haraway"}`), http.StatusForbidden)
+	is.Equal(call(support, "DELETE", b, ""), http.StatusForbidden)
+
+	is.Equal(call(support, "GET", "/users", ""), http.StatusOK)
+
+	admin := as(tokens.RoleAdmin)
+	is.Equal(call(admin, "GET", "/users", ""), http.StatusOK)
+	is.Equal(call(admin, "PUT", b, `{"name": "Donna Haraway", "role": "support"}`), http.StatusOK)
+	user, err = db.GetUserById(customerB.GaiaId)
+	is.NoErr(err)
+	is.Equal(user.Role, tokens.RoleSupport)
+	// B has to log in again to get a token with the new role
+	is.Equal(*revoked, []string{customerB.GaiaId})
+
+	// A person is never a service, and a role without scopes would break every login
+	is.Equal(call(admin, "PUT", b, `{"role": "service"}`), http.StatusBadRequest)
+	is.Equal(call(admin, "PUT", b, `{"role": "superuser"}`), http.StatusBadRequest)
+	is.Equal(call(admin, "POST", "/users", `{"name": "Isabelle Stengers", "role": "service"}`), http.StatusBadRequest)
+	is.Equal(call(admin, "POST", "/users", `{"name": "Isabelle Stengers", "role": "superuser"}`), http.StatusBadRequest)
+	user, err = db.GetUserById(customerB.GaiaId)
+	is.NoErr(err)
+	is.Equal(user.Role, tokens.RoleSupport)
+	users, err := db.GetUsers()
+	is.NoErr(err)
+	is.Equal(len(users), 2)
+
+	// PUT changes a user, it does not create one
+	missing := uuid.NewString()
+	is.Equal(call(admin, "PUT", "/users/"+missing, `{"name": "Michel Serres"}`), http.StatusNotFound)
+	user, err = db.GetUserById(missing)
+	is.NoErr(err)
+	is.Equal(user.GaiaId, "")
+
+	is.Equal(call(admin, "DELETE", b, ""), http.StatusOK)
+}
+
+// A customer token for A never reaches B, whatever the method
+func TestCustomerOtherUser(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+	a, err := db.CreateUser(database.User{Name: "Bruno Latour"})
+	is.NoErr(err)
+	b, err := db.CreateUser(database.User{Name: "Donna Haraway"})
+	is.NoErr(err)
+
+	ts, sign, close := newTestServer(is, db)
+	defer close()
+	client := ts.Client()
+
+	tokenA := sign(a.GaiaId, tokens.RoleCustomer)
+	call := func(method string, body string) int {
+		req, err := http.NewRequest(method, fmt.Sprintf("%v/users/%s", ts.URL, b.GaiaId), strings.NewReader(body))
+		is.NoErr(err)
+		req.Header.Set("Authorization", "Bearer "+tokenA)
+		r, err := client.Do(req)
+		is.NoErr(err)
+		return r.StatusCode
+	}
+
+	is.Equal(call("GET", ""), http.StatusForbidden)
+	is.Equal(call("PUT", `{"name": "Bruno Latour"}`), http.StatusForbidden)
+	is.Equal(call("DELETE", ""), http.StatusForbidden)
+
+	user, err := db.GetUserById(b.GaiaId)
+	is.NoErr(err)
+	is.Equal(user.Name, "Donna Haraway")
+}
+
+// A customer edits their name, the identity their logins are matched on is not theirs to change
+func TestUpdateUserFields(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+	user, err := db.CreateUser(database.User{Name: "Bruno Latour", MitIdUUID: uuid.New().String(), Provider: "mitid", Subject: "bruno"})
+	is.NoErr(err)
+
+	ts, sign, close := newTestServer(is, db)
+	defer close()
+	client := ts.Client()
+
+	put := func(body string) int {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("%v/users/%s", ts.URL, user.GaiaId), strings.NewReader(body))
+		is.NoErr(err)
+		req.Header.Set("Authorization", "Bearer "+sign(user.GaiaId, tokens.RoleCustomer))
+		r, err := client.Do(req)
+		is.NoErr(err)
+		return r.StatusCode
+	}
+
+	is.Equal(put(`{"name": "Bruno Latour", "mitid_uuid": "someone else", "provider": "oidc", "subject": "someone else", "created_at": 1}`), http.StatusOK)
+	stored, err := db.GetUserById(user.GaiaId)
+	is.NoErr(err)
+	is.Equal(stored.MitIdUUID, user.MitIdUUID)
+	is.Equal(stored.Provider, "mitid")
+	is.Equal(stored.Subject, "bruno")
+	is.Equal(stored.Created, user.Created)
+
+	// Fields left out are kept
+	is.Equal(put(`{}`), http.StatusOK)
+	stored, err = db.GetUserById(user.GaiaId)
+	is.NoErr(err)
+	is.Equal(stored.Name, "Bruno Latour")
+
+	is.Equal(put(`{"name": "Bruno`), http.StatusBadRequest)
+
+	// An address from before addresses were verified is kept, DAR does not know it
+	unverified := database.UnverifiedAddressPrefix + user.GaiaId
+	user.DarId = unverified
+	user.Address = &database.Address{DarId: unverified, Text: "Somewhere"}
+	is.NoErr(db.UpdateUserById(user))
+	is.Equal(put(`{"name": "Bruno Latour", "dar_id": "`+unverified+`"}`), http.StatusOK)
+	stored, err = db.GetUserById(user.GaiaId)
+	is.NoErr(err)
+	is.Equal(stored.Address.Text, "Somewhere")
+}
+
+// Without an auth server there are no keys to verify tokens with, so nothing gets through
+func TestNoAuthServer(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+	u, err := db.CreateUser(database.User{Name: "Bruno Latour"})
+	is.NoErr(err)
+
+	keys, err := tokens.NewKeyRing("ES256")
+	is.NoErr(err)
+	token, err := tokens.NewUserToken(u.GaiaId, tokens.RoleAdmin, keys)
+	is.NoErr(err)
+
+	ts := httptest.NewServer(addRoutes(db, Config{}))
+	defer ts.Close()
+	client := ts.Client()
+
+	for _, path := range []string{"/users/" + u.GaiaId, "/users"} {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		is.NoErr(err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r, err := client.Do(req)
+		is.NoErr(err)
+		is.Equal(r.StatusCode, http.StatusUnauthorized)
+	}
 }
 
 func TestDeleteUser(t *testing.T) {
-	defer cleanup()
 	is := is.New(t)
 
-	db := database.New(testdb)
+	db := database.NewMemoryStore()
 
 	u1 := database.User{
-		GaiaId:  uuid.New().String(),
-		Name:    "Bruno Latour",
-		Address: "Landgreven 10, 1301 København K",
-		DarId:   "0a3f507a-b2e6-32b8-e044-0003ba298018",
+		GaiaId: uuid.New().String(),
+		Name:   "Bruno Latour",
+		DarId:  "0a3f507a-b2e6-32b8-e044-0003ba298018",
 	}
 	_, err := db.CreateUser(u1)
 	is.NoErr(err)
 
-	ts := httptest.NewServer(addRoutes(db))
-	defer ts.Close()
+	ts, sign, close := newTestServer(is, db)
+	defer close()
 
 	client := ts.Client()
 	req, err := http.NewRequest("DELETE", fmt.Sprintf("%v/users/%s", ts.URL, u1.GaiaId), nil)
 	is.NoErr(err)
+	req.Header.Set("Authorization", "Bearer "+sign(uuid.New().String(), tokens.RoleAdmin))
 
 	r, err := client.Do(req)
 	is.NoErr(err)
@@ -130,80 +467,328 @@ func TestDeleteUser(t *testing.T) {
 
 }
 
+func TestDeleteUserRevokesSessions(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+
+	u1 := database.User{
+		GaiaId: uuid.New().String(),
+		Name:   "Bruno Latour",
+		DarId:  "0a3f507a-b2e6-32b8-e044-0003ba298018",
+	}
+	_, err := db.CreateUser(u1)
+	is.NoErr(err)
+
+	keys, err := tokens.NewKeyRing("ES256")
+	is.NoErr(err)
+	auth, revoked := newAuthServer(keys)
+	defer auth.Close()
+
+	ts := httptest.NewServer(addRoutes(db, withAuthServer(auth)))
+	defer ts.Close()
+
+	admin, err := tokens.NewUserToken(uuid.New().String(), tokens.RoleAdmin, keys)
+	is.NoErr(err)
+
+	client := ts.Client()
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%v/users/%s", ts.URL, u1.GaiaId), nil)
+	is.NoErr(err)
+	req.Header.Set("Authorization", "Bearer "+admin)
+
+	r, err := client.Do(req)
+	is.NoErr(err)
+
+	is.Equal(r.StatusCode, http.StatusOK)
+	// The auth server only revokes with a service token from the client credentials grant
+	is.Equal(*revoked, []string{u1.GaiaId})
+}
+
 func TestGetUsers(t *testing.T) {
-	defer cleanup()
 	is := is.New(t)
 
-	db := database.New(testdb)
+	db := database.NewMemoryStore()
 	u1 := database.User{
-		GaiaId:  uuid.New().String(),
-		Name:    "Bruno Latour",
-		Address: "Landgreven 10, 1301 København K",
-		DarId:   "0a3f507a-b2e6-32b8-e044-0003ba298018",
+		GaiaId: uuid.New().String(),
+		Name:   "Bruno Latour",
+		DarId:  "0a3f507a-b2e6-32b8-e044-0003ba298018",
 	}
 
 	u2 := database.User{
-		GaiaId:  uuid.New().String(),
-		Name:    "Bruno Latour",
-		Address: "Landgreven 10, 1301 København K",
-		DarId:   "0a3f507a-b2e6-32b8-e044-0003ba298018",
+		GaiaId: uuid.New().String(),
+		Name:   "Bruno Latour",
+		DarId:  "0a3f507a-b2e6-32b8-e044-0003ba298018",
 	}
 
 	u3 := database.User{
-		GaiaId:  uuid.New().String(),
-		Name:    "Bruno Latour",
-		Address: "Landgreven 10, 1301 København K",
-		DarId:   "0a3f507a-b2e6-32b8-e044-0003ba298018",
+		GaiaId: uuid.New().String(),
+		Name:   "Bruno Latour",
+		DarId:  "0a3f507a-b2e6-32b8-e044-0003ba298018",
 	}
 
 	u4 := database.User{
-		GaiaId:  uuid.New().String(),
-		Name:    "Bruno Latour",
-		Address: "Landgreven 10, 1301 København K",
-		DarId:   "0a3f507a-b2e6-32b8-e044-0003ba298018",
+		GaiaId: uuid.New().String(),
+		Name:   "Bruno Latour",
+		DarId:  "0a3f507a-b2e6-32b8-e044-0003ba298018",
 	}
 
 	rows, _, err := db.BulkCreateUsers([]database.User{u1, u2, u3, u4})
 	is.NoErr(err)
 	is.Equal(rows, int64(4))
 
-	ts := httptest.NewServer(addRoutes(db))
-	defer ts.Close()
+	ts, sign, close := newTestServer(is, db)
+	defer close()
 
 	client := ts.Client()
-	r, err := client.Get(fmt.Sprintf("%v/users", ts.URL))
+	req, err := http.NewRequest("GET", fmt.Sprintf("%v/users", ts.URL), nil)
 	is.NoErr(err)
+	req.Header.Set("Authorization", "Bearer "+sign(uuid.New().String(), tokens.RoleService))
+	r, err := client.Do(req)
+	is.NoErr(err)
+
+	is.Equal(r.StatusCode, http.StatusOK)
 
-	var users []database.User
-	json.NewDecoder(r.Body).Decode(&users)
+	var page database.UserPage
+	json.NewDecoder(r.Body).Decode(&page)
 
-	is.Equal(len(users), 4)
+	is.Equal(len(page.Users), 4)
+	is.Equal(page.Total, int64(4))
+}
+
+// Support browses the users a page at a time
+func TestListUsers(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+	for _, name := range []string{"Bruno Latour", "Donna Haraway", "Isabelle Stengers", "Anna Tsing", "Bruno Bosteels"} {
+		_, err := db.CreateUser(database.User{Name: name, MitIdUUID: uuid.New().String()})
+		is.NoErr(err)
+	}
+
+	ts, sign, close := newTestServer(is, db)
+	defer close()
+	client := ts.Client()
+	support := sign(uuid.New().String(), tokens.RoleSupport)
+
+	list := func(query string) (int, database.UserPage) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%v/users?%s", ts.URL, query), nil)
+		is.NoErr(err)
+		req.Header.Set("Authorization", "Bearer "+support)
+		r, err := client.Do(req)
+		is.NoErr(err)
+		var page database.UserPage
+		if r.StatusCode == http.StatusOK {
+			is.NoErr(json.NewDecoder(r.Body).Decode(&page))
+		}
+		return r.StatusCode, page
+	}
+
+	status, page := list("sort=-name&limit=2")
+	is.Equal(status, http.StatusOK)
+	is.Equal(page.Total, int64(5))
+	is.Equal(page.Users[0].Name, "Isabelle Stengers")
+	is.Equal(page.Users[1].Name, "Donna Haraway")
+	_, page = list("sort=-name&limit=2&cursor=" + page.Next)
+	is.Equal(page.Users[0].Name, "Bruno Latour")
+	_, page = list("sort=-name&limit=2&cursor=" + page.Next)
+	is.Equal(len(page.Users), 1)
+	is.Equal(page.Next, "")
+
+	_, page = list("name=bruno&mitid=true&created_after=2020-01-01")
+	is.Equal(page.Total, int64(2))
+	_, page = list("mitid=false")
+	is.Equal(page.Total, int64(0))
+
+	for _, query := range []string{"sort=role", "cursor=abc", "created_after=yesterday", "mitid=maybe", "limit=-1"} {
+		status, _ = list(query)
+		is.Equal(status, http.StatusBadRequest)
+	}
+}
+
+// Support finds a customer on the phone by name and street
+func TestSearchUsers(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+	ts, sign, close := newTestServer(is, db)
+	defer close()
+	client := ts.Client()
+
+	r, err := post(client, sign("service:auth", tokens.RoleService), fmt.Sprintf("%v/match", ts.URL),
+		fmt.Sprintf(`{ "mitid_uuid":"%s", "name":"Bruno Latour", "dar_id":"%s" }`, uuid.New().String(), fixture.Landgreven10))
+	is.NoErr(err)
+	is.Equal(r.StatusCode, http.StatusOK)
+	_, err = db.CreateUser(database.User{Name: "Søren Kierkegaard"})
+	is.NoErr(err)
+
+	search := func(token string, query string) (int, []database.User) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%v/users/search?%s", ts.URL, query), nil)
+		is.NoErr(err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r, err := client.Do(req)
+		is.NoErr(err)
+		var users []database.User
+		if r.StatusCode == http.StatusOK {
+			is.NoErr(json.NewDecoder(r.Body).Decode(&users))
+		}
+		return r.StatusCode, users
+	}
+
+	support := sign(uuid.New().String(), tokens.RoleSupport)
+	status, users := search(support, "q="+url.QueryEscape("Latour, Landgreven"))
+	is.Equal(status, http.StatusOK)
+	is.Equal(len(users), 1)
+	is.Equal(users[0].Address.Text, "Landgreven 10, 1301 København K")
+	_, users = search(support, "q=soeren")
+	is.Equal(len(users), 1)
+	is.Equal(users[0].Name, "Søren Kierkegaard")
+
+	status, _ = search(support, "q=bruno&limit=none")
+	is.Equal(status, http.StatusBadRequest)
+	status, _ = search(sign(uuid.New().String(), tokens.RoleCustomer), "q=bruno")
+	is.Equal(status, http.StatusForbidden)
+}
+
+// failingStore fails to delete, like a database that has gone away
+type failingStore struct {
+	database.UserStore
+}
+
+func (failingStore) DeleteUser(userId string) error {
+	return database.ErrDatabaseDeleteUser
+}
+
+func TestDeleteUserError(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+	user, err := db.CreateUser(database.User{Name: "Bruno Latour"})
+	is.NoErr(err)
+
+	ts, sign, close := newTestServer(is, failingStore{db})
+	defer close()
+
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%v/users/%s", ts.URL, user.GaiaId), nil)
+	is.NoErr(err)
+	req.Header.Set("Authorization", "Bearer "+sign(uuid.New().String(), tokens.RoleAdmin))
+	r, err := ts.Client().Do(req)
+	is.NoErr(err)
+	is.Equal(r.StatusCode, http.StatusInternalServerError)
+}
+
+func TestRestoreUser(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+	user, err := db.CreateUser(database.User{Name: "Bruno Latour", MitIdUUID: uuid.New().String()})
+	is.NoErr(err)
+
+	ts, sign, close := newTestServer(is, db)
+	defer close()
+	client := ts.Client()
+
+	call := func(role string, method string, path string, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		is.NoErr(err)
+		req.Header.Set("Authorization", "Bearer "+sign(uuid.New().String(), role))
+		r, err := client.Do(req)
+		is.NoErr(err)
+		return r
+	}
+	path := "/users/" + user.GaiaId
+	match := fmt.Sprintf(`{"mitid_uuid": "%s"}`, user.MitIdUUID)
+
+	is.Equal(call(tokens.RoleAdmin, "DELETE", path, "").StatusCode, http.StatusOK)
+	// Deleted users are not matched when they log in
+	is.Equal(call(tokens.RoleService, "POST", "/match", match).StatusCode, http.StatusNotFound)
+	is.Equal(call(tokens.RoleAdmin, "PUT", path, `{"name": "Bruno Latour"}`).StatusCode, http.StatusConflict)
+
+	r := call(tokens.RoleAdmin, "GET", "/users?deleted=true", "")
+	is.Equal(r.StatusCode, http.StatusOK)
+	var page database.UserPage
+	is.NoErr(json.NewDecoder(r.Body).Decode(&page))
+	is.Equal(page.Total, int64(1))
+	is.Equal(page.Users[0].GaiaId, user.GaiaId)
+	is.True(page.Users[0].Deleted.Valid)
+	is.Equal(call(tokens.RoleAdmin, "GET", "/users?deleted=maybe", "").StatusCode, http.StatusBadRequest)
+
+	is.Equal(call(tokens.RoleSupport, "POST", path+"/restore", "").StatusCode, http.StatusForbidden)
+	r = call(tokens.RoleAdmin, "POST", path+"/restore", "")
+	is.Equal(r.StatusCode, http.StatusOK)
+	var restored database.User
+	is.NoErr(json.NewDecoder(r.Body).Decode(&restored))
+	is.Equal(restored.Name, "Bruno Latour")
+	is.Equal(call(tokens.RoleAdmin, "POST", path+"/restore", "").StatusCode, http.StatusNotFound)
+	is.Equal(call(tokens.RoleService, "POST", "/match", match).StatusCode, http.StatusOK)
+
+	// The customer onboarded again before the old user was restored
+	is.Equal(call(tokens.RoleAdmin, "DELETE", path, "").StatusCode, http.StatusOK)
+	_, err = db.CreateUser(database.User{Name: "Bruno Latour", MitIdUUID: user.MitIdUUID})
+	is.NoErr(err)
+	is.Equal(call(tokens.RoleAdmin, "POST", path+"/restore", "").StatusCode, http.StatusConflict)
+}
+
+func TestPurge(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+	kept, err := db.CreateUser(database.User{Name: "Bruno Latour"})
+	is.NoErr(err)
+	purged, err := db.CreateUser(database.User{Name: "Donna Haraway"})
+	is.NoErr(err)
+	is.NoErr(db.DeleteUser(kept.GaiaId))
+	is.NoErr(db.DeleteUser(purged.GaiaId))
+
+	// Within the retention nothing is purged. A done context purges once.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	RunPurge(ctx, db, testConfig)
+	page, err := db.QueryUsers(database.UserQuery{Deleted: true})
+	is.NoErr(err)
+	is.Equal(page.Total, int64(2))
+
+	config := testConfig
+	config.USER_RETENTION = time.Nanosecond
+	config.PURGE_ANONYMISE = true
+	RunPurge(ctx, db, config)
+	page, err = db.QueryUsers(database.UserQuery{Deleted: true})
+	is.NoErr(err)
+	is.Equal(page.Total, int64(2))
+	for _, user := range page.Users {
+		is.Equal(user.Name, "")
+	}
+
+	config.PURGE_ANONYMISE = false
+	RunPurge(ctx, db, config)
+	page, err = db.QueryUsers(database.UserQuery{Deleted: true})
+	is.NoErr(err)
+	is.Equal(page.Total, int64(0))
 }
 
 func TestMitIDUserMatch(t *testing.T) {
-	defer cleanup()
 	is := is.New(t)
 
-	db := database.New(testdb)
+	db := database.NewMemoryStore()
 
 	u := database.User{
 		GaiaId:    uuid.New().String(), // create user should return id from DB
 		MitIdUUID: uuid.New().String(),
 		Name:      "Bruno Latour",
-		Address:   "Landgreven 10, 1301 København K",
 		DarId:     "0a3f507a-b2e6-32b8-e044-0003ba298018",
 	}
 
 	_, err := db.CreateUser(u)
 	is.NoErr(err)
 
-	ts := httptest.NewServer(addRoutes(db))
-	defer ts.Close()
+	ts, sign, close := newTestServer(is, db)
+	defer close()
 	client := ts.Client()
+	service := sign("service:auth", tokens.RoleService)
 
 	var data = fmt.Sprintf(`{ "mitid_uuid":"%s", "name":"%s" }`, u.MitIdUUID, u.Name)
 	req, err := http.NewRequest("POST", fmt.Sprintf("%v/match", ts.URL), strings.NewReader(data))
 	is.NoErr(err)
+	req.Header.Set("Authorization", "Bearer "+service)
 
 	r, err := client.Do(req)
 	is.NoErr(err)
@@ -217,14 +802,14 @@ func TestMitIDUserMatch(t *testing.T) {
 
 // This will not match a user, but create a user
 func TestDarIDUserMatch(t *testing.T) {
-	defer cleanup()
 	is := is.New(t)
 
-	db := database.New(testdb)
+	db := database.NewMemoryStore()
 
-	ts := httptest.NewServer(addRoutes(db))
-	defer ts.Close()
+	ts, sign, close := newTestServer(is, db)
+	defer close()
 	client := ts.Client()
+	service := sign("service:auth", tokens.RoleService)
 
 	mitiduuid := uuid.New().String()
 	name := "Bruno Latour"
@@ -235,6 +820,7 @@ func TestDarIDUserMatch(t *testing.T) {
 
 	req, err := http.NewRequest("POST", fmt.Sprintf("%v/match", ts.URL), strings.NewReader(data))
 	is.NoErr(err)
+	req.Header.Set("Authorization", "Bearer "+service)
 
 	r, err := client.Do(req)
 	is.NoErr(err)
@@ -245,15 +831,57 @@ func TestDarIDUserMatch(t *testing.T) {
 	is.Equal(user.GaiaId != "", true)
 }
 
+// A user created before providers were recorded is matched on mitid_uuid and gets provider and subject
+func TestSubjectUserMatch(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+
+	u := database.User{
+		GaiaId:    uuid.New().String(),
+		MitIdUUID: uuid.New().String(),
+		Name:      "Bruno Latour",
+		DarId:     "0a3f507a-b2e6-32b8-e044-0003ba298018",
+	}
+
+	_, err := db.CreateUser(u)
+	is.NoErr(err)
+
+	ts, sign, close := newTestServer(is, db)
+	defer close()
+	client := ts.Client()
+	service := sign("service:auth", tokens.RoleService)
+
+	subject := uuid.New().String()
+	var data = fmt.Sprintf(`{ "mitid_uuid":"%s", "provider":"mitid", "subject":"%s", "name":"%s" }`, u.MitIdUUID, subject, u.Name)
+	r, err := post(client, service, fmt.Sprintf("%v/match", ts.URL), data)
+	is.NoErr(err)
+	is.Equal(r.StatusCode, http.StatusOK)
+
+	user, err := db.GetUserById(u.GaiaId)
+	is.NoErr(err)
+	is.Equal(user.Provider, "mitid")
+	is.Equal(user.Subject, subject)
+
+	// Now the provider and subject alone are enough
+	data = fmt.Sprintf(`{ "provider":"mitid", "subject":"%s" }`, subject)
+	r, err = post(client, service, fmt.Sprintf("%v/match", ts.URL), data)
+	is.NoErr(err)
+	is.Equal(r.StatusCode, http.StatusOK)
+
+	json.NewDecoder(r.Body).Decode(&user)
+	is.Equal(user.GaiaId, u.GaiaId)
+}
+
 func TestFailedMitIDMatch(t *testing.T) {
-	defer cleanup()
 	is := is.New(t)
 
-	db := database.New(testdb)
+	db := database.NewMemoryStore()
 
-	ts := httptest.NewServer(addRoutes(db))
-	defer ts.Close()
+	ts, sign, close := newTestServer(is, db)
+	defer close()
 	client := ts.Client()
+	service := sign("service:auth", tokens.RoleService)
 
 	mitiduuid := uuid.New().String()
 	name := "Bruno Latour"
@@ -262,15 +890,335 @@ func TestFailedMitIDMatch(t *testing.T) {
 
 	req, err := http.NewRequest("POST", fmt.Sprintf("%v/match", ts.URL), strings.NewReader(data))
 	is.NoErr(err)
+	req.Header.Set("Authorization", "Bearer "+service)
 
 	r, err := client.Do(req)
 	is.NoErr(err)
 	is.Equal(r.StatusCode, http.StatusNotFound)
 }
 
-func cleanup() {
-	err := os.Remove(testdb)
+// The browser only chooses the DAR id, CRM stores the address as DAR has it
+func TestAddressVerification(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+
+	ts, sign, close := newTestServer(is, db)
+	defer close()
+	client := ts.Client()
+	service := sign("service:auth", tokens.RoleService)
+
+	match := func(darId string) *http.Response {
+		data := fmt.Sprintf(`{ "mitid_uuid":"%s", "name":"Bruno Latour", "dar_id":"%s", "address":"landgreven 10 kbh" }`, uuid.New().String(), darId)
+		r, err := post(client, service, fmt.Sprintf("%v/match", ts.URL), data)
+		is.NoErr(err)
+		return r
+	}
+
+	is.Equal(match("c6a8d1b8-7b5e-4a3e-9e0b-1f0a2b3c4d5e").StatusCode, http.StatusUnprocessableEntity)
+	is.Equal(match(fixture.Retired).StatusCode, http.StatusUnprocessableEntity)
+	users, err := db.GetUsers()
+	is.NoErr(err)
+	is.Equal(len(users), 0)
+
+	r := match(fixture.Landgreven10FirstRight)
+	is.Equal(r.StatusCode, http.StatusOK)
+	var user database.User
+	json.NewDecoder(r.Body).Decode(&user)
+	is.Equal(user.Address.Text, "Landgreven 10, 1. th, 1301 København K")
+	is.Equal(user.Address.Street, "Landgreven")
+	is.Equal(user.Address.Floor, "1")
+	is.Equal(user.Address.Door, "th")
+	is.Equal(user.Address.Postcode, "1301")
+	is.Equal(user.Address.MunicipalityCode, "0101")
+	is.True(user.Address.Latitude != 0)
+
+	put := func(body string) int {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("%v/users/%s", ts.URL, user.GaiaId), strings.NewReader(body))
+		is.NoErr(err)
+		req.Header.Set("Authorization", "Bearer "+sign(uuid.New().String(), tokens.RoleAdmin))
+		r, err := client.Do(req)
+		is.NoErr(err)
+		return r.StatusCode
+	}
+
+	// Same DAR id, the address text in the body is ignored
+	is.Equal(put(fmt.Sprintf(`{"name": "Bruno Latour", "dar_id": "%s", "address": "Somewhere else 1"}`, fixture.Landgreven10FirstRight)), http.StatusOK)
+	stored, err := db.GetUserById(user.GaiaId)
+	is.NoErr(err)
+	is.Equal(stored.Address.Text, "Landgreven 10, 1. th, 1301 København K")
+
+	is.Equal(put(`{"name": "Bruno Latour", "dar_id": "c6a8d1b8-7b5e-4a3e-9e0b-1f0a2b3c4d5e"}`), http.StatusUnprocessableEntity)
+
+	is.Equal(put(fmt.Sprintf(`{"name": "Bruno Latour", "dar_id": "%s"}`, fixture.ConstantinHansensGade)), http.StatusOK)
+	stored, err = db.GetUserById(user.GaiaId)
+	is.NoErr(err)
+	is.Equal(stored.Address.Text, "Constantin Hansens Gade 12, 1799 København V")
+	is.Equal(stored.Address.Floor, "")
+}
+
+// A move closes the current residence, support can see who lived at an address on a date
+func TestMoves(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+	user, err := db.CreateUser(database.User{Name: "Bruno Latour"})
+	is.NoErr(err)
+
+	ts, sign, close := newTestServer(is, db)
+	defer close()
+	client := ts.Client()
+	customer := sign(user.GaiaId, tokens.RoleCustomer)
+	moves := fmt.Sprintf("%v/users/%s/moves", ts.URL, user.GaiaId)
+
+	move := func(token string, darId string, movedIn string) int {
+		r, err := post(client, token, moves, fmt.Sprintf(`{"dar_id": "%s", "moved_in": "%s"}`, darId, movedIn))
+		is.NoErr(err)
+		return r.StatusCode
+	}
+
+	is.Equal(move(customer, fixture.Landgreven10, "2020-01-01"), http.StatusCreated)
+	is.Equal(move(customer, fixture.ConstantinHansensGade, "2023-06-01"), http.StatusCreated)
+	is.Equal(move(customer, fixture.Landgreven10, "2022-01-01"), http.StatusConflict)
+	is.Equal(move(customer, fixture.Landgreven10, time.Now().AddDate(0, 1, 0).Format(time.DateOnly)), http.StatusBadRequest)
+	is.Equal(move(customer, "c6a8d1b8-7b5e-4a3e-9e0b-1f0a2b3c4d5e", "2024-01-01"), http.StatusUnprocessableEntity)
+	is.Equal(move(customer, fixture.Landgreven10, "1 January"), http.StatusBadRequest)
+	is.Equal(move(sign(uuid.New().String(), tokens.RoleCustomer), fixture.Landgreven10, "2024-01-01"), http.StatusForbidden)
+
+	req, err := http.NewRequest("GET", moves, nil)
+	is.NoErr(err)
+	req.Header.Set("Authorization", "Bearer "+customer)
+	r, err := client.Do(req)
+	is.NoErr(err)
+	is.Equal(r.StatusCode, http.StatusOK)
+	var residences []database.Residence
+	is.NoErr(json.NewDecoder(r.Body).Decode(&residences))
+	is.Equal(len(residences), 2)
+	is.Equal(residences[0].Address.Text, "Landgreven 10, 1301 København K")
+	is.Equal(residences[0].MovedOut.Format(time.DateOnly), "2023-06-01")
+
+	residents := func(token string, on string) (int, []database.User) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%v/addresses/%s/residents?on=%s", ts.URL, fixture.Landgreven10, on), nil)
+		is.NoErr(err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r, err := client.Do(req)
+		is.NoErr(err)
+		var users []database.User
+		if r.StatusCode == http.StatusOK {
+			is.NoErr(json.NewDecoder(r.Body).Decode(&users))
+		}
+		return r.StatusCode, users
+	}
+
+	status, _ := residents(customer, "2021-01-01")
+	is.Equal(status, http.StatusForbidden)
+	support := sign(uuid.New().String(), tokens.RoleSupport)
+	status, users := residents(support, "2021-01-01")
+	is.Equal(status, http.StatusOK)
+	is.Equal(len(users), 1)
+	is.Equal(users[0].GaiaId, user.GaiaId)
+	_, users = residents(support, "2023-06-01")
+	is.Equal(len(users), 0)
+}
+
+// Subscriptions loaded for an address are claimed by the user who onboards there
+func TestSubscriptions(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+	ts, sign, close := newTestServer(is, db)
+	defer close()
+	client := ts.Client()
+	admin := sign(uuid.New().String(), tokens.RoleAdmin)
+
+	preload := func(token string, data string) int {
+		r, err := post(client, token, fmt.Sprintf("%v/subscriptions", ts.URL), data)
+		is.NoErr(err)
+		return r.StatusCode
+	}
+	electricity := fmt.Sprintf(`{"dar_id": "%s", "product": "electricity", "supply_point_id": "571313100000000001", "start": "2024-01-01"}`, fixture.Landgreven10FirstRight)
+	is.Equal(preload(admin, electricity), http.StatusCreated)
+	is.Equal(preload(admin, electricity), http.StatusConflict)
+	is.Equal(preload(admin, `{"product": "electricity"}`), http.StatusBadRequest)
+	is.Equal(preload(admin, fmt.Sprintf(`{"dar_id": "%s"}`, fixture.Landgreven10)), http.StatusBadRequest)
+	is.Equal(preload(admin, fmt.Sprintf(`{"dar_id": "%s", "product": "electricity", "status": "active"}`, fixture.Landgreven10)), http.StatusBadRequest)
+	is.Equal(preload(sign(uuid.New().String(), tokens.RoleCustomer), electricity), http.StatusForbidden)
+
+	// Onboarding at the access address does not claim the subscription of the apartment
+	match := func(darId string) database.User {
+		data := fmt.Sprintf(`{ "mitid_uuid":"%s", "name":"Bruno Latour", "dar_id":"%s" }`, uuid.New().String(), darId)
+		r, err := post(client, sign("service:auth", tokens.RoleService), fmt.Sprintf("%v/match", ts.URL), data)
+		is.NoErr(err)
+		is.Equal(r.StatusCode, http.StatusOK)
+		var user database.User
+		is.NoErr(json.NewDecoder(r.Body).Decode(&user))
+		return user
+	}
+	neighbour := match(fixture.Landgreven10)
+	subscriptions, err := db.GetSubscriptions(neighbour.GaiaId)
+	is.NoErr(err)
+	is.Equal(len(subscriptions), 0)
+
+	// Only onboarding claims, not logging in again
+	is.Equal(preload(admin, fmt.Sprintf(`{"dar_id": "%s", "product": "heat"}`, fixture.Landgreven10)), http.StatusCreated)
+	again, err := post(client, sign("service:auth", tokens.RoleService), fmt.Sprintf("%v/match", ts.URL), fmt.Sprintf(`{"mitid_uuid": "%s"}`, neighbour.MitIdUUID))
+	is.NoErr(err)
+	is.Equal(again.StatusCode, http.StatusOK)
+	subscriptions, err = db.GetSubscriptions(neighbour.GaiaId)
+	is.NoErr(err)
+	is.Equal(len(subscriptions), 0)
+
+	user := match(fixture.Landgreven10FirstRight)
+	customer := sign(user.GaiaId, tokens.RoleCustomer)
+	subscriptionsURL := fmt.Sprintf("%v/users/%s/subscriptions", ts.URL, user.GaiaId)
+
+	get := func(token string, url string) (int, []byte) {
+		req, err := http.NewRequest("GET", url, nil)
+		is.NoErr(err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r, err := client.Do(req)
+		is.NoErr(err)
+		body, err := io.ReadAll(r.Body)
+		is.NoErr(err)
+		return r.StatusCode, body
+	}
+	status, body := get(customer, subscriptionsURL)
+	is.Equal(status, http.StatusOK)
+	is.NoErr(json.Unmarshal(body, &subscriptions))
+	is.Equal(len(subscriptions), 1)
+	is.Equal(subscriptions[0].Status, database.SubscriptionActive)
+	is.Equal(subscriptions[0].SupplyPointId, "571313100000000001")
+	is.Equal(subscriptions[0].Address.Text, "Landgreven 10, 1. th, 1301 København K")
+	electricityURL := subscriptionsURL + "/" + subscriptions[0].Id
+
+	// Customers read their subscriptions, staff and services change them
+	r, err := post(client, customer, subscriptionsURL, `{"product": "heat"}`)
+	is.NoErr(err)
+	is.Equal(r.StatusCode, http.StatusForbidden)
+	r, err = post(client, admin, subscriptionsURL, `{"product": "heat", "start": "2024-02-01"}`)
+	is.NoErr(err)
+	is.Equal(r.StatusCode, http.StatusCreated)
+	var heat database.Subscription
+	is.NoErr(json.NewDecoder(r.Body).Decode(&heat))
+	is.Equal(heat.DarId, fixture.Landgreven10FirstRight)
+	is.Equal(heat.Status, database.SubscriptionActive)
+
+	put := func(data string) int {
+		req, err := http.NewRequest("PUT", electricityURL, strings.NewReader(data))
+		is.NoErr(err)
+		req.Header.Set("Authorization", "Bearer "+admin)
+		r, err := client.Do(req)
+		is.NoErr(err)
+		return r.StatusCode
+	}
+	is.Equal(put(`{"product": "electricity", "status": "ended", "end": "2023-01-01"}`), http.StatusBadRequest)
+	is.Equal(put(`{"product": "electricity", "status": "pending"}`), http.StatusBadRequest)
+	is.Equal(put(`{"product": "electricity", "supply_point_id": "571313100000000001", "status": "ended", "end": "2025-01-01"}`), http.StatusOK)
+	status, body = get(customer, electricityURL)
+	is.Equal(status, http.StatusOK)
+	var ended database.Subscription
+	is.NoErr(json.Unmarshal(body, &ended))
+	is.Equal(ended.Status, database.SubscriptionEnded)
+	is.Equal(ended.Start.Format(time.DateOnly), "2024-01-01")
+	is.Equal(ended.End.Format(time.DateOnly), "2025-01-01")
+
+	status, _ = get(sign(uuid.New().String(), tokens.RoleCustomer), electricityURL)
+	is.Equal(status, http.StatusForbidden)
+	status, _ = get(sign(neighbour.GaiaId, tokens.RoleCustomer), fmt.Sprintf("%v/users/%s/subscriptions/%s", ts.URL, neighbour.GaiaId, heat.Id))
+	is.Equal(status, http.StatusNotFound)
+
+	req, err := http.NewRequest("DELETE", subscriptionsURL+"/"+heat.Id, nil)
+	is.NoErr(err)
+	req.Header.Set("Authorization", "Bearer "+admin)
+	r, err = client.Do(req)
+	is.NoErr(err)
+	is.Equal(r.StatusCode, http.StatusOK)
+	status, _ = get(customer, subscriptionsURL+"/"+heat.Id)
+	is.Equal(status, http.StatusNotFound)
+}
+
+// Staff and services correct or remove a pending subscription before anyone claims it
+func TestPendingSubscriptions(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+	ts, sign, close := newTestServer(is, db)
+	defer close()
+	client := ts.Client()
+	admin := sign(uuid.New().String(), tokens.RoleAdmin)
+
+	call := func(token string, method string, path string, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		is.NoErr(err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r, err := client.Do(req)
+		is.NoErr(err)
+		return r
+	}
+
+	r := call(admin, "POST", "/subscriptions", fmt.Sprintf(`{"dar_id": "%s", "product": "electricity", "supply_point_id": "571313100000000001"}`, fixture.Landgreven10FirstRight))
+	is.Equal(r.StatusCode, http.StatusCreated)
+	var pending database.Subscription
+	is.NoErr(json.NewDecoder(r.Body).Decode(&pending))
+	path := "/subscriptions/" + pending.Id
+
+	is.Equal(call(sign(uuid.New().String(), tokens.RoleCustomer), "GET", path, "").StatusCode, http.StatusForbidden)
+	is.Equal(call(sign(uuid.New().String(), tokens.RoleSupport), "GET", path, "").StatusCode, http.StatusForbidden)
+	is.Equal(call(sign("service:billing", tokens.RoleService), "GET", path, "").StatusCode, http.StatusOK)
+
+	// The supply point id was wrong, and it is still pending
+	r = call(admin, "PUT", path, `{"product": "electricity", "supply_point_id": "571313100000000002"}`)
+	is.Equal(r.StatusCode, http.StatusOK)
+	is.Equal(call(admin, "PUT", path, `{"product": "electricity", "status": "active"}`).StatusCode, http.StatusBadRequest)
+	r = call(admin, "GET", path, "")
+	is.Equal(r.StatusCode, http.StatusOK)
+	var corrected database.Subscription
+	is.NoErr(json.NewDecoder(r.Body).Decode(&corrected))
+	is.Equal(corrected.SupplyPointId, "571313100000000002")
+	is.Equal(corrected.Status, database.SubscriptionPending)
+	is.Equal(corrected.DarId, fixture.Landgreven10FirstRight)
+
+	is.Equal(call(admin, "DELETE", path, "").StatusCode, http.StatusOK)
+	is.Equal(call(admin, "GET", path, "").StatusCode, http.StatusNotFound)
+
+	// A claimed subscription belongs to the user, and is not found here
+	claimed, err := db.CreateSubscription(database.Subscription{GaiaId: uuid.New().String(), DarId: fixture.Landgreven10, Product: "heat"})
+	is.NoErr(err)
+	is.Equal(call(admin, "GET", "/subscriptions/"+claimed.Id, "").StatusCode, http.StatusNotFound)
+	is.Equal(call(admin, "DELETE", "/subscriptions/"+claimed.Id, "").StatusCode, http.StatusNotFound)
+}
+
+// Matching creates users, so anonymous callers and customers are turned away
+func TestMatchRequiresService(t *testing.T) {
+	is := is.New(t)
+
+	db := database.NewMemoryStore()
+
+	ts, sign, close := newTestServer(is, db)
+	defer close()
+	client := ts.Client()
+
+	data := fmt.Sprintf(`{ "mitid_uuid":"%s", "name":"Bruno Latour", "dar_id":"0a3f507a-b2e6-32b8-e044-0003ba298018", "address":"Landgreven 10, 1301 København K" }`, uuid.New().String())
+
+	r, err := client.Post(fmt.Sprintf("%v/match", ts.URL), "application/json", strings.NewReader(data))
+	is.NoErr(err)
+	is.Equal(r.StatusCode, http.StatusUnauthorized)
+
+	r, err = post(client, sign(uuid.New().String(), tokens.RoleCustomer), fmt.Sprintf("%v/match", ts.URL), data)
+	is.NoErr(err)
+	is.Equal(r.StatusCode, http.StatusForbidden)
+
+	users, err := db.GetUsers()
+	is.NoErr(err)
+	is.Equal(len(users), 0)
+}
+
+func post(client *http.Client, token string, url string, data string) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, strings.NewReader(data))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	return client.Do(req)
 }
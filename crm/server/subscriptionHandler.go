@@ -0,0 +1,257 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/henrikkorsgaard/gaia/crm/dar"
+	"github.com/henrikkorsgaard/gaia/crm/database"
+)
+
+var (
+	ErrSubscriptionProduct  = errors.New("error: a subscription needs a product")
+	ErrSubscriptionAddress  = errors.New("error: a subscription without a user needs a dar_id")
+	ErrSubscriptionStatus   = errors.New("error: status is pending, active or ended, and subscriptions without a user are pending until claimed")
+	ErrSubscriptionEnd      = errors.New("error: a subscription cannot end before it starts")
+	ErrSubscriptionNotFound = errors.New("error: unknown subscription")
+)
+
+type subscriptionRequest struct {
+	DarId         string `json:"dar_id"`
+	Product       string `json:"product"`
+	SupplyPointId string `json:"supply_point_id"`
+	Status        string `json:"status"`
+	Start         string `json:"start"` //YYYY-MM-DD or RFC 3339, defaults to now
+	End           string `json:"end"`
+}
+
+/*
+subscriptionHandler lists and creates the subscriptions of a user. Without
+a user in the path it loads a pending subscription, which the user who
+onboards at the address claims.
+
+	GET  /users/{id}/subscriptions
+	POST /users/{id}/subscriptions
+	POST /subscriptions
+*/
+func subscriptionHandler(db database.UserStore, addresses *dar.Client) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			id := r.PathValue("id")
+
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+			if id != "" && r.Method == http.MethodGet {
+				subscriptions, err := db.GetSubscriptions(id)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(subscriptions)
+				return
+			}
+
+			if r.Method == http.MethodPost {
+				var request subscriptionRequest
+				json.NewDecoder(r.Body).Decode(&request)
+
+				subscription := database.Subscription{GaiaId: id, Status: database.SubscriptionActive}
+				if id == "" {
+					subscription.Status = database.SubscriptionPending
+					if request.DarId == "" {
+						http.Error(w, ErrSubscriptionAddress.Error(), http.StatusBadRequest)
+						return
+					}
+				} else {
+					user, err := db.GetUserById(id)
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+						return
+					}
+					if user.GaiaId == "" {
+						http.Error(w, ErrUserNotFound.Error(), http.StatusNotFound)
+						return
+					}
+					// Most subscriptions are at the address the user lives at
+					if request.DarId == "" {
+						request.DarId = user.DarId
+					}
+				}
+
+				status, err := applySubscription(addresses, request, &subscription)
+				if err != nil {
+					http.Error(w, err.Error(), status)
+					return
+				}
+
+				subscription, err = db.CreateSubscription(subscription)
+				if errors.Is(err, database.ErrDatabaseSupplyPoint) {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(subscription)
+				return
+			}
+
+			http.Error(w, "", http.StatusMethodNotAllowed)
+		},
+	)
+}
+
+/*
+subscriptionIdHandler reads, changes and deletes one subscription of a
+user. Without a user in the path it is a pending subscription no user
+has claimed yet.
+
+	GET    /users/{id}/subscriptions/{subscription}
+	PUT    /users/{id}/subscriptions/{subscription}
+	DELETE /users/{id}/subscriptions/{subscription}
+	GET    /subscriptions/{subscription}
+	PUT    /subscriptions/{subscription}
+	DELETE /subscriptions/{subscription}
+*/
+func subscriptionIdHandler(db database.UserStore, addresses *dar.Client) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			id := r.PathValue("id")
+			subscriptionId := r.PathValue("subscription")
+
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+			subscription, err := db.GetSubscription(id, subscriptionId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if subscription.Id == "" {
+				http.Error(w, ErrSubscriptionNotFound.Error(), http.StatusNotFound)
+				return
+			}
+
+			if r.Method == http.MethodGet {
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(subscription)
+				return
+			}
+
+			if r.Method == http.MethodPut {
+				var request subscriptionRequest
+				json.NewDecoder(r.Body).Decode(&request)
+				if request.DarId == "" {
+					request.DarId = subscription.DarId
+				}
+
+				status, err := applySubscription(addresses, request, &subscription)
+				if err != nil {
+					http.Error(w, err.Error(), status)
+					return
+				}
+
+				err = db.UpdateSubscription(subscription)
+				if errors.Is(err, database.ErrDatabaseSupplyPoint) {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(subscription)
+				return
+			}
+
+			if r.Method == http.MethodDelete {
+				err = db.DeleteSubscription(id, subscriptionId)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			http.Error(w, "", http.StatusMethodNotAllowed)
+		},
+	)
+}
+
+/*
+applySubscription checks the request and copies it to the subscription.
+A new DAR id is verified with DAR. It returns the status to answer with
+if the request is not accepted.
+*/
+func applySubscription(addresses *dar.Client, request subscriptionRequest, subscription *database.Subscription) (int, error) {
+	if request.Product == "" {
+		return http.StatusBadRequest, ErrSubscriptionProduct
+	}
+	subscription.Product = request.Product
+	subscription.SupplyPointId = request.SupplyPointId
+
+	if request.Status != "" {
+		subscription.Status = request.Status
+	}
+	statuses := []string{database.SubscriptionPending, database.SubscriptionActive, database.SubscriptionEnded}
+	pending := subscription.Status == database.SubscriptionPending
+	if !slices.Contains(statuses, subscription.Status) || (pending != (subscription.GaiaId == "") && subscription.Status != database.SubscriptionEnded) {
+		return http.StatusBadRequest, ErrSubscriptionStatus
+	}
+
+	// A PUT without dates keeps the ones the subscription has
+	start, err := parseDate(request.Start, defaultTime(subscription.Start))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	subscription.Start = start.UTC().Truncate(time.Second)
+
+	var end time.Time
+	if subscription.End != nil {
+		end = *subscription.End
+	}
+	subscription.End = nil
+	if request.End != "" || subscription.Status == database.SubscriptionEnded {
+		end, err := parseDate(request.End, defaultTime(end))
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		end = end.UTC().Truncate(time.Second)
+		if end.Before(subscription.Start) {
+			return http.StatusBadRequest, ErrSubscriptionEnd
+		}
+		subscription.End = &end
+	}
+
+	if request.DarId != "" && (request.DarId != subscription.DarId || subscription.Created == 0) {
+		address, err := lookupAddress(addresses, request.DarId)
+		if err != nil {
+			return addressStatus(err), err
+		}
+		subscription.Address = address
+	}
+	subscription.DarId = request.DarId
+
+	return http.StatusOK, nil
+}
+
+// defaultTime is t, or now if t is not set
+func defaultTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return time.Now()
+	}
+	return t
+}
@@ -2,12 +2,49 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/henrikkorsgaard/gaia/auth/clients"
+	"github.com/henrikkorsgaard/gaia/auth/tokens"
+	"github.com/henrikkorsgaard/gaia/crm/dar"
 	"github.com/henrikkorsgaard/gaia/crm/database"
 )
 
-func userIdHandler(db *database.UserDatabase) http.Handler {
+var (
+	ErrRevokeSessions   = errors.New("error: user deleted, but auth server did not revoke sessions")
+	ErrUserNotFound     = errors.New("error: unknown user")
+	ErrUserQueryMitID   = errors.New("error: mitid is true or false")
+	ErrUserQueryLimit   = errors.New("error: limit is a positive number")
+	ErrUserQueryDeleted = errors.New("error: deleted is true or false")
+	ErrUserBody         = errors.New("error: the body is not a JSON user")
+	ErrUserRole         = errors.New("error: role is customer, support or admin")
+)
+
+// userRole reports if a user may have role. Services get their role from the client credentials grant, never from a user.
+func userRole(role string) bool {
+	_, ok := tokens.RoleScopes[role]
+	return ok && role != tokens.RoleService
+}
+
+/*
+userUpdate is what PUT /users/{id} may change. Fields left out are kept.
+The identity a login is matched on is only set by /match. Only admins
+change the role, and only staff the address, customers record a move.
+*/
+type userUpdate struct {
+	Name  *string `json:"name"`
+	DarId *string `json:"dar_id"`
+	Role  *string `json:"role"`
+}
+
+func userIdHandler(db database.UserStore, addresses *dar.Client, serviceTokens *clients.TokenSource, config Config) http.Handler {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 
@@ -30,15 +67,84 @@ func userIdHandler(db *database.UserDatabase) http.Handler {
 
 			if id != "" && r.Method == http.MethodPut {
 
-				var user database.User
-				json.NewDecoder(r.Body).Decode(&user)
+				var update userUpdate
+				err := json.NewDecoder(r.Body).Decode(&update)
+				if err != nil {
+					http.Error(w, ErrUserBody.Error(), http.StatusBadRequest)
+					return
+				}
+				if update.Role != nil && *update.Role != "" && !userRole(*update.Role) {
+					http.Error(w, ErrUserRole.Error(), http.StatusBadRequest)
+					return
+				}
 
-				err := db.UpdateUserById(user)
+				current, err := db.GetUserById(id)
 				if err != nil {
 					http.Error(w, err.Error(), http.StatusInternalServerError)
 					return
 				}
 
+				// A move is recorded as one, and the address decides which pending subscriptions a user may claim
+				claims, _ := tokens.ClaimsFromContext(r.Context())
+				if update.DarId != nil && *update.DarId != current.DarId && !claims.IsStaff() {
+					http.Error(w, ErrAccessMove.Error(), http.StatusForbidden)
+					return
+				}
+
+				// The path decides which user is updated, and only the fields in the body change
+				user := current
+				user.GaiaId = id
+				if update.Name != nil {
+					user.Name = *update.Name
+				}
+				if update.DarId != nil {
+					user.DarId = *update.DarId
+				}
+				if update.Role != nil && *update.Role != "" {
+					user.Role = *update.Role
+				}
+
+				// A new address is verified, an unchanged one is kept whatever the body says.
+				// DAR does not know an unverified address, it is kept until the user gets a DAR id.
+				user.Address = nil
+				unverified := strings.HasPrefix(current.DarId, database.UnverifiedAddressPrefix)
+				if user.DarId != "" && (user.DarId != current.DarId || !unverified && (current.Address == nil || current.Address.Street == "")) {
+					err = verifyAddress(addresses, &user)
+					if err != nil {
+						http.Error(w, err.Error(), addressStatus(err))
+						return
+					}
+				}
+
+				roleChanged := user.Role != current.Role
+				if roleChanged && !claims.HasRole(tokens.RoleAdmin) {
+					http.Error(w, ErrAccessRoleChange.Error(), http.StatusForbidden)
+					return
+				}
+
+				err = db.UpdateUserById(user)
+				if errors.Is(err, database.ErrDatabaseUserUnknown) {
+					http.Error(w, ErrUserNotFound.Error(), http.StatusNotFound)
+					return
+				}
+				if errors.Is(err, database.ErrDatabaseUserDeleted) {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				// Tokens carry the role, so the user has to log in again to get the new one
+				if roleChanged && config.AUTH_SERVER != "" {
+					err = revokeSessions(serviceTokens, config, id)
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusBadGateway)
+						return
+					}
+				}
+
 				w.WriteHeader(http.StatusOK)
 				return
 			}
@@ -46,7 +152,17 @@ func userIdHandler(db *database.UserDatabase) http.Handler {
 			if id != "" && r.Method == http.MethodDelete {
 				err := db.DeleteUser(id)
 				if err != nil {
-					panic(err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				// A deleted customer should be logged out right away, not when their token expires
+				if config.AUTH_SERVER != "" {
+					err = revokeSessions(serviceTokens, config, id)
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusBadGateway)
+						return
+					}
 				}
 
 				w.WriteHeader(http.StatusOK)
@@ -59,7 +175,7 @@ func userIdHandler(db *database.UserDatabase) http.Handler {
 	)
 }
 
-func userHandler(db *database.UserDatabase) http.Handler {
+func userHandler(db database.UserStore, addresses *dar.Client) http.Handler {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 
@@ -67,6 +183,20 @@ func userHandler(db *database.UserDatabase) http.Handler {
 
 				var user database.User
 				json.NewDecoder(r.Body).Decode(&user)
+				if user.Role != "" && !userRole(user.Role) {
+					http.Error(w, ErrUserRole.Error(), http.StatusBadRequest)
+					return
+				}
+
+				// The address is what DAR has for the DAR id, not what the body says
+				user.Address = nil
+				if user.DarId != "" {
+					err := verifyAddress(addresses, &user)
+					if err != nil {
+						http.Error(w, err.Error(), addressStatus(err))
+						return
+					}
+				}
 
 				newUser, err := db.CreateUser(user)
 				if err != nil {
@@ -80,13 +210,23 @@ func userHandler(db *database.UserDatabase) http.Handler {
 
 			if r.Method == http.MethodGet {
 
-				users, err := db.GetUsers()
+				query, err := userQuery(r.URL.Query())
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+
+				page, err := db.QueryUsers(query)
+				if errors.Is(err, database.ErrDatabaseSort) || errors.Is(err, database.ErrDatabaseCursor) {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
 				if err != nil {
 					http.Error(w, err.Error(), http.StatusInternalServerError)
 					return
 				}
-				w.WriteHeader(http.StatusCreated)
-				json.NewEncoder(w).Encode(users)
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(page)
 				return
 			}
 
@@ -95,3 +235,152 @@ func userHandler(db *database.UserDatabase) http.Handler {
 		},
 	)
 }
+
+/*
+restoreHandler undoes DELETE /users/{id} while the user is kept for the
+retention period. The user has to log in again.
+
+	POST /users/{id}/restore
+*/
+func restoreHandler(db database.UserStore) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			user, err := db.RestoreUser(r.PathValue("id"))
+			if errors.Is(err, database.ErrDatabaseRestoreConflict) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if user.GaiaId == "" {
+				http.Error(w, ErrUserNotFound.Error(), http.StatusNotFound)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(user)
+		},
+	)
+}
+
+/*
+searchHandler finds users by words from their name and address, e.g.
+"Latour, Landgreven". Words match from the start, so "lat land" does too.
+
+	GET /users/search?q=...&limit=20
+*/
+func searchHandler(db database.UserStore) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			limit := 0
+			if r.URL.Query().Get("limit") != "" {
+				var err error
+				limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+				if err != nil || limit < 1 {
+					http.Error(w, ErrUserQueryLimit.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+
+			users, err := db.SearchUsers(r.URL.Query().Get("q"), limit)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(users)
+		},
+	)
+}
+
+/*
+userQuery reads the filters of GET /users
+
+	name, dar_id, postcode                        exact, except name which is part of the name
+	created_after, created_before,
+	updated_after, updated_before                 YYYY-MM-DD or RFC 3339
+	mitid                                         true or false
+	deleted                                       true for only deleted users
+	sort                                          name, created or updated, -name etc. for descending
+	limit, cursor                                 page size, and next from the previous page
+*/
+func userQuery(values url.Values) (query database.UserQuery, err error) {
+	query.Name = values.Get("name")
+	query.DarId = values.Get("dar_id")
+	query.Postcode = values.Get("postcode")
+	query.Sort = values.Get("sort")
+	query.Cursor = values.Get("cursor")
+
+	for param, field := range map[string]*int64{
+		"created_after":  &query.CreatedAfter,
+		"created_before": &query.CreatedBefore,
+		"updated_after":  &query.UpdatedAfter,
+		"updated_before": &query.UpdatedBefore,
+	} {
+		if values.Get(param) == "" {
+			continue
+		}
+		t, err := parseDate(values.Get(param), time.Time{})
+		if err != nil {
+			return query, fmt.Errorf("%w: %s", err, param)
+		}
+		*field = t.Unix()
+	}
+
+	if values.Get("mitid") != "" {
+		mitid, err := strconv.ParseBool(values.Get("mitid"))
+		if err != nil {
+			return query, ErrUserQueryMitID
+		}
+		query.MitID = &mitid
+	}
+
+	if values.Get("deleted") != "" {
+		query.Deleted, err = strconv.ParseBool(values.Get("deleted"))
+		if err != nil {
+			return query, ErrUserQueryDeleted
+		}
+	}
+
+	if values.Get("limit") != "" {
+		query.Limit, err = strconv.Atoi(values.Get("limit"))
+		if err != nil || query.Limit < 1 {
+			return query, ErrUserQueryLimit
+		}
+	}
+	return query, nil
+}
+
+// revokeSessions asks the auth gateway to log the user out everywhere
+func revokeSessions(serviceTokens *clients.TokenSource, config Config, gaiaId string) error {
+	token, err := serviceTokens.Token()
+	if err != nil {
+		return errors.Join(ErrRevokeSessions, err)
+	}
+
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%v/account/sessions/%s", config.AUTH_SERVER, url.PathEscape(gaiaId)), nil)
+	if err != nil {
+		return errors.Join(ErrRevokeSessions, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Join(ErrRevokeSessions, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return errors.Join(ErrRevokeSessions, errors.New(string(body)))
+	}
+
+	return nil
+}